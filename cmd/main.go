@@ -2,45 +2,180 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	vpa_clientset "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/client/clientset/versioned"
+	vpa_informers "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/client/informers/externalversions"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 
 	c "github.com/influxdata/vpa-rollout-controller/internal/controller"
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
 )
 
 const (
 	// Default values for command-line flags
 	diffTriggerPercentageDefault      = 10
 	cooldownPeriodDurationDefault     = 15 * time.Minute
-	loopWaitTimeSecondsDefault        = 30
+	resyncPeriodDefault               = 10 * time.Minute
+	workersDefault                    = 4
+	activeRolloutRequeueDefault       = 10 * time.Second
 	patchOperationFieldManagerDefault = "flux-client-side-apply"
+	leaderElectDefault                = true
+	leaderElectionIDDefault           = "vpa-rollout-controller"
+	leaseDurationDefault              = 15 * time.Second
+	renewDeadlineDefault              = 10 * time.Second
+	retryPeriodDefault                = 2 * time.Second
+	metricsBindAddressDefault         = ":8080"
+	dryRunDefault                     = false
+	pendingDeadlineDefault            = 30 * time.Minute
+	inProgressDeadlineDefault         = time.Hour
+	failedRolloutBackoffDefault       = time.Hour
+	recommendationMaxAgeDefault       = 0
+	stabilizationWindowDefault        = 0
+	stabilizationObservationsDefault  = 0
+	oomWindowDefault                  = time.Hour
+	verificationToleranceDefault      = 10
+	surgeBufferGCIntervalDefault      = 10 * time.Minute
+	surgeBufferMaxAgeDefault          = 3 * time.Hour
+	surgeBufferStatefulSetModeDefault = utils.SurgeBufferStatefulSetModeStatefulSet
+
+	// Source component of the Events recorded by the controller
+	eventSourceComponent = "vpa-rollout-controller"
+
+	// Namespace of the controller's pod, used as the default leader election namespace
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 )
 
 func main() {
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	slog.SetDefault(log)
 
 	// Command-line flags with default values
 	diffTriggerPercentageDefault := flag.Int("diffTriggerPercentage", diffTriggerPercentageDefault, "Percentage difference to trigger rollout")
+	cpuIncreaseDiffTriggerPercentageDefault := flag.Int("cpuIncreaseDiffTriggerPercentage", -1, "Percentage difference to trigger a rollout when the CPU recommendation is above the requests. Defaults to diffTriggerPercentage")
+	cpuDecreaseDiffTriggerPercentageDefault := flag.Int("cpuDecreaseDiffTriggerPercentage", -1, "Percentage difference to trigger a rollout when the CPU recommendation is below the requests. Defaults to diffTriggerPercentage")
+	memoryIncreaseDiffTriggerPercentageDefault := flag.Int("memoryIncreaseDiffTriggerPercentage", -1, "Percentage difference to trigger a rollout when the memory recommendation is above the requests. Defaults to diffTriggerPercentage")
+	memoryDecreaseDiffTriggerPercentageDefault := flag.Int("memoryDecreaseDiffTriggerPercentage", -1, "Percentage difference to trigger a rollout when the memory recommendation is below the requests. Defaults to diffTriggerPercentage")
+	minCPUDiffTriggerDefault := flag.String("minCPUDiffTrigger", "0", "Minimum absolute CPU difference to trigger a rollout, on top of the percentage (e.g. '100m')")
+	minMemoryDiffTriggerDefault := flag.String("minMemoryDiffTrigger", "0", "Minimum absolute memory difference to trigger a rollout, on top of the percentage (e.g. '128Mi')")
 	cooldownPeriodDurationDefault := flag.Duration("cooldownPeriodDuration", cooldownPeriodDurationDefault, "Cooldown period before triggering another rollout")
-	loopWaitTimeSecondsDefault := flag.Int("loopWaitTimeSeconds", loopWaitTimeSecondsDefault, "Time to wait between each loop iteration")
+	resyncPeriodDefault := flag.Duration("resyncPeriod", resyncPeriodDefault, "Period at which every VPA is re-evaluated, even if none of its resources changed")
+	workersDefault := flag.Int("workers", workersDefault, "Number of VPAs reconciled concurrently")
+	activeRolloutRequeueDefault := flag.Duration("activeRolloutRequeueInterval", activeRolloutRequeueDefault, "How often VPAs with a 'pending' or 'in-progress' rollout are re-evaluated")
 	patchOperationFieldManagerDefault := flag.String("patchOperationFieldManager", patchOperationFieldManagerDefault, "Field manager for patch operations")
+	leaderElectDefault := flag.Bool("leaderElect", leaderElectDefault, "Enable leader election, so that only one replica of the controller mutates resources at a time")
+	leaderElectionIDDefault := flag.String("leaderElectionID", leaderElectionIDDefault, "Name of the Lease used for leader election")
+	leaderElectionNamespaceDefault := flag.String("leaderElectionNamespace", "", "Namespace of the Lease used for leader election. Defaults to the controller pod's namespace")
+	leaseDurationDefault := flag.Duration("leaseDuration", leaseDurationDefault, "Duration that non-leader replicas wait before trying to acquire leadership")
+	renewDeadlineDefault := flag.Duration("renewDeadline", renewDeadlineDefault, "Duration the leader retries renewing its leadership before giving it up")
+	retryPeriodDefault := flag.Duration("retryPeriod", retryPeriodDefault, "Duration replicas wait between leader election actions")
+	metricsBindAddressDefault := flag.String("metricsBindAddress", metricsBindAddressDefault, "Address the /metrics endpoint binds to. Set to an empty string to disable it")
+	dryRunDefault := flag.Bool("dry-run", dryRunDefault, "Evaluate every VPA and log and record Events about what the controller would do, without mutating any resource")
+	pendingDeadlineDefault := flag.Duration("pendingDeadline", pendingDeadlineDefault, "Maximum time a rollout can stay 'pending', waiting for its surge buffer to be ready, before it is failed. 0 disables the deadline")
+	inProgressDeadlineDefault := flag.Duration("inProgressDeadline", inProgressDeadlineDefault, "Maximum time a rollout can stay 'in-progress' before it is failed. 0 disables the deadline")
+	failedRolloutBackoffDefault := flag.Duration("failedRolloutBackoffDuration", failedRolloutBackoffDefault, "Time to wait after a failed rollout before attempting another one")
+	verificationToleranceDefault := flag.Int("rolloutVerificationTolerancePercentage", verificationToleranceDefault, "Percentage the requests of the pods restarted by a rollout can differ from the VPA recommendation by before the rollout is marked 'unapplied'. 0 disables the verification")
+	stabilizationWindowDefault := flag.Duration("stabilizationWindow", stabilizationWindowDefault, "Time the drift from the recommendation must stay the same, in the same direction, before it triggers a rollout. 0 disables it")
+	stabilizationObservationsDefault := flag.Int("stabilizationObservations", stabilizationObservationsDefault, "Number of evaluations the drift must stay the same in, in the same direction, before it triggers a rollout. 0 disables it")
+	oomWindowDefault := flag.Duration("oomWindow", oomWindowDefault, "Time during which an OOM kill of a workload's container bypasses the cooldown for a rollout that increases its memory, and blocks rollouts that decrease it. 0 disables it")
+	recommendationMaxAgeDefault := flag.Duration("recommendationMaxAge", recommendationMaxAgeDefault, "Age after which a VPA recommendation is not acted on, measured from when the controller first saw its current values. 0 disables the maximum age")
+	surgeBufferGCIntervalDefault := flag.Duration("surgeBufferGCInterval", surgeBufferGCIntervalDefault, "How often orphaned surge buffers are garbage collected, starting at startup. 0 disables the garbage collection")
+	surgeBufferMaxAgeDefault := flag.Duration("surgeBufferMaxAge", surgeBufferMaxAgeDefault, "Age after which a surge buffer is garbage collected, even if its rollout is still 'pending' or 'in-progress'. 0 disables the maximum age")
+	surgeBufferStatefulSetModeDefault := flag.String("surgeBufferStatefulSetMode", surgeBufferStatefulSetModeDefault, "How the surge buffer of a StatefulSet is built: 'statefulset' (same volumeClaimTemplates, PVCs deleted with the surge buffer), 'ephemeral' (ephemeral volumes instead of volumeClaimTemplates) or 'deployment' (a Deployment with ephemeral volumes)")
+	surgeBufferPodTemplateOverridesFile := flag.String("surgeBufferPodTemplateOverridesFile", "", "Path to a YAML or JSON file of pod template overrides applied to every surge buffer: annotations, removeAnnotations, labels, removeLabels, priorityClassName, nodeSelector, tolerations and affinity")
 	flag.Parse()
 	diffTriggerPercentage := *diffTriggerPercentageDefault
+	triggerThresholds := c.TriggerThresholds{
+		CPUIncreasePercent:    percentageOrDefault(*cpuIncreaseDiffTriggerPercentageDefault, diffTriggerPercentage),
+		CPUDecreasePercent:    percentageOrDefault(*cpuDecreaseDiffTriggerPercentageDefault, diffTriggerPercentage),
+		MemoryIncreasePercent: percentageOrDefault(*memoryIncreaseDiffTriggerPercentageDefault, diffTriggerPercentage),
+		MemoryDecreasePercent: percentageOrDefault(*memoryDecreaseDiffTriggerPercentageDefault, diffTriggerPercentage),
+	}
+	var err error
+	if triggerThresholds.MinCPUDelta, err = resource.ParseQuantity(*minCPUDiffTriggerDefault); err != nil {
+		log.Error("Invalid minimum CPU difference to trigger a rollout", "err", err, "minCPUDiffTrigger", *minCPUDiffTriggerDefault)
+		os.Exit(1)
+	}
+	if triggerThresholds.MinMemoryDelta, err = resource.ParseQuantity(*minMemoryDiffTriggerDefault); err != nil {
+		log.Error("Invalid minimum memory difference to trigger a rollout", "err", err, "minMemoryDiffTrigger", *minMemoryDiffTriggerDefault)
+		os.Exit(1)
+	}
 	cooldownPeriodDuration := *cooldownPeriodDurationDefault
-	loopWaitTimeDuration := time.Duration(*loopWaitTimeSecondsDefault) * time.Second
+	resyncPeriod := *resyncPeriodDefault
+	workers := *workersDefault
+	if workers < 1 {
+		log.Error("The number of workers must be at least 1", "workers", workers)
+		os.Exit(1)
+	}
+	activeRolloutRequeueInterval := *activeRolloutRequeueDefault
 	patchOperationFieldManager := *patchOperationFieldManagerDefault
-	log.Info("Starting VPA Rollout Controller with parameters", "diffTriggerPercentage", diffTriggerPercentage, "cooldownPeriodDuration", cooldownPeriodDuration, "loopWaitTimeDuration", loopWaitTimeDuration, "patchOperationFieldManager", patchOperationFieldManager)
+	leaderElect := *leaderElectDefault
+	leaderElectionID := *leaderElectionIDDefault
+	leaderElectionNamespace := *leaderElectionNamespaceDefault
+	if leaderElectionNamespace == "" {
+		leaderElectionNamespace = podNamespace()
+	}
+	leaseDuration := *leaseDurationDefault
+	renewDeadline := *renewDeadlineDefault
+	retryPeriod := *retryPeriodDefault
+	metricsBindAddress := *metricsBindAddressDefault
+	dryRun := *dryRunDefault
+	pendingDeadline := *pendingDeadlineDefault
+	inProgressDeadline := *inProgressDeadlineDefault
+	failedRolloutBackoffDuration := *failedRolloutBackoffDefault
+	rolloutVerificationTolerance := *verificationToleranceDefault
+	recommendationMaxAge := *recommendationMaxAgeDefault
+	oomWindow := *oomWindowDefault
+	stabilization := c.StabilizationConfig{
+		Window:       *stabilizationWindowDefault,
+		Observations: *stabilizationObservationsDefault,
+	}
+	surgeBufferGCInterval := *surgeBufferGCIntervalDefault
+	surgeBufferMaxAge := *surgeBufferMaxAgeDefault
+	surgeBufferStatefulSetMode := *surgeBufferStatefulSetModeDefault
+	var surgeBufferPodTemplateOverrides c.PodTemplateOverrides
+	if *surgeBufferPodTemplateOverridesFile != "" {
+		surgeBufferPodTemplateOverrides, err = c.LoadPodTemplateOverrides(*surgeBufferPodTemplateOverridesFile)
+		if err != nil {
+			log.Error("Error loading the surge buffer pod template overrides", "err", err, "surgeBufferPodTemplateOverridesFile", *surgeBufferPodTemplateOverridesFile)
+			os.Exit(1)
+		}
+	}
+	switch surgeBufferStatefulSetMode {
+	case utils.SurgeBufferStatefulSetModeStatefulSet, utils.SurgeBufferStatefulSetModeEphemeral, utils.SurgeBufferStatefulSetModeDeployment:
+	default:
+		log.Error("The surge buffer StatefulSet mode must be one of 'statefulset', 'ephemeral' or 'deployment'", "surgeBufferStatefulSetMode", surgeBufferStatefulSetMode)
+		os.Exit(1)
+	}
+	log.Info("Starting VPA Rollout Controller with parameters", "diffTriggerPercentage", diffTriggerPercentage, "cpuIncreaseDiffTriggerPercentage", triggerThresholds.CPUIncreasePercent, "cpuDecreaseDiffTriggerPercentage", triggerThresholds.CPUDecreasePercent, "memoryIncreaseDiffTriggerPercentage", triggerThresholds.MemoryIncreasePercent, "memoryDecreaseDiffTriggerPercentage", triggerThresholds.MemoryDecreasePercent, "minCPUDiffTrigger", triggerThresholds.MinCPUDelta.String(), "minMemoryDiffTrigger", triggerThresholds.MinMemoryDelta.String(), "cooldownPeriodDuration", cooldownPeriodDuration, "resyncPeriod", resyncPeriod, "workers", workers, "activeRolloutRequeueInterval", activeRolloutRequeueInterval, "patchOperationFieldManager", patchOperationFieldManager, "leaderElect", leaderElect, "leaderElectionID", leaderElectionID, "leaderElectionNamespace", leaderElectionNamespace, "leaseDuration", leaseDuration, "renewDeadline", renewDeadline, "retryPeriod", retryPeriod, "metricsBindAddress", metricsBindAddress, "dryRun", dryRun, "pendingDeadline", pendingDeadline, "inProgressDeadline", inProgressDeadline, "failedRolloutBackoffDuration", failedRolloutBackoffDuration, "rolloutVerificationTolerancePercentage", rolloutVerificationTolerance, "recommendationMaxAge", recommendationMaxAge, "stabilizationWindow", stabilization.Window, "stabilizationObservations", stabilization.Observations, "oomWindow", oomWindow, "surgeBufferGCInterval", surgeBufferGCInterval, "surgeBufferMaxAge", surgeBufferMaxAge, "surgeBufferStatefulSetMode", surgeBufferStatefulSetMode)
 
 	// Setup client-go
 	config, err := rest.InClusterConfig()
@@ -55,121 +190,176 @@ func main() {
 	if err != nil {
 		panic(err.Error())
 	}
+	vpaClient, err := vpa_clientset.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
 
-	// Main loop
-	for {
-		vpaClient, err := vpa_clientset.NewForConfig(config)
-		if err != nil {
-			panic(err.Error())
-		}
-		vpas, err := vpaClient.AutoscalingV1().VerticalPodAutoscalers(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
-		if err != nil {
-			panic(err.Error())
+	// Resolve the resources of the VPAs' target workloads from the API server's discovery information, cached in memory
+	restMapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery()))
+
+	// Serve the Prometheus metrics on every replica, whether it is the leader or not
+	if metricsBindAddress != "" {
+		go serveMetrics(ctx, metricsBindAddress)
+	}
+
+	// Setup the shared informers for VPAs, pods and the VPAs' target workloads
+	vpaInformerFactory := vpa_informers.NewSharedInformerFactory(vpaClient, resyncPeriod)
+	kubeInformerFactory := informers.NewSharedInformerFactory(clientset, resyncPeriod)
+	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, resyncPeriod)
+
+	// Watch the LimitRanges like the VPA admission controller, to compute the recommendations it actually applies.
+	// The calculator starts and syncs its own informer, so it gets a factory of its own.
+	limitRangeCalculator, err := limitrange.NewLimitsRangeCalculator(informers.NewSharedInformerFactory(clientset, resyncPeriod))
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// Record Events about the controller's decisions on VPAs and their target workloads
+	eventBroadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events(metav1.NamespaceAll)})
+	defer eventBroadcaster.Shutdown()
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventSourceComponent})
+
+	controller, err := c.NewController(ctx, c.Config{
+		TriggerThresholds:            triggerThresholds,
+		CooldownPeriodDuration:       cooldownPeriodDuration,
+		PatchOperationFieldManager:   patchOperationFieldManager,
+		Workers:                      workers,
+		ActiveRolloutRequeueInterval: activeRolloutRequeueInterval,
+		DryRun:                       dryRun,
+		PendingDeadline:              pendingDeadline,
+		InProgressDeadline:           inProgressDeadline,
+		FailedRolloutBackoffDuration: failedRolloutBackoffDuration,
+		RolloutVerificationTolerance: rolloutVerificationTolerance,
+		RecommendationMaxAge:         recommendationMaxAge,
+		Stabilization:                stabilization,
+		OOMWindow:                    oomWindow,
+		SurgeBufferGCInterval:        surgeBufferGCInterval,
+		SurgeBufferMaxAge:            surgeBufferMaxAge,
+		SurgeBuffer: c.SurgeBufferConfig{
+			StatefulSetMode:      surgeBufferStatefulSetMode,
+			PodTemplateOverrides: surgeBufferPodTemplateOverrides,
+		},
+	}, dynamicClient, restMapper, recorder, vpaInformerFactory.Autoscaling().V1().VerticalPodAutoscalers(), kubeInformerFactory.Core().V1().Pods(), dynamicInformerFactory, limitRangeCalculator)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	vpaInformerFactory.Start(ctx.Done())
+	kubeInformerFactory.Start(ctx.Done())
+	dynamicInformerFactory.Start(ctx.Done())
+	defer vpaInformerFactory.Shutdown()
+	defer kubeInformerFactory.Shutdown()
+	defer dynamicInformerFactory.Shutdown()
+
+	// Without leader election, this replica is the only one allowed to mutate resources
+	if !leaderElect {
+		if err := controller.Run(ctx); err != nil {
+			log.Error("Error running controller", "err", err)
+			os.Exit(1)
 		}
-		log.Info("Processing list of VPAs in the cluster", "Total", len(vpas.Items))
-
-		for _, vpa := range vpas.Items {
-
-			// Check if the VPA is eligible for processing
-			if !c.VPAIsEligible(ctx, vpa) {
-				continue
-			}
-			log.Info("Processing VPA", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name)
-
-			// Get the VPA's target workload resource
-			workload, err := c.GetTargetWorkload(ctx, vpa, dynamicClient)
-			if err != nil {
-				log.Error("Error fetching target workload", "err", err)
-				continue
-			}
-			workloadName := workload["metadata"].(map[string]interface{})["name"]
-			workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
-
-			rolloutStatus := c.GetRolloutStatus(ctx, vpa)
-			// Check if there is a pending rollout that needs to be triggered
-			if rolloutStatus == "pending" {
-				log.Info("Rollout is pending for VPA", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name)
-
-				// Check if the surge buffer workload is ready
-				surgeBufferWorkloadStatus, err := c.GetSurgeBufferWorkloadStatus(ctx, dynamicClient, clientset, vpa, workload)
-				if err != nil {
-					log.Error("Error checking if surge buffer workload exists", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-					continue
-				}
-				if surgeBufferWorkloadStatus != "Ready" {
-					log.Info("Surge buffer workload is not ready, skipping", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace, "SurgeBufferWorkloadStatus", surgeBufferWorkloadStatus)
-					continue
-				}
+		return
+	}
 
-				// Trigger the rollout restart and set the VPA's rollout status to "in-progress"
-				err = c.TriggerPendingRollout(ctx, vpa, workload, dynamicClient, patchOperationFieldManager)
-				if err != nil {
-					log.Error("Error triggering pending rollout", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-					continue
+	// All replicas keep their informer caches warm, but only the leader runs the workers that mutate resources
+	identity, err := os.Hostname()
+	if err != nil {
+		panic(err.Error())
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaderElectionID,
+			Namespace: leaderElectionNamespace,
+		},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	// OnStartedLeading runs in its own goroutine, so the WaitGroup is only added to under the lock, and never once the
+	// elector has returned, for the Add to happen before the Wait
+	var (
+		leading     sync.WaitGroup
+		leadingMu   sync.Mutex
+		stopLeading bool
+	)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            leaderElectionID,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				leadingMu.Lock()
+				if stopLeading {
+					leadingMu.Unlock()
+					return
 				}
-				log.Info("Pending rollout triggered", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-				continue
-			}
-			// Check if an in-progress rollout is completed
-			if rolloutStatus == "in-progress" {
-				// Check if the workload pods are healthy and have restarted since the last rollout
-				rolloutIsCompleted, err := c.RolloutIsCompleted(ctx, vpa, workload, clientset)
-				if err != nil {
-					log.Error("Error checking if rollout is completed", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-					continue
+				leading.Add(1)
+				leadingMu.Unlock()
+				defer leading.Done()
+				log.Info("Acquired leadership, starting controller", "identity", identity)
+				if err := controller.Run(leaderCtx); err != nil {
+					log.Error("Error running controller", "err", err)
 				}
-				if !rolloutIsCompleted {
-					log.Info("Rollout is still in progress for VPA", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-					continue
+			},
+			OnStoppedLeading: func() {
+				log.Info("Stopped leading", "identity", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Info("Another replica is the leader", "leader", leader, "identity", identity)
 				}
+			},
+		},
+	})
+	// Wait for in-flight work to stop before exiting
+	leadingMu.Lock()
+	stopLeading = true
+	leadingMu.Unlock()
+	leading.Wait()
 
-				// Cleanup the buffer workload if it exists and is ready
-				// If its status is "NotFound", we implicitly skip this step
-				surgeBufferWorkloadStatus, err := c.GetSurgeBufferWorkloadStatus(ctx, dynamicClient, clientset, vpa, workload)
-				if err != nil {
-					log.Error("Error getting surge buffer workload status", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-					continue
-				}
-				if surgeBufferWorkloadStatus == "Ready" {
-					log.Info("Deleting the surge buffer workload", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-					err := c.DeleteSurgeBufferWorkload(ctx, dynamicClient, vpa, workload)
-					if err != nil {
-						log.Error("Error deleting surge buffer workload", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-						continue
-					}
-					log.Info("Surge buffer workload deleted", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-				}
+	// The workqueue cannot be restarted once shut down, so a replica that lost its leadership exits and starts over as a follower
+	if ctx.Err() == nil {
+		log.Error("Leadership lost, exiting", "identity", identity)
+		os.Exit(1)
+	}
+}
 
-				// Set the VPA's rollout status to "complete"
-				c.SetRolloutStatus(ctx, vpa, dynamicClient, patchOperationFieldManager, "complete")
-				log.Info("Rollout completed for VPA", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-				continue
-			}
-
-			// Check if the cooldown period has elapsed
-			cooldownHasElapsed, err := c.CooldownHasElapsed(ctx, clientset, vpa, workload, cooldownPeriodDuration)
-			if err != nil {
-				log.Error("Error checking cooldown period", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-				continue
-			}
-			if cooldownHasElapsed {
-				// Check if a rollout is needed
-				rolloutIsNeeded, err := c.RolloutIsNeeded(ctx, clientset, vpa, workload, diffTriggerPercentage)
-				if err != nil {
-					log.Error("Error checking if rollout is needed", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-					continue
-				}
-				if rolloutIsNeeded {
-					err := c.TriggerRollout(ctx, workload, vpa, dynamicClient, patchOperationFieldManager)
-					if err != nil {
-						log.Error("Error triggering rollout", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-						continue
-					}
-				}
-				log.Info("No rollout needed for VPA Target Workload", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name)
-			}
-		}
+// Serves the Prometheus metrics until the context is cancelled
+func serveMetrics(ctx context.Context, bindAddress string) {
+	log := slog.Default()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: bindAddress, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	log.Info("Serving metrics", "bindAddress", bindAddress)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error("Error serving metrics", "err", err, "bindAddress", bindAddress)
+	}
+}
+
+// Returns the namespace the controller's pod runs in, falling back to 'default' when running outside of a pod
+func podNamespace() string {
+	namespace, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil || strings.TrimSpace(string(namespace)) == "" {
+		return metav1.NamespaceDefault
+	}
+	return strings.TrimSpace(string(namespace))
+}
 
-		time.Sleep(loopWaitTimeDuration)
+// Returns the percentage set by a flag, or the default percentage when the flag is left unset (negative)
+func percentageOrDefault(percentage, defaultPercentage int) int {
+	if percentage < 0 {
+		return defaultPercentage
 	}
+	return percentage
 }
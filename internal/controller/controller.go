@@ -0,0 +1,675 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	vpa_informers "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/client/informers/externalversions/autoscaling.k8s.io/v1"
+	vpa_listers "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/client/listers/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// Name of the VPA informer index that maps a target workload to the VPAs referencing it
+	vpaByTargetIndex = "vpaByTarget"
+)
+
+// Workload resources that are watched from startup. Other kinds get an informer the first time a VPA targets them.
+var defaultWorkloadGVRs = []schema.GroupVersionResource{
+	{Group: "apps", Version: "v1", Resource: "deployments"},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"},
+}
+
+// Config holds the controller-wide settings, set from the command-line flags
+type Config struct {
+	// Thresholds above which the drift of a container from its recommendation triggers a rollout
+	TriggerThresholds          TriggerThresholds
+	CooldownPeriodDuration     time.Duration
+	PatchOperationFieldManager string
+	// Number of VPAs reconciled concurrently
+	Workers int
+	// How often VPAs with a 'pending' or 'in-progress' rollout are re-evaluated
+	ActiveRolloutRequeueInterval time.Duration
+	// Only log and record Events about what the controller would do, for every VPA
+	DryRun bool
+	// Maximum time a rollout can stay 'pending' or 'in-progress' before it is failed, 0 disables the deadline
+	PendingDeadline    time.Duration
+	InProgressDeadline time.Duration
+	// Time to wait after a failed or unapplied rollout before attempting another one
+	FailedRolloutBackoffDuration time.Duration
+	// Percentage the requests of the pods restarted by a rollout can differ from the recommendation by, 0 disables the verification
+	RolloutVerificationTolerance int
+	// How long the drift must stay the same before it triggers a rollout
+	Stabilization StabilizationConfig
+	// Time during which an OOM kill bypasses the cooldown for memory increases and blocks memory decreases, 0 disables it
+	OOMWindow time.Duration
+	// Age after which a VPA recommendation is not acted on, 0 disables it
+	RecommendationMaxAge time.Duration
+	// How often orphaned surge buffers are garbage collected, 0 disables it
+	SurgeBufferGCInterval time.Duration
+	// Age after which a surge buffer is garbage collected even if its rollout is still active, 0 disables it
+	SurgeBufferMaxAge time.Duration
+	// Cluster-wide settings of the surge buffer workloads
+	SurgeBuffer SurgeBufferConfig
+}
+
+// Controller reconciles VPAs and their target workloads.
+// VPAs, workloads and pods are read from shared informer caches, and VPAs are processed from a rate-limited workqueue keyed by VPA namespace/name.
+type Controller struct {
+	config        Config
+	dynamicClient dynamic.Interface
+	restMapper    meta.RESTMapper
+	recorder      record.EventRecorder
+
+	vpaLister  vpa_listers.VerticalPodAutoscalerLister
+	vpaIndexer cache.Indexer
+	podLister  corelisters.PodLister
+	workloads  *workloadInformers
+	// Computes the LimitRanges of a namespace, to derive the effective recommendations from the VPAs'
+	limitRanges limitrange.LimitRangeCalculator
+	// When the VPAs' recommendations were first seen and why they were last skipped
+	recommendations *RecommendationTracker
+	// Drift histories of the VPAs in dry-run, which are not recorded on the VPAs
+	dryRunDriftHistories *DryRunDriftHistories
+
+	cacheSyncs []cache.InformerSynced
+	queue      workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewController wires the informers' event handlers to the controller's workqueue.
+// It must be called before the informer factories are started.
+func NewController(ctx context.Context, config Config, dynamicClient dynamic.Interface, restMapper meta.RESTMapper, recorder record.EventRecorder, vpaInformer vpa_informers.VerticalPodAutoscalerInformer, podInformer coreinformers.PodInformer, dynamicInformerFactory dynamicinformer.DynamicSharedInformerFactory, limitRanges limitrange.LimitRangeCalculator) (*Controller, error) {
+	c := &Controller{
+		config:               config,
+		dynamicClient:        dynamicClient,
+		restMapper:           restMapper,
+		recorder:             recorder,
+		vpaLister:            vpaInformer.Lister(),
+		vpaIndexer:           vpaInformer.Informer().GetIndexer(),
+		podLister:            podInformer.Lister(),
+		limitRanges:          limitRanges,
+		recommendations:      NewRecommendationTracker(),
+		dryRunDriftHistories: NewDryRunDriftHistories(),
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "vpas"},
+		),
+	}
+
+	if err := vpaInformer.Informer().AddIndexers(cache.Indexers{vpaByTargetIndex: vpaTargetIndexFunc}); err != nil {
+		return nil, fmt.Errorf("error adding VPA target index: %v", err)
+	}
+	if _, err := vpaInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueVPA,
+		UpdateFunc: c.handleVPAUpdate,
+	}); err != nil {
+		return nil, fmt.Errorf("error adding VPA event handler: %v", err)
+	}
+	if _, err := podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.handlePod,
+		UpdateFunc: c.handlePodUpdate,
+		DeleteFunc: c.handlePod,
+	}); err != nil {
+		return nil, fmt.Errorf("error adding pod event handler: %v", err)
+	}
+
+	c.workloads = newWorkloadInformers(ctx, dynamicInformerFactory, cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.handleWorkload,
+		UpdateFunc: c.handleWorkloadUpdate,
+		DeleteFunc: c.handleWorkload,
+	})
+	c.cacheSyncs = []cache.InformerSynced{vpaInformer.Informer().HasSynced, podInformer.Informer().HasSynced}
+	for _, gvr := range defaultWorkloadGVRs {
+		informer, err := c.workloads.register(gvr)
+		if err != nil {
+			return nil, err
+		}
+		c.cacheSyncs = append(c.cacheSyncs, informer.Informer().HasSynced)
+	}
+
+	return c, nil
+}
+
+// Run waits for the informer caches to sync, then processes VPAs from the workqueue until the context is cancelled.
+// It returns once the workers have finished their in-flight reconciliations, so that no mutation happens after it returns.
+func (c *Controller) Run(ctx context.Context) error {
+	log := slog.Default()
+	defer utilruntime.HandleCrash()
+
+	log.Info("Waiting for informer caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), c.cacheSyncs...) {
+		c.queue.ShutDown()
+		return fmt.Errorf("timed out waiting for informer caches to sync")
+	}
+
+	log.Info("Starting VPA workers", "workers", c.config.Workers)
+	var workers sync.WaitGroup
+	for i := 0; i < c.config.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.UntilWithContext(ctx, c.runWorker, time.Second)
+		}()
+	}
+
+	if c.config.SurgeBufferGCInterval > 0 {
+		log.Info("Starting orphaned surge buffer garbage collection", "interval", c.config.SurgeBufferGCInterval)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.UntilWithContext(ctx, c.collectOrphanedSurgeBuffers, c.config.SurgeBufferGCInterval)
+		}()
+	}
+
+	<-ctx.Done()
+	log.Info("Shutting down VPA workers")
+	c.queue.ShutDown()
+	workers.Wait()
+	log.Info("VPA workers stopped")
+	return nil
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+// Pops a VPA key off the workqueue and reconciles it.
+// The VPA is requeued with backoff on error, or at the time the reconciliation asked to be re-evaluated.
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	log := slog.Default()
+
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+	// The queue still hands out its remaining items after shutdown, don't act on them once we have been told to stop
+	if ctx.Err() != nil {
+		return false
+	}
+
+	start := time.Now()
+	requeueAfter, err := c.reconcile(ctx, key)
+	if err != nil {
+		metrics.ReconcileDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		log.Error("Error reconciling VPA, requeuing", "err", err, "key", key, "requeues", c.queue.NumRequeues(key))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	metrics.ReconcileDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
+	c.queue.Forget(key)
+	if requeueAfter > 0 {
+		log.Debug("Scheduling VPA re-evaluation", "key", key, "requeueAfter", requeueAfter.Round(time.Second))
+		c.queue.AddAfter(key, requeueAfter)
+	}
+	return true
+}
+
+// Reconciles a single VPA, identified by its namespace/name key.
+// It returns how long to wait before the VPA is re-evaluated, or 0 to wait for the next event affecting it.
+func (c *Controller) reconcile(ctx context.Context, key string) (time.Duration, error) {
+	log := slog.Default()
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		log.Error("Invalid VPA key", "err", err, "key", key)
+		return 0, nil
+	}
+	vpaObj, err := c.vpaLister.VerticalPodAutoscalers(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Debug("VPA no longer exists", "Name", name, "Namespace", namespace)
+			metrics.DeleteVPA(namespace, name)
+			c.recommendations.forget(key)
+			c.dryRunDriftHistories.forget(key)
+			return 0, nil
+		}
+		return 0, err
+	}
+	vpa := *vpaObj.DeepCopy()
+
+	// Check if the VPA is eligible for processing
+	if !VPAIsEligible(ctx, vpa) {
+		return 0, nil
+	}
+	dryRun := VPAIsInDryRun(ctx, c.recorder, vpa, c.config.DryRun)
+	log.Info("Processing VPA", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name, "DryRun", dryRun)
+
+	// Get the VPA's target workload resource
+	workload, err := GetTargetWorkload(ctx, vpa, c.workloads, c.restMapper)
+	if err != nil {
+		log.Error("Error fetching target workload", "err", err)
+		recordEvent(c.recorder, vpa, nil, corev1.EventTypeWarning, EventReasonAPIError, "Error fetching target workload %s %s: %v", vpa.Spec.TargetRef.Kind, vpa.Spec.TargetRef.Name, err)
+		return 0, err
+	}
+	workloadName := workload["metadata"].(map[string]interface{})["name"]
+	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
+	workloadKind := workload["kind"].(string)
+
+	rolloutStatus := GetRolloutStatus(ctx, vpa)
+	rolloutStatusUpdatedAt, rolloutStatusUpdatedAtFound := GetRolloutStatusUpdatedAt(ctx, vpa)
+	// Pending rollouts started before the timestamp annotation existed get one, so that their phase deadline applies.
+	// In-progress ones are left as is, since their completion is checked against the time the rollout was triggered.
+	if rolloutStatus == "pending" && !rolloutStatusUpdatedAtFound {
+		err := SetRolloutStatus(ctx, vpa, c.dynamicClient, c.recorder, c.config.PatchOperationFieldManager, rolloutStatus, dryRun)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Check if there is a pending rollout that needs to be triggered
+	if rolloutStatus == "pending" {
+		log.Info("Rollout is pending for VPA", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name)
+
+		// Keep the surge buffer in line with the latest recommendation while the rollout is pending, and recreate it if it was deleted
+		surgeBufferChanged, err := EnsureSurgeBufferWorkload(ctx, c.dynamicClient, c.restMapper, c.workloads, c.limitRanges, c.recorder, vpa, workload, c.config.SurgeBuffer, dryRun)
+		if err != nil {
+			log.Error("Error updating surge buffer workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+			return 0, err
+		}
+		if surgeBufferChanged && !dryRun {
+			log.Info("Surge buffer workload was updated, waiting for it to be ready", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+			return c.config.ActiveRolloutRequeueInterval, nil
+		}
+
+		// Check if the surge buffer workload is ready
+		surgeBufferWorkloadStatus, err := GetSurgeBufferWorkloadStatus(ctx, c.workloads, c.restMapper, c.podLister, c.recorder, vpa, workload, c.config.SurgeBuffer)
+		if err != nil {
+			log.Error("Error checking if surge buffer workload exists", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+			return 0, err
+		}
+		if surgeBufferWorkloadStatus != "Ready" {
+			deadlinePassed, _, err := RolloutPhaseDeadlineHasPassed(ctx, c.recorder, vpa, utils.VPAAnnotationPendingDeadline, c.config.PendingDeadline)
+			if err != nil {
+				return 0, err
+			}
+			if deadlinePassed {
+				return 0, c.failRollout(ctx, vpa, workload, dryRun, fmt.Sprintf("the surge buffer was not ready before the 'pending' deadline, its status is %s", surgeBufferWorkloadStatus))
+			}
+			log.Info("Surge buffer workload is not ready, skipping", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace, "SurgeBufferWorkloadStatus", surgeBufferWorkloadStatus)
+			recordEvent(c.recorder, vpa, workload, corev1.EventTypeNormal, EventReasonSurgeBufferNotReady, "Waiting for the surge buffer to be ready before triggering the rollout, surge buffer status is %s", surgeBufferWorkloadStatus)
+			return c.config.ActiveRolloutRequeueInterval, nil
+		}
+		if rolloutStatusUpdatedAtFound && !dryRun {
+			metrics.PhaseDuration.WithLabelValues(metrics.PhaseSurgeBufferReady).Observe(time.Since(rolloutStatusUpdatedAt).Seconds())
+		}
+
+		// Trigger the rollout restart and set the VPA's rollout status to "in-progress"
+		err = TriggerPendingRollout(ctx, vpa, workload, c.dynamicClient, c.restMapper, c.recorder, c.config.PatchOperationFieldManager, dryRun)
+		if err != nil {
+			log.Error("Error triggering pending rollout", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+			metrics.RolloutsFailed.WithLabelValues(vpa.Namespace, workloadKind).Inc()
+			return 0, err
+		}
+		log.Info("Pending rollout triggered", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		if rolloutStatusUpdatedAtFound && !dryRun {
+			metrics.PhaseDuration.WithLabelValues(metrics.PhasePending).Observe(time.Since(rolloutStatusUpdatedAt).Seconds())
+		}
+		return c.config.ActiveRolloutRequeueInterval, nil
+	}
+	// Check if an in-progress rollout is completed
+	if rolloutStatus == "in-progress" {
+		// Check if the workload pods are healthy and have restarted since the last rollout
+		rolloutIsCompleted, err := RolloutIsCompleted(ctx, vpa, workload, c.podLister)
+		if rolloutProgressDeadlineExceeded(err) {
+			return 0, c.failRollout(ctx, vpa, workload, dryRun, err.Error())
+		}
+		if err != nil {
+			log.Error("Error checking if rollout is completed", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+			return 0, err
+		}
+		if !rolloutIsCompleted {
+			deadlinePassed, _, err := RolloutPhaseDeadlineHasPassed(ctx, c.recorder, vpa, utils.VPAAnnotationInProgressDeadline, c.config.InProgressDeadline)
+			if err != nil {
+				return 0, err
+			}
+			if deadlinePassed {
+				return 0, c.failRollout(ctx, vpa, workload, dryRun, "the rollout did not complete before the 'in-progress' deadline")
+			}
+			log.Info("Rollout is still in progress for VPA", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+			return c.config.ActiveRolloutRequeueInterval, nil
+		}
+
+		// Cleanup the buffer workload if it exists and is ready
+		// If its status is "NotFound", we implicitly skip this step
+		surgeBufferWorkloadStatus, err := GetSurgeBufferWorkloadStatus(ctx, c.workloads, c.restMapper, c.podLister, c.recorder, vpa, workload, c.config.SurgeBuffer)
+		if err != nil {
+			log.Error("Error getting surge buffer workload status", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+			return 0, err
+		}
+		if surgeBufferWorkloadStatus == "Ready" {
+			log.Info("Deleting the surge buffer workload", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+			err := DeleteSurgeBufferWorkload(ctx, c.dynamicClient, c.restMapper, c.recorder, vpa, workload, c.config.SurgeBuffer, dryRun)
+			if err != nil {
+				log.Error("Error deleting surge buffer workload", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+				return 0, err
+			}
+			log.Info("Surge buffer workload deleted", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		}
+
+		// Check that the VPA admission controller applied the recommendation to the restarted pods, otherwise the next rollout would restart them again for nothing
+		rolloutIsApplied, unappliedDiffs, err := RolloutIsApplied(ctx, c.podLister, c.limitRanges, c.recorder, vpa, workload, c.config.RolloutVerificationTolerance)
+		if err != nil {
+			log.Error("Error verifying the resources of the rollout's pods", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+			return 0, err
+		}
+		if !rolloutIsApplied {
+			// Set the VPA's rollout status to "unapplied", which waits for the failed rollout backoff before another rollout
+			err = SetRolloutStatus(ctx, vpa, c.dynamicClient, c.recorder, c.config.PatchOperationFieldManager, "unapplied", dryRun)
+			if err != nil {
+				return 0, err
+			}
+			log.Warn("Rollout completed, but its pods did not receive the VPA recommendation", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace, "UnappliedContainers", len(unappliedDiffs))
+			if dryRun {
+				return 0, nil
+			}
+			metrics.RolloutsUnapplied.WithLabelValues(vpa.Namespace, workloadKind).Inc()
+			recordEvent(c.recorder, vpa, workload, corev1.EventTypeWarning, EventReasonRolloutUnapplied, "Rollout of %s %s completed, but its pods did not receive the VPA recommendation, check that the VPA admission controller is running: %s", workloadKind, workloadName, formatUnappliedContainerDiffs(unappliedDiffs))
+			return 0, nil
+		}
+
+		// Set the VPA's rollout status to "complete"
+		err = SetRolloutStatus(ctx, vpa, c.dynamicClient, c.recorder, c.config.PatchOperationFieldManager, "complete", dryRun)
+		if err != nil {
+			return 0, err
+		}
+		log.Info("Rollout completed for VPA", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		// In dry-run the rollout status is left as is, so the completion would otherwise be reported on every reconciliation
+		if dryRun {
+			return 0, nil
+		}
+		metrics.RolloutsCompleted.WithLabelValues(vpa.Namespace, workloadKind).Inc()
+		recordEvent(c.recorder, vpa, workload, corev1.EventTypeNormal, EventReasonRolloutCompleted, "Rollout of %s %s completed", workloadKind, workloadName)
+		if rolloutStatusUpdatedAtFound {
+			metrics.PhaseDuration.WithLabelValues(metrics.PhaseInProgress).Observe(time.Since(rolloutStatusUpdatedAt).Seconds())
+		}
+		return 0, nil
+	}
+
+	// Wait longer before attempting another rollout after a failed one
+	failedRolloutBackoffHasElapsed, failedRolloutBackoffRemaining, err := FailedRolloutBackoffHasElapsed(ctx, c.recorder, vpa, c.config.FailedRolloutBackoffDuration)
+	if err != nil {
+		return 0, err
+	}
+	if !failedRolloutBackoffHasElapsed {
+		return failedRolloutBackoffRemaining, nil
+	}
+
+	// Check if the cooldown period has elapsed
+	cooldownHasElapsed, cooldownRemaining, err := CooldownHasElapsed(ctx, c.podLister, c.recorder, vpa, workload, c.config.CooldownPeriodDuration)
+	if err != nil {
+		log.Error("Error checking cooldown period", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		return 0, err
+	}
+	// Containers that were just OOM killed should not wait for the cooldown to get more memory
+	oomWindow, err := durationFromAnnotation(c.recorder, vpa, utils.VPAAnnotationOOMWindow, c.config.OOMWindow)
+	if err != nil {
+		return 0, err
+	}
+	if !cooldownHasElapsed {
+		recentOOMKills, err := WorkloadHasRecentOOMKills(ctx, c.podLister, workload, oomWindow)
+		if err != nil {
+			return 0, err
+		}
+		if !recentOOMKills {
+			// Re-evaluate the VPA exactly when its cooldown period ends
+			return cooldownRemaining, nil
+		}
+		log.Info("Workload pods were recently OOM killed, evaluating the VPA during its cooldown period", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace, "CooldownRemaining", cooldownRemaining)
+	}
+
+	// Check that the recommender provided a recent and confident recommendation
+	recommendationIsUsable, err := RecommendationIsUsable(ctx, c.recorder, c.recommendations, vpa, workload, c.config.RecommendationMaxAge)
+	if err != nil {
+		return 0, err
+	}
+	if !recommendationIsUsable {
+		if !cooldownHasElapsed {
+			return cooldownRemaining, nil
+		}
+		return 0, nil
+	}
+
+	// Check if a rollout is needed
+	rolloutIsNeeded, containerDiffs, stabilizationRemaining, err := RolloutIsNeeded(ctx, c.podLister, c.dynamicClient, c.limitRanges, c.recorder, vpa, workload, c.config.TriggerThresholds, c.config.Stabilization, c.dryRunDriftHistories, oomWindow, c.config.PatchOperationFieldManager, !cooldownHasElapsed, dryRun)
+	if err != nil {
+		log.Error("Error checking if rollout is needed", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		return 0, err
+	}
+	if !rolloutIsNeeded {
+		log.Info("No rollout needed for VPA Target Workload", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name, "EvaluatedContainers", len(containerDiffs))
+		// Re-evaluate the VPA once its drift can be stable, or once the cooldown has elapsed if that comes first
+		if !cooldownHasElapsed && (stabilizationRemaining == 0 || cooldownRemaining < stabilizationRemaining) {
+			return cooldownRemaining, nil
+		}
+		return stabilizationRemaining, nil
+	}
+	if !cooldownHasElapsed {
+		// During the cooldown, a rollout is only needed for the memory increases of OOM killed containers
+		increases := memoryIncreasesAfterOOMKills(containerDiffs)
+		log.Info("Bypassing the cooldown period to increase the memory of recently OOM killed containers", "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace, "CooldownRemaining", cooldownRemaining, "MemoryIncreases", formatOOMKilledMemoryChanges(increases))
+		metrics.OOMDecisions.WithLabelValues(vpa.Namespace, metrics.OOMDecisionCooldownBypassed).Inc()
+		recordEvent(c.recorder, vpa, workload, corev1.EventTypeNormal, EventReasonCooldownBypassed, "Bypassing the remaining %s of the cooldown period to increase the memory of OOM killed containers: %s", cooldownRemaining.Round(time.Second), formatOOMKilledMemoryChanges(increases))
+	}
+	err = TriggerRollout(ctx, workload, vpa, c.dynamicClient, c.restMapper, c.workloads, c.limitRanges, c.recorder, c.config.PatchOperationFieldManager, c.config.SurgeBuffer, dryRun)
+	if err != nil {
+		log.Error("Error triggering rollout", "err", err, "VPAName", vpa.Name, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		metrics.RolloutsFailed.WithLabelValues(vpa.Namespace, workloadKind).Inc()
+		return 0, err
+	}
+	return 0, nil
+}
+
+// Fails the VPA's current rollout, which then waits for the failed rollout backoff before being attempted again
+func (c *Controller) failRollout(ctx context.Context, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, dryRun bool, reason string) error {
+	err := FailRollout(ctx, vpa, workload, c.dynamicClient, c.restMapper, c.workloads, c.podLister, c.recorder, c.config.PatchOperationFieldManager, c.config.SurgeBuffer, reason, dryRun)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		metrics.RolloutsFailed.WithLabelValues(vpa.Namespace, workload["kind"].(string)).Inc()
+	}
+	return nil
+}
+
+func (c *Controller) enqueueVPA(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Enqueues a VPA when its recommendation, spec or annotations change, or on periodic resync
+func (c *Controller) handleVPAUpdate(oldObj, newObj interface{}) {
+	oldVPA, ok := oldObj.(*v1.VerticalPodAutoscaler)
+	if !ok {
+		return
+	}
+	newVPA, ok := newObj.(*v1.VerticalPodAutoscaler)
+	if !ok {
+		return
+	}
+	// Periodic resyncs deliver unchanged objects, and are how idle VPAs get re-evaluated
+	if oldVPA.ResourceVersion == newVPA.ResourceVersion ||
+		!equality.Semantic.DeepEqual(oldVPA.Status.Recommendation, newVPA.Status.Recommendation) ||
+		!equality.Semantic.DeepEqual(oldVPA.Spec, newVPA.Spec) ||
+		!equality.Semantic.DeepEqual(annotationsWithoutDriftHistory(oldVPA.Annotations), annotationsWithoutDriftHistory(newVPA.Annotations)) {
+		c.enqueueVPA(newObj)
+	}
+}
+
+// The controller updates the drift history annotation of the VPAs itself, which must not trigger another reconciliation
+func annotationsWithoutDriftHistory(annotations map[string]string) map[string]string {
+	if _, found := annotations[utils.VPAAnnotationDriftHistory]; !found {
+		return annotations
+	}
+	annotations = maps.Clone(annotations)
+	delete(annotations, utils.VPAAnnotationDriftHistory)
+	return annotations
+}
+
+func (c *Controller) handleWorkload(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	workload, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	c.enqueueVPAsForWorkload(workload)
+}
+
+// Enqueues the VPAs targeting a workload when the workload's status or spec change
+func (c *Controller) handleWorkloadUpdate(oldObj, newObj interface{}) {
+	oldWorkload, ok := oldObj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	newWorkload, ok := newObj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	if oldWorkload.GetResourceVersion() == newWorkload.GetResourceVersion() {
+		return
+	}
+	if oldWorkload.GetGeneration() == newWorkload.GetGeneration() && equality.Semantic.DeepEqual(oldWorkload.Object["status"], newWorkload.Object["status"]) {
+		return
+	}
+	c.enqueueVPAsForWorkload(newWorkload)
+}
+
+// Enqueues the VPAs that target the workload. Surge buffer workloads are mapped back to the VPA that owns them.
+func (c *Controller) enqueueVPAsForWorkload(workload *unstructured.Unstructured) {
+	workloadName := workload.GetName()
+	if workload.GetLabels()[utils.LabelSurgeBuffer] == "true" {
+		for _, ownerReference := range workload.GetOwnerReferences() {
+			if ownerReference.Kind == "VerticalPodAutoscaler" {
+				c.queue.Add(workload.GetNamespace() + "/" + ownerReference.Name)
+				return
+			}
+		}
+		// Surge buffers created before they had an owner are named after their source workload
+		workloadName = strings.TrimSuffix(workloadName, surgeBufferNameSuffix)
+	}
+	vpas, err := c.vpaIndexer.ByIndex(vpaByTargetIndex, vpaTargetIndexKey(workload.GetNamespace(), workload.GetKind(), workloadName))
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, vpa := range vpas {
+		c.enqueueVPA(vpa)
+	}
+}
+
+func (c *Controller) handlePod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	c.enqueueVPAsForPod(pod)
+}
+
+// Enqueues the VPAs targeting the pod's workload when the pod's phase or readiness change
+func (c *Controller) handlePodUpdate(oldObj, newObj interface{}) {
+	oldPod, ok := oldObj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	newPod, ok := newObj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	if oldPod.Status.Phase == newPod.Status.Phase && podIsReady(oldPod) == podIsReady(newPod) {
+		return
+	}
+	c.enqueueVPAsForPod(newPod)
+}
+
+// Enqueues the VPAs in the pod's namespace whose target workload selects the pod
+func (c *Controller) enqueueVPAsForPod(pod *corev1.Pod) {
+	vpas, err := c.vpaLister.VerticalPodAutoscalers(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, vpa := range vpas {
+		if vpa.Spec.TargetRef == nil {
+			continue
+		}
+		gvr, err := resolveWorkloadGVR(c.restMapper, vpa.Spec.TargetRef.APIVersion, vpa.Spec.TargetRef.Kind, false)
+		if err != nil {
+			continue
+		}
+		workloadLister, ok := c.workloads.existing(gvr)
+		if !ok {
+			continue
+		}
+		obj, err := workloadLister.ByNamespace(vpa.Namespace).Get(vpa.Spec.TargetRef.Name)
+		if err != nil {
+			continue
+		}
+		workload, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		selectorLabels, found, err := unstructured.NestedStringMap(workload.Object, "spec", "selector", "matchLabels")
+		if err != nil || !found || len(selectorLabels) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(selectorLabels).Matches(labels.Set(pod.Labels)) {
+			c.enqueueVPA(vpa)
+		}
+	}
+}
+
+// Indexes VPAs by their target workload, so that workload events can be mapped back to VPAs
+func vpaTargetIndexFunc(obj interface{}) ([]string, error) {
+	vpa, ok := obj.(*v1.VerticalPodAutoscaler)
+	if !ok || vpa.Spec.TargetRef == nil {
+		return nil, nil
+	}
+	return []string{vpaTargetIndexKey(vpa.Namespace, vpa.Spec.TargetRef.Kind, vpa.Spec.TargetRef.Name)}, nil
+}
+
+func vpaTargetIndexKey(namespace, kind, name string) string {
+	return namespace + "/" + kind + "/" + name
+}
+
+func podIsReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
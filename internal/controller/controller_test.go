@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestEnqueueVPAsForWorkload(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{vpaByTargetIndex: vpaTargetIndexFunc})
+	vpa := testutil.CreateTestVPA()
+	otherVPA := testutil.CreateTestVPA(
+		testutil.WithName("other-vpa"),
+		testutil.WithTargetRef("Deployment", "other-deployment", "apps/v1"),
+	)
+	if err := indexer.Add(&vpa); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := indexer.Add(&otherVPA); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := &Controller{
+		vpaIndexer: indexer,
+		queue:      workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
+	}
+	defer c.queue.ShutDown()
+
+	t.Run("Workload event enqueues the VPA targeting it", func(t *testing.T) {
+		workload := &unstructured.Unstructured{Object: testutil.CreateTestWorkload("test-deployment", "default", "")}
+		c.enqueueVPAsForWorkload(workload)
+		if c.queue.Len() != 1 {
+			t.Fatalf("expected 1 item in the queue, got: %d", c.queue.Len())
+		}
+		key, _ := c.queue.Get()
+		c.queue.Done(key)
+		if key != "default/test-vpa" {
+			t.Errorf("expected key default/test-vpa, got: %s", key)
+		}
+	})
+
+	t.Run("Surge buffer event enqueues the VPA targeting the source workload", func(t *testing.T) {
+		surgeBuffer := &unstructured.Unstructured{Object: testutil.CreateTestWorkload("test-deployment-surge-buffer", "default", "")}
+		surgeBuffer.SetLabels(map[string]string{utils.LabelSurgeBuffer: "true"})
+		c.enqueueVPAsForWorkload(surgeBuffer)
+		if c.queue.Len() != 1 {
+			t.Fatalf("expected 1 item in the queue, got: %d", c.queue.Len())
+		}
+		key, _ := c.queue.Get()
+		c.queue.Done(key)
+		if key != "default/test-vpa" {
+			t.Errorf("expected key default/test-vpa, got: %s", key)
+		}
+	})
+
+	t.Run("Surge buffer event enqueues the VPA owning it", func(t *testing.T) {
+		surgeBuffer := &unstructured.Unstructured{Object: testutil.CreateTestWorkload(surgeBufferWorkloadName("other-deployment"), "default", "")}
+		surgeBuffer.SetLabels(map[string]string{utils.LabelSurgeBuffer: "true"})
+		surgeBuffer.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "autoscaling.k8s.io/v1", Kind: "VerticalPodAutoscaler", Name: "other-vpa"}})
+		c.enqueueVPAsForWorkload(surgeBuffer)
+		if c.queue.Len() != 1 {
+			t.Fatalf("expected 1 item in the queue, got: %d", c.queue.Len())
+		}
+		key, _ := c.queue.Get()
+		c.queue.Done(key)
+		if key != "default/other-vpa" {
+			t.Errorf("expected key default/other-vpa, got: %s", key)
+		}
+	})
+
+	t.Run("Unrelated workload event enqueues nothing", func(t *testing.T) {
+		workload := &unstructured.Unstructured{Object: testutil.CreateTestWorkload("unrelated-deployment", "default", "")}
+		c.enqueueVPAsForWorkload(workload)
+		if c.queue.Len() != 0 {
+			t.Errorf("expected an empty queue, got: %d items", c.queue.Len())
+		}
+	})
+}
@@ -9,11 +9,13 @@ import (
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
-	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
-// Check if the cooldown period has elapsed, to avoid rolling too frequently
-func CooldownHasElapsed(ctx context.Context, clientset kubernetes.Interface, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, cooldownPeriodDuration time.Duration) (bool, error) {
+// Check if the cooldown period has elapsed, to avoid rolling too frequently.
+// When it has not elapsed, it also returns the time remaining until it does, or 0 if that cannot be known yet (e.g. the workload has no pods).
+func CooldownHasElapsed(ctx context.Context, podLister corelisters.PodLister, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, cooldownPeriodDuration time.Duration) (bool, time.Duration, error) {
 
 	log := slog.Default()
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
@@ -25,7 +27,8 @@ func CooldownHasElapsed(ctx context.Context, clientset kubernetes.Interface, vpa
 		overridenCooldownPeriodDuration, err := time.ParseDuration(vpa.Annotations[utils.VPAAnnotationCooldownPeriod])
 		if err != nil {
 			log.Error("Error parsing cooldown period duration from VPA annotation", "err", err, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
-			return false, err
+			recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationCooldownPeriod, err)
+			return false, 0, err
 		}
 		effectiveCooldownPeriodDuration = overridenCooldownPeriodDuration
 	} else {
@@ -37,7 +40,7 @@ func CooldownHasElapsed(ctx context.Context, clientset kubernetes.Interface, vpa
 	timestamp, timestampFound, err := unstructured.NestedString(workload, "spec", "template", "metadata", "annotations", "kubectl.kubernetes.io/restartedAt")
 	if err != nil {
 		log.Error("Error getting timestamp", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-		return false, err
+		return false, 0, err
 	}
 
 	if timestampFound {
@@ -46,49 +49,54 @@ func CooldownHasElapsed(ctx context.Context, clientset kubernetes.Interface, vpa
 		lastRestartedAt, err := time.Parse(time.RFC3339, timestamp)
 		if err != nil {
 			log.Error("Error parsing timestamp for Workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace, "timestamp", timestamp)
-			return false, err
+			return false, 0, err
 		}
 		elapsed := time.Since(lastRestartedAt)
 		if elapsed < effectiveCooldownPeriodDuration {
 			log.Info("Cooldown period has not elapsed for workload", "workloadName", workloadName, "workloadNamespace", workloadNamespace, "elapsedTime", elapsed.Round(time.Second), "cooldownPeriodDuration", effectiveCooldownPeriodDuration)
-			return false, nil
+			return false, effectiveCooldownPeriodDuration - elapsed, nil
 		}
 		log.Debug("Cooldown period has elapsed for workload", "workloadName", workloadName, "workloadNamespace", workloadNamespace, "elapsedTime", elapsed.Round(time.Second), "cooldownPeriodDuration", effectiveCooldownPeriodDuration)
 	}
 
 	// At this point, either no timestamp was found, or cooldown has elapsed, so we need to check pods' cooldown
-	cooldownElapsedForWorkloadPods, err := cooldownElapsedForWorkloadPods(ctx, clientset, workload, effectiveCooldownPeriodDuration)
+	cooldownElapsedForWorkloadPods, remaining, err := cooldownElapsedForWorkloadPods(ctx, podLister, workload, effectiveCooldownPeriodDuration)
 	if err != nil {
 		log.Error("Error checking workload pods cooldown", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-		return false, err
+		return false, 0, err
 	}
-	return cooldownElapsedForWorkloadPods, nil
+	return cooldownElapsedForWorkloadPods, remaining, nil
 }
 
-// Verifies that the workload's pods' age is greater than the cooldown period
-func cooldownElapsedForWorkloadPods(ctx context.Context, clientset kubernetes.Interface, workload map[string]interface{}, cooldownPeriodDuration time.Duration) (bool, error) {
+// Verifies that the workload's pods' age is greater than the cooldown period.
+// When it is not, it also returns the time remaining until the youngest pod is older than the cooldown period.
+func cooldownElapsedForWorkloadPods(ctx context.Context, podLister corelisters.PodLister, workload map[string]interface{}, cooldownPeriodDuration time.Duration) (bool, time.Duration, error) {
 	log := slog.Default()
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
 	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
 
 	// Check that the workload's pods' age is greater than the cooldown period
-	podList, err := getTargetWorkloadPods(ctx, workload, clientset)
+	podList, err := getTargetWorkloadPods(ctx, workload, podLister)
 	if err != nil {
 		log.Error("Error getting pods for workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-		return false, err
+		return false, 0, err
 	}
 	if len(podList.Items) == 0 {
 		log.Info("No pods found for workload", "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-		return false, nil
+		return false, 0, nil
 	}
+	var remaining time.Duration
 	for _, pod := range podList.Items {
 		podAge := time.Since(pod.GetCreationTimestamp().Time)
 		log.Debug("Pod age", "podName", pod.Name, "podNamespace", pod.Namespace, "podAge", podAge.Round(time.Second))
 		if podAge < cooldownPeriodDuration {
 			log.Info("Workload's Pod age is less than cooldown period", "workloadName", workloadName, "workloadNamespace", workloadNamespace, "podName", pod.Name, "podNamespace", pod.Namespace, "podAge", podAge.Round(time.Second), "cooldownPeriodDuration", cooldownPeriodDuration)
-			return false, nil
+			remaining = max(remaining, cooldownPeriodDuration-podAge)
 		}
 	}
+	if remaining > 0 {
+		return false, remaining, nil
+	}
 	log.Debug("Cooldown period has elapsed for workload's pods", "workloadName", workloadName, "workloadNamespace", workloadNamespace, "cooldownPeriodDuration", cooldownPeriodDuration)
-	return true, nil
+	return true, 0, nil
 }
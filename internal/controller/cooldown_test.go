@@ -5,12 +5,16 @@ import (
 	"testing"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
 	testutil "github.com/influxdata/vpa-rollout-controller/test"
 )
 
 func TestCooldownHasElapsed(t *testing.T) {
-	// Create a fake clientset using the utility function
-	clientset := testutil.CreateTestClientset()
+	// Create a fake pod lister using the utility function
+	podLister := testutil.CreateTestPodLister()
 
 	// Create a fake VPA object using the utility function
 	vpa := testutil.CreateTestVPA(
@@ -26,12 +30,46 @@ func TestCooldownHasElapsed(t *testing.T) {
 	defaultCooldownPeriodDuration := 10 * time.Minute
 
 	t.Run("Cooldown has not elapsed", func(t *testing.T) {
-		cooldownHasElapsed, err := CooldownHasElapsed(context.Background(), clientset, vpa, workload, defaultCooldownPeriodDuration)
+		cooldownHasElapsed, remaining, err := CooldownHasElapsed(context.Background(), podLister, record.NewFakeRecorder(10), vpa, workload, defaultCooldownPeriodDuration)
 		if err != nil {
 			t.Fatalf("Error checking cooldown: %v", err)
 		}
 		if cooldownHasElapsed {
 			t.Errorf("Expected cooldown to not have elapsed, but it has")
 		}
+		if remaining != 0 {
+			t.Errorf("Expected no remaining cooldown when the workload has no pods, got: %v", remaining)
+		}
+	})
+
+	t.Run("Remaining cooldown is computed from the youngest pod", func(t *testing.T) {
+		podLister := testutil.CreateTestPodLister(
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "old-pod",
+					Namespace:         "default",
+					Labels:            map[string]string{"app": "myapp"},
+					CreationTimestamp: metav1.NewTime(time.Now().Add(-1 * time.Hour)),
+				},
+			},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "young-pod",
+					Namespace:         "default",
+					Labels:            map[string]string{"app": "myapp"},
+					CreationTimestamp: metav1.NewTime(time.Now().Add(-2 * time.Minute)),
+				},
+			},
+		)
+		cooldownHasElapsed, remaining, err := CooldownHasElapsed(context.Background(), podLister, record.NewFakeRecorder(10), vpa, workload, defaultCooldownPeriodDuration)
+		if err != nil {
+			t.Fatalf("Error checking cooldown: %v", err)
+		}
+		if cooldownHasElapsed {
+			t.Errorf("Expected cooldown to not have elapsed, but it has")
+		}
+		if remaining <= 2*time.Minute || remaining > 3*time.Minute {
+			t.Errorf("Expected about 3m of remaining cooldown, got: %v", remaining)
+		}
 	})
 }
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/dynamic"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Check if the deadline of the VPA's current rollout phase ('pending' or 'in-progress') has passed.
+// The phase started when the rollout status was last set. A deadline of 0 disables it.
+// When the deadline has not passed, it also returns the time remaining until it does, or 0 if the phase has no deadline.
+func RolloutPhaseDeadlineHasPassed(ctx context.Context, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, deadlineAnnotation string, deadline time.Duration) (bool, time.Duration, error) {
+	log := slog.Default()
+
+	effectiveDeadline, err := durationFromAnnotation(recorder, vpa, deadlineAnnotation, deadline)
+	if err != nil {
+		return false, 0, err
+	}
+	if effectiveDeadline == 0 {
+		return false, 0, nil
+	}
+	phaseStartedAt, found := GetRolloutStatusUpdatedAt(ctx, vpa)
+	if !found {
+		log.Info("Rollout status has no timestamp, cannot check the phase deadline", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "Status", GetRolloutStatus(ctx, vpa))
+		return false, 0, nil
+	}
+	elapsed := time.Since(phaseStartedAt)
+	if elapsed < effectiveDeadline {
+		return false, effectiveDeadline - elapsed, nil
+	}
+	log.Info("Rollout phase deadline has passed", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "Status", GetRolloutStatus(ctx, vpa), "elapsedTime", elapsed.Round(time.Second), "deadline", effectiveDeadline)
+	return true, 0, nil
+}
+
+// Check if the backoff period after a failed or unapplied rollout has elapsed, before another rollout can be attempted.
+// When it has not elapsed, it also returns the time remaining until it does.
+func FailedRolloutBackoffHasElapsed(ctx context.Context, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, failedRolloutBackoffDuration time.Duration) (bool, time.Duration, error) {
+	log := slog.Default()
+
+	if status := GetRolloutStatus(ctx, vpa); status != "failed" && status != "unapplied" {
+		return true, 0, nil
+	}
+	effectiveBackoffDuration, err := durationFromAnnotation(recorder, vpa, utils.VPAAnnotationFailedRolloutBackoff, failedRolloutBackoffDuration)
+	if err != nil {
+		return false, 0, err
+	}
+	failedAt, found := GetRolloutStatusUpdatedAt(ctx, vpa)
+	if !found {
+		return true, 0, nil
+	}
+	elapsed := time.Since(failedAt)
+	if elapsed < effectiveBackoffDuration {
+		log.Info("Backoff period after a failed rollout has not elapsed", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "elapsedTime", elapsed.Round(time.Second), "failedRolloutBackoffDuration", effectiveBackoffDuration)
+		return false, effectiveBackoffDuration - elapsed, nil
+	}
+	return true, 0, nil
+}
+
+// Fails the VPA's current rollout: deletes its surge buffer if it exists, sets the rollout status to 'failed' and records a Warning Event with the reason
+func FailRollout(ctx context.Context, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, dynamicClient dynamic.Interface, restMapper meta.RESTMapper, workloadListers WorkloadListers, podLister corelisters.PodLister, recorder record.EventRecorder, patchOperationFieldManager string, surgeBufferConfig SurgeBufferConfig, reason string, dryRun bool) error {
+	log := slog.Default()
+	workloadName := workload["metadata"].(map[string]interface{})["name"]
+	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
+
+	log.Info("Failing rollout", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace, "Reason", reason)
+
+	// Don't leave the surge buffer running, whether it became ready or not
+	surgeBufferWorkloadStatus, err := GetSurgeBufferWorkloadStatus(ctx, workloadListers, restMapper, podLister, recorder, vpa, workload, surgeBufferConfig)
+	if err != nil {
+		return fmt.Errorf("error getting surge buffer workload status: %v", err)
+	}
+	if surgeBufferWorkloadStatus != "NotFound" {
+		if err := DeleteSurgeBufferWorkload(ctx, dynamicClient, restMapper, recorder, vpa, workload, surgeBufferConfig, dryRun); err != nil {
+			return err
+		}
+	}
+
+	if err := SetRolloutStatus(ctx, vpa, dynamicClient, recorder, patchOperationFieldManager, "failed", dryRun); err != nil {
+		return err
+	}
+	recordEvent(recorder, vpa, workload, corev1.EventTypeWarning, EventReasonRolloutFailed, "Rollout of %s %s failed: %s", workload["kind"], workloadName, reason)
+	return nil
+}
+
+// Get a duration from a VPA annotation, or the default value if the annotation is not set
+func durationFromAnnotation(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, annotation string, defaultValue time.Duration) (time.Duration, error) {
+	if vpa.Annotations == nil || vpa.Annotations[annotation] == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(vpa.Annotations[annotation])
+	if err != nil {
+		slog.Default().Error("Error parsing duration from VPA annotation", "err", err, "annotation", annotation, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
+		recordInvalidAnnotationEvent(recorder, vpa, annotation, err)
+		return 0, fmt.Errorf("error parsing annotation %s: %v", annotation, err)
+	}
+	return value, nil
+}
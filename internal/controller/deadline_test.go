@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestRolloutPhaseDeadlineHasPassed(t *testing.T) {
+	ctx := context.Background()
+	recorder := record.NewFakeRecorder(10)
+	pendingSince := time.Now().Add(-20 * time.Minute).UTC().Format(time.RFC3339)
+
+	vpa := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "pending"),
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatusUpdatedAt, pendingSince),
+	)
+	passed, remaining, err := RolloutPhaseDeadlineHasPassed(ctx, recorder, vpa, utils.VPAAnnotationPendingDeadline, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if passed {
+		t.Errorf("expected the deadline not to have passed")
+	}
+	if remaining <= 9*time.Minute || remaining > 10*time.Minute {
+		t.Errorf("expected about 10m until the deadline, got: %v", remaining)
+	}
+
+	// The annotation overrides the default deadline
+	vpaOverride := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "pending"),
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatusUpdatedAt, pendingSince),
+		testutil.WithAnnotation(utils.VPAAnnotationPendingDeadline, "10m"),
+	)
+	passed, _, err = RolloutPhaseDeadlineHasPassed(ctx, recorder, vpaOverride, utils.VPAAnnotationPendingDeadline, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !passed {
+		t.Errorf("expected the deadline to have passed")
+	}
+
+	// A deadline of 0 disables it
+	passed, _, err = RolloutPhaseDeadlineHasPassed(ctx, recorder, vpa, utils.VPAAnnotationPendingDeadline, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if passed {
+		t.Errorf("expected a disabled deadline never to pass")
+	}
+
+	// Invalid annotations are reported
+	vpaInvalid := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationInProgressDeadline, "soon"))
+	if _, _, err := RolloutPhaseDeadlineHasPassed(ctx, recorder, vpaInvalid, utils.VPAAnnotationInProgressDeadline, time.Hour); err == nil {
+		t.Errorf("expected error for an invalid deadline annotation")
+	}
+}
+
+func TestFailedRolloutBackoffHasElapsed(t *testing.T) {
+	ctx := context.Background()
+	recorder := record.NewFakeRecorder(10)
+	failedAt := time.Now().Add(-20 * time.Minute).UTC().Format(time.RFC3339)
+
+	vpa := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "failed"),
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatusUpdatedAt, failedAt),
+	)
+	elapsed, remaining, err := FailedRolloutBackoffHasElapsed(ctx, recorder, vpa, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed {
+		t.Errorf("expected the backoff not to have elapsed")
+	}
+	if remaining <= 39*time.Minute || remaining > 40*time.Minute {
+		t.Errorf("expected about 40m of remaining backoff, got: %v", remaining)
+	}
+
+	// Unapplied rollouts are backed off like failed ones
+	vpaUnapplied := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "unapplied"),
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatusUpdatedAt, failedAt),
+	)
+	elapsed, _, err = FailedRolloutBackoffHasElapsed(ctx, recorder, vpaUnapplied, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed {
+		t.Errorf("expected the backoff not to have elapsed after an unapplied rollout")
+	}
+
+	// Only failed and unapplied rollouts are backed off
+	vpaComplete := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "complete"),
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatusUpdatedAt, failedAt),
+	)
+	elapsed, _, err = FailedRolloutBackoffHasElapsed(ctx, recorder, vpaComplete, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !elapsed {
+		t.Errorf("expected no backoff after a completed rollout")
+	}
+}
+
+func TestFailRollout(t *testing.T) {
+	ctx := context.Background()
+	recorder := record.NewFakeRecorder(10)
+	vpa := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "pending"))
+	workload := testutil.CreateTestWorkload("test-deployment", "default", "")
+	surgeBuffer := testutil.CreateTestWorkload("test-deployment-surge-buffer", "default", "")
+	surgeBuffer["metadata"].(map[string]interface{})["labels"] = map[string]interface{}{utils.LabelSurgeBuffer: "true"}
+	vpaObject := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "autoscaling.k8s.io/v1",
+		"kind":       "VerticalPodAutoscaler",
+		"metadata":   map[string]interface{}{"name": vpa.Name, "namespace": vpa.Namespace},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), &unstructured.Unstructured{Object: surgeBuffer}, vpaObject)
+	workloadListers := &testutil.FakeWorkloadListers{Workloads: []map[string]interface{}{workload, surgeBuffer}}
+
+	err := FailRollout(ctx, vpa, workload, dynamicClient, testutil.CreateTestRESTMapper(), workloadListers, testutil.CreateTestPodLister(), recorder, "test-field-manager", SurgeBufferConfig{}, "the surge buffer was not ready", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var verbs []string
+	for _, action := range dynamicClient.Actions() {
+		verbs = append(verbs, action.GetVerb()+" "+action.GetResource().Resource)
+	}
+	if strings.Join(verbs, ",") != "delete deployments,patch verticalpodautoscalers" {
+		t.Errorf("expected the surge buffer to be deleted and the VPA to be patched, got: %v", verbs)
+	}
+	patched, err := dynamicClient.Resource(schema.GroupVersionResource{Group: "autoscaling.k8s.io", Version: "v1", Resource: "verticalpodautoscalers"}).Namespace(vpa.Namespace).Get(ctx, vpa.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if patched.GetAnnotations()[utils.VPAAnnotationRolloutStatus] != "failed" {
+		t.Errorf("expected the rollout status to be 'failed', got: %s", patched.GetAnnotations()[utils.VPAAnnotationRolloutStatus])
+	}
+
+	var failedEvents int
+	for len(recorder.Events) > 0 {
+		if strings.HasPrefix(<-recorder.Events, "Warning "+EventReasonRolloutFailed) {
+			failedEvents++
+		}
+	}
+	// One on the VPA and one on the workload
+	if failedEvents != 2 {
+		t.Errorf("expected 2 %s events, got: %d", EventReasonRolloutFailed, failedEvents)
+	}
+}
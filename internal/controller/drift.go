@@ -0,0 +1,375 @@
+package controller
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	vpa_api_util "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/vpa"
+	"k8s.io/client-go/tools/record"
+)
+
+// Rules that trigger a rollout, by resource and by direction in which the requests would change
+const (
+	TriggerRuleCPUIncrease    = "cpu-increase"
+	TriggerRuleCPUDecrease    = "cpu-decrease"
+	TriggerRuleMemoryIncrease = "memory-increase"
+	TriggerRuleMemoryDecrease = "memory-decrease"
+
+	// Rules of the 'bounds' trigger mode, when the requests are outside of the recommendation's bounds
+	TriggerRuleCPUBelowLowerBound    = "cpu-below-lower-bound"
+	TriggerRuleCPUAboveUpperBound    = "cpu-above-upper-bound"
+	TriggerRuleMemoryBelowLowerBound = "memory-below-lower-bound"
+	TriggerRuleMemoryAboveUpperBound = "memory-above-upper-bound"
+)
+
+// Thresholds above which the difference between a container's requests and its recommendation triggers a rollout
+type TriggerThresholds struct {
+	// In percent of the recommendation, when the recommendation is above the requests (increase) or below them (decrease)
+	CPUIncreasePercent    int
+	CPUDecreasePercent    int
+	MemoryIncreasePercent int
+	MemoryDecreasePercent int
+	// Minimum absolute differences, on top of the percentages. Zero for none.
+	MinCPUDelta    resource.Quantity
+	MinMemoryDelta resource.Quantity
+}
+
+// Set the same percentage for both resources and both directions
+func (t *TriggerThresholds) setPercent(percent int) {
+	t.CPUIncreasePercent, t.CPUDecreasePercent = percent, percent
+	t.MemoryIncreasePercent, t.MemoryDecreasePercent = percent, percent
+}
+
+// Get the rule triggered by the difference between a request and its target, or "" if none is.
+// Resources without a target never trigger a rollout.
+func (t TriggerThresholds) triggeredRule(resourceName corev1.ResourceName, request, target resource.Quantity) string {
+	if target.IsZero() {
+		return ""
+	}
+	delta := target.AsApproximateFloat64() - request.AsApproximateFloat64()
+	diffPercent := math.Abs(delta) / target.AsApproximateFloat64() * 100
+	rule, percent, minDelta := t.rule(resourceName, delta > 0)
+	if diffPercent > float64(percent) && math.Abs(delta) >= minDelta.AsApproximateFloat64() {
+		return rule
+	}
+	return ""
+}
+
+// Get the name and thresholds of the rule of a resource in a direction
+func (t TriggerThresholds) rule(resourceName corev1.ResourceName, increase bool) (string, int, resource.Quantity) {
+	switch {
+	case resourceName == corev1.ResourceCPU && increase:
+		return TriggerRuleCPUIncrease, t.CPUIncreasePercent, t.MinCPUDelta
+	case resourceName == corev1.ResourceCPU:
+		return TriggerRuleCPUDecrease, t.CPUDecreasePercent, t.MinCPUDelta
+	case increase:
+		return TriggerRuleMemoryIncrease, t.MemoryIncreasePercent, t.MinMemoryDelta
+	default:
+		return TriggerRuleMemoryDecrease, t.MemoryDecreasePercent, t.MinMemoryDelta
+	}
+}
+
+// Describe the thresholds of a rule, for logs and Events
+func (t TriggerThresholds) describe(rule string) string {
+	resourceName, direction, _ := strings.Cut(rule, "-")
+	_, percent, minDelta := t.rule(corev1.ResourceName(resourceName), direction == "increase")
+	if minDelta.IsZero() {
+		return fmt.Sprintf("%s (more than %d%%)", rule, percent)
+	}
+	return fmt.Sprintf("%s (more than %d%% and at least %s)", rule, percent, minDelta.String())
+}
+
+// Get the rule triggered by a request outside of the recommendation's bounds, or "" if none is.
+// Bounds that are not set never trigger a rollout.
+func boundsTriggeredRule(resourceName corev1.ResourceName, request, lowerBound, upperBound resource.Quantity) string {
+	if !lowerBound.IsZero() && request.Cmp(lowerBound) < 0 {
+		if resourceName == corev1.ResourceCPU {
+			return TriggerRuleCPUBelowLowerBound
+		}
+		return TriggerRuleMemoryBelowLowerBound
+	}
+	if !upperBound.IsZero() && request.Cmp(upperBound) > 0 {
+		if resourceName == corev1.ResourceCPU {
+			return TriggerRuleCPUAboveUpperBound
+		}
+		return TriggerRuleMemoryAboveUpperBound
+	}
+	return ""
+}
+
+// Drift of a container's requests from its effective VPA recommendation, across the workload's pods
+type ContainerDiff struct {
+	ContainerName string
+	// Pod that triggered the rollout, or else whose requests differ the most from the recommendation, and its requests
+	PodName       string
+	CPURequest    resource.Quantity
+	MemoryRequest resource.Quantity
+	// Effective recommendation for the container in that pod
+	CPUTarget        resource.Quantity
+	MemoryTarget     resource.Quantity
+	CPULowerBound    resource.Quantity
+	CPUUpperBound    resource.Quantity
+	MemoryLowerBound resource.Quantity
+	MemoryUpperBound resource.Quantity
+	// Largest differences across the pods, in percent of the target
+	CPUDiffPercent    float64
+	MemoryDiffPercent float64
+	// Whether the requests of any of the pods are outside of the recommendation's bounds
+	CPUOutsideBounds    bool
+	MemoryOutsideBounds bool
+	// Trigger mode and thresholds the container is evaluated with, and the rule that triggered a rollout, if any
+	TriggerMode   string
+	Thresholds    TriggerThresholds
+	TriggeredRule string
+	RolloutNeeded bool
+	// Recent OOM kills of the container across the pods, within the VPA's OOM window
+	OOMKills oomKills
+}
+
+// Describe the rule that triggered a rollout, with the thresholds or bounds it was evaluated against
+func (d ContainerDiff) describeTriggeredRule() string {
+	switch d.TriggeredRule {
+	case TriggerRuleCPUBelowLowerBound:
+		return fmt.Sprintf("%s (lower bound %s)", d.TriggeredRule, d.CPULowerBound.String())
+	case TriggerRuleCPUAboveUpperBound:
+		return fmt.Sprintf("%s (upper bound %s)", d.TriggeredRule, d.CPUUpperBound.String())
+	case TriggerRuleMemoryBelowLowerBound:
+		return fmt.Sprintf("%s (lower bound %s)", d.TriggeredRule, d.MemoryLowerBound.String())
+	case TriggerRuleMemoryAboveUpperBound:
+		return fmt.Sprintf("%s (upper bound %s)", d.TriggeredRule, d.MemoryUpperBound.String())
+	default:
+		return d.Thresholds.describe(d.TriggeredRule)
+	}
+}
+
+// Which of a VPA's containers are checked for drift, and with which trigger mode and thresholds
+type containerDriftPolicy struct {
+	mode              string
+	initContainers    string
+	included          []string
+	excluded          []string
+	thresholds        TriggerThresholds
+	containerTriggers map[string]int
+}
+
+// Read the containers to check for drift and their thresholds from the VPA's annotations, falling back to the cluster-wide thresholds.
+// The diff percent trigger annotation overrides all the cluster-wide percentages, and the per-resource and per-direction annotations override it.
+// An invalid annotation is reported with an Event and returned as an error.
+func getContainerDriftPolicy(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, thresholds TriggerThresholds) (containerDriftPolicy, error) {
+	policy := containerDriftPolicy{
+		mode:       utils.TriggerModeTarget,
+		included:   splitContainerNames(vpa.Annotations[utils.VPAAnnotationIncludedContainers]),
+		excluded:   splitContainerNames(vpa.Annotations[utils.VPAAnnotationExcludedContainers]),
+		thresholds: thresholds,
+	}
+
+	switch mode := vpa.Annotations[utils.VPAAnnotationTriggerMode]; mode {
+	case "":
+	case utils.TriggerModeTarget, utils.TriggerModeBounds:
+		policy.mode = mode
+	default:
+		err := fmt.Errorf("must be %s or %s", utils.TriggerModeTarget, utils.TriggerModeBounds)
+		recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationTriggerMode, err)
+		return policy, fmt.Errorf("error parsing annotation %s: %v", utils.VPAAnnotationTriggerMode, err)
+	}
+
+	initContainers, err := getInitContainersScope(recorder, vpa)
+	if err != nil {
+		return policy, err
+	}
+	policy.initContainers = initContainers
+
+	// Override the diffPercentTrigger if the VPA annotation is specified
+	if value := vpa.Annotations[utils.VPAAnnotationDiffPercentTrigger]; value != "" {
+		trigger, err := strconv.Atoi(value)
+		if err != nil {
+			recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationDiffPercentTrigger, err)
+			return policy, fmt.Errorf("error parsing annotation %s: %v", utils.VPAAnnotationDiffPercentTrigger, err)
+		}
+		policy.thresholds.setPercent(trigger)
+	}
+
+	for annotation, percent := range map[string]*int{
+		utils.VPAAnnotationCPUIncreaseDiffPercentTrigger:    &policy.thresholds.CPUIncreasePercent,
+		utils.VPAAnnotationCPUDecreaseDiffPercentTrigger:    &policy.thresholds.CPUDecreasePercent,
+		utils.VPAAnnotationMemoryIncreaseDiffPercentTrigger: &policy.thresholds.MemoryIncreasePercent,
+		utils.VPAAnnotationMemoryDecreaseDiffPercentTrigger: &policy.thresholds.MemoryDecreasePercent,
+	} {
+		if value := vpa.Annotations[annotation]; value != "" {
+			trigger, err := strconv.Atoi(value)
+			if err != nil {
+				recordInvalidAnnotationEvent(recorder, vpa, annotation, err)
+				return policy, fmt.Errorf("error parsing annotation %s: %v", annotation, err)
+			}
+			*percent = trigger
+		}
+	}
+	for annotation, minDelta := range map[string]*resource.Quantity{
+		utils.VPAAnnotationMinCPUDiffTrigger:    &policy.thresholds.MinCPUDelta,
+		utils.VPAAnnotationMinMemoryDiffTrigger: &policy.thresholds.MinMemoryDelta,
+	} {
+		if value := vpa.Annotations[annotation]; value != "" {
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil {
+				recordInvalidAnnotationEvent(recorder, vpa, annotation, err)
+				return policy, fmt.Errorf("error parsing annotation %s: %v", annotation, err)
+			}
+			*minDelta = quantity
+		}
+	}
+
+	if value := vpa.Annotations[utils.VPAAnnotationContainerDiffPercentTriggers]; value != "" {
+		triggers, err := parseContainerDiffPercentTriggers(value)
+		if err != nil {
+			recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationContainerDiffPercentTriggers, err)
+			return policy, fmt.Errorf("error parsing annotation %s: %v", utils.VPAAnnotationContainerDiffPercentTriggers, err)
+		}
+		policy.containerTriggers = triggers
+	}
+	return policy, nil
+}
+
+// Parse a comma-separated list of 'container=percent' pairs
+func parseContainerDiffPercentTriggers(value string) (map[string]int, error) {
+	triggers := map[string]int{}
+	for _, pair := range strings.Split(value, ",") {
+		containerName, percent, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || containerName == "" {
+			return nil, fmt.Errorf("expected container=percent, got %q", pair)
+		}
+		trigger, err := strconv.Atoi(percent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percent for container %s: %v", containerName, err)
+		}
+		triggers[containerName] = trigger
+	}
+	return triggers, nil
+}
+
+func splitContainerNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Check if a container is checked for drift: it must be in the included containers, if any, and not in the excluded ones
+func (p containerDriftPolicy) evaluates(containerName string) bool {
+	if len(p.included) > 0 && !slices.Contains(p.included, containerName) {
+		return false
+	}
+	return !slices.Contains(p.excluded, containerName)
+}
+
+// Get the thresholds of a container, whose percentages can be overridden per container
+func (p containerDriftPolicy) containerThresholds(containerName string) TriggerThresholds {
+	thresholds := p.thresholds
+	if trigger, found := p.containerTriggers[containerName]; found {
+		thresholds.setPercent(trigger)
+	}
+	return thresholds
+}
+
+// Get a container's request and target for a resource, and their difference in percent of the target.
+// Resources without a target have no difference.
+func resourceDiffPercent(requests corev1.ResourceList, target corev1.ResourceList, resourceName corev1.ResourceName) (resource.Quantity, resource.Quantity, float64) {
+	requestQuantity := requests[resourceName]
+	targetQuantity, found := target[resourceName]
+	if !found || targetQuantity.IsZero() {
+		return requestQuantity, targetQuantity, 0
+	}
+	diff := math.Abs(requestQuantity.AsApproximateFloat64() - targetQuantity.AsApproximateFloat64())
+	return requestQuantity, targetQuantity, diff / targetQuantity.AsApproximateFloat64() * 100
+}
+
+// Describe the containers that need a rollout, for the RolloutNeeded Event
+func formatContainerDiffs(containerDiffs []ContainerDiff) string {
+	var descriptions []string
+	for _, containerDiff := range containerDiffs {
+		if !containerDiff.RolloutNeeded {
+			continue
+		}
+		if containerDiff.TriggerMode == utils.TriggerModeBounds {
+			descriptions = append(descriptions, fmt.Sprintf("container %s of pod %s has requests outside of the VPA recommendation bounds: CPU %s (bounds %s to %s) and memory %s (bounds %s to %s), triggered by rule %s",
+				containerDiff.ContainerName, containerDiff.PodName,
+				containerDiff.CPURequest.String(), containerDiff.CPULowerBound.String(), containerDiff.CPUUpperBound.String(),
+				containerDiff.MemoryRequest.String(), containerDiff.MemoryLowerBound.String(), containerDiff.MemoryUpperBound.String(),
+				containerDiff.describeTriggeredRule()))
+			continue
+		}
+		descriptions = append(descriptions, fmt.Sprintf("container %s of pod %s differs from the VPA recommendation by %.1f%% CPU (%s, target %s) and %.1f%% memory (%s, target %s), triggered by rule %s",
+			containerDiff.ContainerName, containerDiff.PodName,
+			containerDiff.CPUDiffPercent, containerDiff.CPURequest.String(), containerDiff.CPUTarget.String(),
+			containerDiff.MemoryDiffPercent, containerDiff.MemoryRequest.String(), containerDiff.MemoryTarget.String(),
+			containerDiff.describeTriggeredRule()))
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+// Compute the drift of a container across the workload's pods, each against its own effective recommendation.
+// The VPA's raw recommendation is used for the pods without an effective recommendation for the container.
+// In 'target' mode the rules compare the requests with the target, and in 'bounds' mode with the lower and upper bounds.
+// It returns false if none of the pods runs the container.
+func computeContainerDiff(recommendation v1.RecommendedContainerResources, pods []corev1.Pod, effectiveRecommendations []*v1.RecommendedPodResources, mode string, thresholds TriggerThresholds) (ContainerDiff, bool) {
+	containerDiff := ContainerDiff{ContainerName: recommendation.ContainerName, TriggerMode: mode, Thresholds: thresholds}
+	found := false
+	largestPodDiffPercent := -1.0
+	for i, pod := range pods {
+		containerIndex := slices.IndexFunc(pod.Spec.Containers, func(container corev1.Container) bool {
+			return container.Name == recommendation.ContainerName
+		})
+		if containerIndex < 0 {
+			continue
+		}
+		found = true
+		requests := pod.Spec.Containers[containerIndex].Resources.Requests
+		containerRecommendation := &recommendation
+		if effectiveRecommendation := vpa_api_util.GetRecommendationForContainer(recommendation.ContainerName, effectiveRecommendations[i]); effectiveRecommendation != nil {
+			containerRecommendation = effectiveRecommendation
+		}
+
+		cpuRequest, cpuTarget, cpuDiffPercent := resourceDiffPercent(requests, containerRecommendation.Target, corev1.ResourceCPU)
+		memoryRequest, memoryTarget, memoryDiffPercent := resourceDiffPercent(requests, containerRecommendation.Target, corev1.ResourceMemory)
+		cpuLowerBound, cpuUpperBound := containerRecommendation.LowerBound[corev1.ResourceCPU], containerRecommendation.UpperBound[corev1.ResourceCPU]
+		memoryLowerBound, memoryUpperBound := containerRecommendation.LowerBound[corev1.ResourceMemory], containerRecommendation.UpperBound[corev1.ResourceMemory]
+		containerDiff.CPUDiffPercent = math.Max(containerDiff.CPUDiffPercent, cpuDiffPercent)
+		containerDiff.MemoryDiffPercent = math.Max(containerDiff.MemoryDiffPercent, memoryDiffPercent)
+		cpuBoundsRule := boundsTriggeredRule(corev1.ResourceCPU, cpuRequest, cpuLowerBound, cpuUpperBound)
+		memoryBoundsRule := boundsTriggeredRule(corev1.ResourceMemory, memoryRequest, memoryLowerBound, memoryUpperBound)
+		containerDiff.CPUOutsideBounds = containerDiff.CPUOutsideBounds || cpuBoundsRule != ""
+		containerDiff.MemoryOutsideBounds = containerDiff.MemoryOutsideBounds || memoryBoundsRule != ""
+
+		// Report the first pod that triggers a rollout, or else the one that differs the most from the recommendation
+		if containerDiff.TriggeredRule != "" {
+			continue
+		}
+		var rule string
+		if mode == utils.TriggerModeBounds {
+			rule = cmp.Or(cpuBoundsRule, memoryBoundsRule)
+		} else {
+			rule = cmp.Or(thresholds.triggeredRule(corev1.ResourceCPU, cpuRequest, cpuTarget), thresholds.triggeredRule(corev1.ResourceMemory, memoryRequest, memoryTarget))
+		}
+		if podDiffPercent := math.Max(cpuDiffPercent, memoryDiffPercent); rule != "" || podDiffPercent > largestPodDiffPercent {
+			largestPodDiffPercent = podDiffPercent
+			containerDiff.PodName = pod.Name
+			containerDiff.CPURequest, containerDiff.CPUTarget = cpuRequest, cpuTarget
+			containerDiff.MemoryRequest, containerDiff.MemoryTarget = memoryRequest, memoryTarget
+			containerDiff.CPULowerBound, containerDiff.CPUUpperBound = cpuLowerBound, cpuUpperBound
+			containerDiff.MemoryLowerBound, containerDiff.MemoryUpperBound = memoryLowerBound, memoryUpperBound
+			containerDiff.TriggeredRule = rule
+		}
+	}
+	containerDiff.RolloutNeeded = containerDiff.TriggeredRule != ""
+	return containerDiff, found
+}
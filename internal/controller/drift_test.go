@@ -0,0 +1,406 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+// Create trigger thresholds with the same percentage for both resources and both directions
+func percentTriggerThresholds(percent int) TriggerThresholds {
+	var thresholds TriggerThresholds
+	thresholds.setPercent(percent)
+	return thresholds
+}
+
+// Create a VPA recommending 100m CPU and 100Mi memory for the sidecar and the app containers, and a pod of its workload
+// where the sidecar matches its recommendation and the app container runs with 50% less CPU.
+func createTestDriftVPAAndPod(options ...testutil.VPAOption) (v1.VerticalPodAutoscaler, *corev1.Pod) {
+	target := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("100Mi")}
+	vpa := testutil.CreateTestVPA(options...)
+	vpa.Status.Recommendation = &v1.RecommendedPodResources{
+		ContainerRecommendations: []v1.RecommendedContainerResources{
+			{ContainerName: "sidecar", Target: target},
+			{ContainerName: "app", Target: target},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-0", Namespace: "default", Labels: map[string]string{"app": "myapp"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "sidecar", Resources: corev1.ResourceRequirements{Requests: target}},
+				{Name: "app", Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("50m"), corev1.ResourceMemory: resource.MustParse("100Mi")}}},
+			},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	return vpa, pod
+}
+
+func TestRolloutIsNeededEvaluatesEveryContainer(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+
+	tests := []struct {
+		name                    string
+		annotations             map[string]string
+		expectRolloutNeeded     bool
+		expectContainers        []string
+		expectTriggers          []int
+		expectInvalidAnnotation bool
+	}{
+		{
+			name:                "Drift of a container listed after another one is detected",
+			expectRolloutNeeded: true,
+			expectContainers:    []string{"sidecar", "app"},
+			expectTriggers:      []int{10, 10},
+		},
+		{
+			name:                "Excluded containers are not evaluated",
+			annotations:         map[string]string{utils.VPAAnnotationExcludedContainers: "app"},
+			expectRolloutNeeded: false,
+			expectContainers:    []string{"sidecar"},
+			expectTriggers:      []int{10},
+		},
+		{
+			name:                "Only included containers are evaluated",
+			annotations:         map[string]string{utils.VPAAnnotationIncludedContainers: "app, other"},
+			expectRolloutNeeded: true,
+			expectContainers:    []string{"app"},
+			expectTriggers:      []int{10},
+		},
+		{
+			name:                "Container triggers override the VPA's trigger",
+			annotations:         map[string]string{utils.VPAAnnotationDiffPercentTrigger: "20", utils.VPAAnnotationContainerDiffPercentTriggers: "app=60"},
+			expectRolloutNeeded: false,
+			expectContainers:    []string{"sidecar", "app"},
+			expectTriggers:      []int{20, 60},
+		},
+		{
+			name:                    "Invalid container triggers are reported",
+			annotations:             map[string]string{utils.VPAAnnotationContainerDiffPercentTriggers: "app:60"},
+			expectInvalidAnnotation: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options []testutil.VPAOption
+			for key, value := range tt.annotations {
+				options = append(options, testutil.WithAnnotation(key, value))
+			}
+			vpa, pod := createTestDriftVPAAndPod(options...)
+			recorder := record.NewFakeRecorder(10)
+
+			rolloutIsNeeded, containerDiffs, _, err := RolloutIsNeeded(ctx, testutil.CreateTestPodLister(pod), nil, limitrange.NewNoopLimitsCalculator(), recorder, vpa, workload, percentTriggerThresholds(10), StabilizationConfig{}, NewDryRunDriftHistories(), 0, "", false, false)
+			if tt.expectInvalidAnnotation {
+				if err == nil {
+					t.Fatalf("expected an error for the invalid annotation")
+				}
+				if event := <-recorder.Events; !strings.Contains(event, EventReasonInvalidAnnotation) {
+					t.Errorf("expected an %s event, got: %s", EventReasonInvalidAnnotation, event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rolloutIsNeeded != tt.expectRolloutNeeded {
+				t.Errorf("expected rollout needed to be %v, got: %v", tt.expectRolloutNeeded, rolloutIsNeeded)
+			}
+			if len(containerDiffs) != len(tt.expectContainers) {
+				t.Fatalf("expected diffs for containers %v, got: %v", tt.expectContainers, containerDiffs)
+			}
+			for i, containerDiff := range containerDiffs {
+				if containerDiff.ContainerName != tt.expectContainers[i] || containerDiff.Thresholds != percentTriggerThresholds(tt.expectTriggers[i]) {
+					t.Errorf("expected container %s with trigger %d, got: %s with thresholds %+v", tt.expectContainers[i], tt.expectTriggers[i], containerDiff.ContainerName, containerDiff.Thresholds)
+				}
+				if containerDiff.ContainerName == "app" && (containerDiff.CPUDiffPercent != 50 || containerDiff.PodName != "pod-0") {
+					t.Errorf("expected a 50%% CPU diff for app in pod-0, got: %.1f%% in %s", containerDiff.CPUDiffPercent, containerDiff.PodName)
+				}
+			}
+			if tt.expectRolloutNeeded {
+				if event := <-recorder.Events; !strings.Contains(event, EventReasonRolloutNeeded) || !strings.Contains(event, "container app of pod pod-0") || strings.Contains(event, "sidecar") {
+					t.Errorf("expected a %s event about the app container only, got: %s", EventReasonRolloutNeeded, event)
+				}
+			}
+		})
+	}
+}
+
+func TestParseContainerDiffPercentTriggers(t *testing.T) {
+	triggers, err := parseContainerDiffPercentTriggers("app=5, istio-proxy=50")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(triggers) != 2 || triggers["app"] != 5 || triggers["istio-proxy"] != 50 {
+		t.Errorf("expected app=5 and istio-proxy=50, got: %v", triggers)
+	}
+
+	for _, value := range []string{"app", "=5", "app=five"} {
+		if _, err := parseContainerDiffPercentTriggers(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestTriggerThresholdsTriggeredRule(t *testing.T) {
+	// Fast up, slow down: CPU increases above 10% and decreases above 50%, of at least 100m.
+	// Memory changes above 20%, of at least 128Mi.
+	thresholds := TriggerThresholds{
+		CPUIncreasePercent:    10,
+		CPUDecreasePercent:    50,
+		MemoryIncreasePercent: 20,
+		MemoryDecreasePercent: 20,
+		MinCPUDelta:           resource.MustParse("100m"),
+		MinMemoryDelta:        resource.MustParse("128Mi"),
+	}
+
+	tests := []struct {
+		name         string
+		resourceName corev1.ResourceName
+		request      string
+		target       string
+		expectRule   string
+	}{
+		{"Small CPU increase below the minimum delta", corev1.ResourceCPU, "20m", "30m", ""},
+		{"CPU increase above both thresholds", corev1.ResourceCPU, "500m", "700m", TriggerRuleCPUIncrease},
+		{"CPU decrease below the decrease percentage", corev1.ResourceCPU, "1", "700m", ""},
+		{"CPU decrease above both thresholds", corev1.ResourceCPU, "2", "700m", TriggerRuleCPUDecrease},
+		{"Memory increase above both thresholds", corev1.ResourceMemory, "512Mi", "768Mi", TriggerRuleMemoryIncrease},
+		{"Memory decrease below the minimum delta", corev1.ResourceMemory, "128Mi", "64Mi", ""},
+		{"Memory decrease above both thresholds", corev1.ResourceMemory, "1Gi", "512Mi", TriggerRuleMemoryDecrease},
+		{"No target", corev1.ResourceMemory, "1Gi", "0", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rule := thresholds.triggeredRule(tt.resourceName, resource.MustParse(tt.request), resource.MustParse(tt.target)); rule != tt.expectRule {
+				t.Errorf("expected rule %q, got: %q", tt.expectRule, rule)
+			}
+		})
+	}
+
+	if description := thresholds.describe(TriggerRuleCPUDecrease); description != "cpu-decrease (more than 50% and at least 100m)" {
+		t.Errorf("unexpected description: %s", description)
+	}
+}
+
+func TestGetContainerDriftPolicy(t *testing.T) {
+	clusterThresholds := TriggerThresholds{CPUIncreasePercent: 10, CPUDecreasePercent: 30, MemoryIncreasePercent: 10, MemoryDecreasePercent: 30, MinCPUDelta: resource.MustParse("100m")}
+	vpa := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationDiffPercentTrigger, "20"),
+		testutil.WithAnnotation(utils.VPAAnnotationMemoryDecreaseDiffPercentTrigger, "50"),
+		testutil.WithAnnotation(utils.VPAAnnotationMinMemoryDiffTrigger, "128Mi"),
+		testutil.WithAnnotation(utils.VPAAnnotationContainerDiffPercentTriggers, "sidecar=80"),
+	)
+
+	policy, err := getContainerDriftPolicy(record.NewFakeRecorder(10), vpa, clusterThresholds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The VPA's diff percent trigger overrides the cluster-wide percentages, and the per-direction annotation overrides it
+	expected := TriggerThresholds{CPUIncreasePercent: 20, CPUDecreasePercent: 20, MemoryIncreasePercent: 20, MemoryDecreasePercent: 50, MinCPUDelta: resource.MustParse("100m"), MinMemoryDelta: resource.MustParse("128Mi")}
+	if thresholds := policy.containerThresholds("app"); thresholds.CPUIncreasePercent != expected.CPUIncreasePercent || thresholds.CPUDecreasePercent != expected.CPUDecreasePercent ||
+		thresholds.MemoryIncreasePercent != expected.MemoryIncreasePercent || thresholds.MemoryDecreasePercent != expected.MemoryDecreasePercent ||
+		thresholds.MinCPUDelta.Cmp(expected.MinCPUDelta) != 0 || thresholds.MinMemoryDelta.Cmp(expected.MinMemoryDelta) != 0 {
+		t.Errorf("expected thresholds %+v, got: %+v", expected, thresholds)
+	}
+	// The container's trigger overrides every percentage, but keeps the minimum deltas
+	if thresholds := policy.containerThresholds("sidecar"); thresholds.CPUDecreasePercent != 80 || thresholds.MemoryDecreasePercent != 80 || thresholds.MinMemoryDelta.Cmp(expected.MinMemoryDelta) != 0 {
+		t.Errorf("expected 80%% thresholds for the sidecar, got: %+v", thresholds)
+	}
+
+	vpa = testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationMinCPUDiffTrigger, "a lot"))
+	if _, err := getContainerDriftPolicy(record.NewFakeRecorder(10), vpa, clusterThresholds); err == nil {
+		t.Errorf("expected an error for an invalid minimum CPU difference")
+	}
+}
+
+func TestRolloutIsNeededBoundsTriggerMode(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+
+	tests := []struct {
+		name                    string
+		mode                    string
+		cpuLowerBound           string
+		expectRolloutNeeded     bool
+		expectRule              string
+		expectInvalidAnnotation bool
+	}{
+		{
+			name:                "Requests within the bounds don't trigger a rollout",
+			mode:                utils.TriggerModeBounds,
+			cpuLowerBound:       "40m",
+			expectRolloutNeeded: false,
+		},
+		{
+			name:                "Requests below the lower bound trigger a rollout",
+			mode:                utils.TriggerModeBounds,
+			cpuLowerBound:       "60m",
+			expectRolloutNeeded: true,
+			expectRule:          TriggerRuleCPUBelowLowerBound,
+		},
+		{
+			name:                "Target mode ignores the bounds",
+			mode:                utils.TriggerModeTarget,
+			cpuLowerBound:       "40m",
+			expectRolloutNeeded: true,
+			expectRule:          TriggerRuleCPUIncrease,
+		},
+		{
+			name:                    "Invalid trigger modes are reported",
+			mode:                    "upper",
+			expectInvalidAnnotation: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vpa, pod := createTestDriftVPAAndPod(testutil.WithAnnotation(utils.VPAAnnotationTriggerMode, tt.mode))
+			for i := range vpa.Status.Recommendation.ContainerRecommendations {
+				vpa.Status.Recommendation.ContainerRecommendations[i].LowerBound = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cmp.Or(tt.cpuLowerBound, "0")), corev1.ResourceMemory: resource.MustParse("80Mi")}
+				vpa.Status.Recommendation.ContainerRecommendations[i].UpperBound = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m"), corev1.ResourceMemory: resource.MustParse("200Mi")}
+			}
+			recorder := record.NewFakeRecorder(10)
+
+			rolloutIsNeeded, containerDiffs, _, err := RolloutIsNeeded(ctx, testutil.CreateTestPodLister(pod), nil, limitrange.NewNoopLimitsCalculator(), recorder, vpa, workload, percentTriggerThresholds(10), StabilizationConfig{}, NewDryRunDriftHistories(), 0, "", false, false)
+			if tt.expectInvalidAnnotation {
+				if err == nil {
+					t.Fatalf("expected an error for the invalid annotation")
+				}
+				if event := <-recorder.Events; !strings.Contains(event, EventReasonInvalidAnnotation) {
+					t.Errorf("expected an %s event, got: %s", EventReasonInvalidAnnotation, event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rolloutIsNeeded != tt.expectRolloutNeeded {
+				t.Errorf("expected rollout needed to be %v, got: %v", tt.expectRolloutNeeded, rolloutIsNeeded)
+			}
+			appDiff := containerDiffs[1]
+			if appDiff.TriggerMode != tt.mode || appDiff.TriggeredRule != tt.expectRule {
+				t.Errorf("expected mode %s and rule %q, got: %s and %q", tt.mode, tt.expectRule, appDiff.TriggerMode, appDiff.TriggeredRule)
+			}
+			if appDiff.CPUOutsideBounds != (tt.cpuLowerBound == "60m") || appDiff.MemoryOutsideBounds {
+				t.Errorf("unexpected outside bounds CPU %v and memory %v", appDiff.CPUOutsideBounds, appDiff.MemoryOutsideBounds)
+			}
+			if tt.expectRule == TriggerRuleCPUBelowLowerBound {
+				if event := <-recorder.Events; !strings.Contains(event, "outside of the VPA recommendation bounds") || !strings.Contains(event, "cpu-below-lower-bound (lower bound 60m)") {
+					t.Errorf("expected a %s event about the bounds, got: %s", EventReasonRolloutNeeded, event)
+				}
+			}
+		})
+	}
+}
+
+func TestBoundsTriggeredRule(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceName corev1.ResourceName
+		request      string
+		lowerBound   string
+		upperBound   string
+		expectRule   string
+	}{
+		{"CPU within the bounds", corev1.ResourceCPU, "100m", "50m", "200m", ""},
+		{"CPU below the lower bound", corev1.ResourceCPU, "40m", "50m", "200m", TriggerRuleCPUBelowLowerBound},
+		{"CPU above the upper bound", corev1.ResourceCPU, "250m", "50m", "200m", TriggerRuleCPUAboveUpperBound},
+		{"Memory below the lower bound", corev1.ResourceMemory, "64Mi", "128Mi", "1Gi", TriggerRuleMemoryBelowLowerBound},
+		{"Memory above the upper bound", corev1.ResourceMemory, "2Gi", "128Mi", "1Gi", TriggerRuleMemoryAboveUpperBound},
+		{"Bounds not set", corev1.ResourceMemory, "2Gi", "0", "0", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rule := boundsTriggeredRule(tt.resourceName, resource.MustParse(tt.request), resource.MustParse(tt.lowerBound), resource.MustParse(tt.upperBound)); rule != tt.expectRule {
+				t.Errorf("expected rule %q, got: %q", tt.expectRule, rule)
+			}
+		})
+	}
+}
+
+func TestRolloutIsNeededInitContainers(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	always := corev1.ContainerRestartPolicyAlways
+
+	tests := []struct {
+		name                    string
+		scope                   string
+		expectRolloutNeeded     bool
+		expectContainers        []string
+		expectInvalidAnnotation bool
+	}{
+		{
+			name:                "Init containers are ignored by default",
+			expectRolloutNeeded: false,
+			expectContainers:    []string{"sidecar"},
+		},
+		{
+			name:                "Native sidecars are evaluated",
+			scope:               utils.InitContainersSidecars,
+			expectRolloutNeeded: true,
+			expectContainers:    []string{"sidecar", "app"},
+		},
+		{
+			name:                    "Invalid scopes are reported",
+			scope:                   "sidecar",
+			expectInvalidAnnotation: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options []testutil.VPAOption
+			if tt.scope != "" {
+				options = append(options, testutil.WithAnnotation(utils.VPAAnnotationInitContainers, tt.scope))
+			}
+			vpa, pod := createTestDriftVPAAndPod(options...)
+			// The drifting app container runs as a native sidecar
+			pod.Spec.InitContainers = []corev1.Container{pod.Spec.Containers[1]}
+			pod.Spec.InitContainers[0].RestartPolicy = &always
+			pod.Spec.Containers = pod.Spec.Containers[:1]
+			recorder := record.NewFakeRecorder(10)
+
+			rolloutIsNeeded, containerDiffs, _, err := RolloutIsNeeded(ctx, testutil.CreateTestPodLister(pod), nil, limitrange.NewNoopLimitsCalculator(), recorder, vpa, workload, percentTriggerThresholds(10), StabilizationConfig{}, NewDryRunDriftHistories(), 0, "", false, false)
+			if tt.expectInvalidAnnotation {
+				if err == nil {
+					t.Fatalf("expected an error for the invalid annotation")
+				}
+				if event := <-recorder.Events; !strings.Contains(event, EventReasonInvalidAnnotation) {
+					t.Errorf("expected an %s event, got: %s", EventReasonInvalidAnnotation, event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rolloutIsNeeded != tt.expectRolloutNeeded {
+				t.Errorf("expected rollout needed to be %v, got: %v", tt.expectRolloutNeeded, rolloutIsNeeded)
+			}
+			if len(containerDiffs) != len(tt.expectContainers) {
+				t.Fatalf("expected diffs for containers %v, got: %v", tt.expectContainers, containerDiffs)
+			}
+			for i, containerDiff := range containerDiffs {
+				if containerDiff.ContainerName != tt.expectContainers[i] {
+					t.Errorf("expected container %s, got: %s", tt.expectContainers[i], containerDiff.ContainerName)
+				}
+			}
+		})
+	}
+}
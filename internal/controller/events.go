@@ -0,0 +1,72 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the Events recorded on VPAs and their target workloads
+const (
+	EventReasonRolloutNeeded         = "RolloutNeeded"
+	EventReasonRolloutTriggered      = "RolloutTriggered"
+	EventReasonRolloutCompleted      = "RolloutCompleted"
+	EventReasonRolloutFailed         = "RolloutFailed"
+	EventReasonRolloutUnapplied      = "RolloutUnapplied"
+	EventReasonSurgeBufferCreated    = "SurgeBufferCreated"
+	EventReasonSurgeBufferUpdated    = "SurgeBufferUpdated"
+	EventReasonSurgeBufferDeleted    = "SurgeBufferDeleted"
+	EventReasonSurgeBufferNotReady   = "SurgeBufferNotReady"
+	EventReasonSurgeBufferCollected  = "SurgeBufferCollected"
+	EventReasonZeroMaxSurge          = "ZeroMaxSurge"
+	EventReasonInvalidAnnotation     = "InvalidAnnotation"
+	EventReasonAPIError              = "APIError"
+	EventReasonDryRun                = "DryRun"
+	EventReasonRecommendationSkipped = "RecommendationSkipped"
+	EventReasonRolloutStabilizing    = "RolloutStabilizing"
+	EventReasonCooldownBypassed      = "CooldownBypassed"
+	EventReasonMemoryDecreaseBlocked = "MemoryDecreaseBlocked"
+)
+
+// Records an Event on the VPA and, if it is not nil, on its target workload
+func recordEvent(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, eventType, reason, messageFmt string, args ...interface{}) {
+	recorder.Eventf(vpaReference(vpa), eventType, reason, messageFmt, args...)
+	if workload != nil {
+		recorder.Eventf(workloadReference(workload), eventType, reason, messageFmt, args...)
+	}
+}
+
+// Records a Warning Event on the VPA about one of its annotations having an invalid value
+func recordInvalidAnnotationEvent(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, annotation string, err error) {
+	recordEvent(recorder, vpa, nil, corev1.EventTypeWarning, EventReasonInvalidAnnotation, "Invalid value %q for annotation %s: %v", vpa.Annotations[annotation], annotation, err)
+}
+
+// Records a Warning Event on the VPA and its target workload about a failed API call
+func recordAPIErrorEvent(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, operation string, err error) {
+	recordEvent(recorder, vpa, workload, corev1.EventTypeWarning, EventReasonAPIError, "Error during %s: %v", operation, err)
+}
+
+// VPAs from the informer cache have no TypeMeta, so the reference is built explicitly
+func vpaReference(vpa v1.VerticalPodAutoscaler) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion:      v1.SchemeGroupVersion.String(),
+		Kind:            "VerticalPodAutoscaler",
+		Name:            vpa.Name,
+		Namespace:       vpa.Namespace,
+		UID:             vpa.UID,
+		ResourceVersion: vpa.ResourceVersion,
+	}
+}
+
+func workloadReference(workload map[string]interface{}) *corev1.ObjectReference {
+	obj := &unstructured.Unstructured{Object: workload}
+	return &corev1.ObjectReference{
+		APIVersion:      obj.GetAPIVersion(),
+		Kind:            obj.GetKind(),
+		Name:            obj.GetName(),
+		Namespace:       obj.GetNamespace(),
+		UID:             obj.GetUID(),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+}
@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestInvalidAnnotationEvent(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	vpa := testutil.CreateTestVPA(testutil.WithCooldownPeriod("not-a-duration"))
+	workload := testutil.CreateTestWorkload("test-deployment", "default", "")
+
+	_, _, err := CooldownHasElapsed(context.Background(), testutil.CreateTestPodLister(), recorder, vpa, workload, 10*time.Minute)
+	if err == nil {
+		t.Fatalf("expected an error for an invalid cooldown period annotation")
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning "+EventReasonInvalidAnnotation) {
+			t.Errorf("expected a Warning %s event, got: %s", EventReasonInvalidAnnotation, event)
+		}
+	default:
+		t.Errorf("expected an event to be recorded")
+	}
+}
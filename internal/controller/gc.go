@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+)
+
+// Surge buffers younger than this are never collected. TriggerRollout creates the surge buffer before it sets the VPA's rollout status to 'pending',
+// and the collection reads the VPA from the informer cache, which can lag behind that patch: a new surge buffer can look orphaned for a moment.
+const surgeBufferGCGracePeriod = 5 * time.Minute
+
+// Deletes the surge buffer workloads that no rollout is waiting on: their VPA no longer exists, its rollout is not 'pending' or 'in-progress' anymore, or they are older than the maximum age.
+// It runs at startup and then periodically, while the controller is running.
+func (c *Controller) collectOrphanedSurgeBuffers(ctx context.Context) {
+	log := slog.Default()
+
+	selector := labels.SelectorFromSet(labels.Set{utils.LabelSurgeBuffer: "true"})
+	for gvr, lister := range c.workloads.synced() {
+		objs, err := lister.List(selector)
+		if err != nil {
+			log.Error("Error listing surge buffer workloads", "err", err, "Resource", gvr.String())
+			continue
+		}
+		for _, obj := range objs {
+			surgeBuffer, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			vpa := c.surgeBufferVPA(surgeBuffer)
+			orphaned, reason := surgeBufferIsOrphaned(surgeBuffer, vpa, c.config.SurgeBufferMaxAge)
+			if !orphaned {
+				continue
+			}
+			c.collectSurgeBuffer(ctx, gvr, surgeBuffer, vpa, reason)
+		}
+	}
+}
+
+// Check if a surge buffer workload is orphaned, and why. vpa is the VPA it was created for, or nil if it no longer exists.
+func surgeBufferIsOrphaned(surgeBuffer *unstructured.Unstructured, vpa *v1.VerticalPodAutoscaler, maxAge time.Duration) (bool, string) {
+	age := time.Since(surgeBuffer.GetCreationTimestamp().Time)
+	if age < surgeBufferGCGracePeriod {
+		return false, ""
+	}
+	if maxAge > 0 && age > maxAge {
+		return true, metrics.SurgeBufferGCReasonMaxAgeExceeded
+	}
+	if vpa == nil {
+		return true, metrics.SurgeBufferGCReasonVPANotFound
+	}
+	// A VPA that was deleted and recreated with the same name is not the one the surge buffer was created for
+	if vpaUID := surgeBuffer.GetLabels()[utils.LabelSurgeBufferVPAUID]; vpaUID != "" && vpaUID != string(vpa.UID) {
+		return true, metrics.SurgeBufferGCReasonVPANotFound
+	}
+	if rolloutStatus := GetRolloutStatus(context.Background(), *vpa); rolloutStatus != "pending" && rolloutStatus != "in-progress" {
+		return true, metrics.SurgeBufferGCReasonRolloutNotActive
+	}
+	return false, ""
+}
+
+// Get the VPA a surge buffer workload was created for, from its owner reference, or from its name for surge buffers created before they had one.
+// It returns nil if the VPA no longer exists.
+func (c *Controller) surgeBufferVPA(surgeBuffer *unstructured.Unstructured) *v1.VerticalPodAutoscaler {
+	vpaName := surgeBuffer.GetAnnotations()[utils.AnnotationSurgeBufferVPAName]
+	for _, ownerReference := range surgeBuffer.GetOwnerReferences() {
+		if ownerReference.Kind == "VerticalPodAutoscaler" {
+			vpaName = ownerReference.Name
+		}
+	}
+	if vpaName != "" {
+		vpa, err := c.vpaLister.VerticalPodAutoscalers(surgeBuffer.GetNamespace()).Get(vpaName)
+		if err != nil {
+			return nil
+		}
+		return vpa
+	}
+
+	sourceWorkloadName := strings.TrimSuffix(surgeBuffer.GetName(), surgeBufferNameSuffix)
+	vpas, err := c.vpaIndexer.ByIndex(vpaByTargetIndex, vpaTargetIndexKey(surgeBuffer.GetNamespace(), surgeBuffer.GetKind(), sourceWorkloadName))
+	if err != nil || len(vpas) == 0 {
+		return nil
+	}
+	vpa, ok := vpas[0].(*v1.VerticalPodAutoscaler)
+	if !ok {
+		return nil
+	}
+	return vpa
+}
+
+// Deletes an orphaned surge buffer workload, and reports it with an Event and a metric
+func (c *Controller) collectSurgeBuffer(ctx context.Context, gvr schema.GroupVersionResource, surgeBuffer *unstructured.Unstructured, vpa *v1.VerticalPodAutoscaler, reason string) {
+	log := slog.Default()
+
+	dryRun := c.config.DryRun
+	if vpa != nil {
+		dryRun = VPAIsInDryRun(ctx, c.recorder, *vpa, c.config.DryRun)
+	}
+	if dryRun {
+		log.Info("Dry run: would delete orphaned surge buffer workload", "SurgeBufferWorkloadName", surgeBuffer.GetName(), "Namespace", surgeBuffer.GetNamespace(), "Reason", reason)
+		c.recordSurgeBufferCollectedEvent(surgeBuffer, vpa, corev1.EventTypeNormal, EventReasonDryRun, "Dry run: would delete orphaned surge buffer %s %s, reason: %s", surgeBuffer.GetKind(), surgeBuffer.GetName(), reason)
+		return
+	}
+
+	// Only delete the exact object that was found orphaned
+	uid := surgeBuffer.GetUID()
+	err := c.dynamicClient.Resource(gvr).Namespace(surgeBuffer.GetNamespace()).Delete(ctx, surgeBuffer.GetName(), metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return
+		}
+		log.Error("Error deleting orphaned surge buffer workload", "err", err, "SurgeBufferWorkloadName", surgeBuffer.GetName(), "Namespace", surgeBuffer.GetNamespace())
+		metrics.APIErrors.WithLabelValues(metrics.OperationDeleteSurgeBuffer).Inc()
+		return
+	}
+
+	log.Info("Deleted orphaned surge buffer workload", "SurgeBufferWorkloadName", surgeBuffer.GetName(), "Namespace", surgeBuffer.GetNamespace(), "Reason", reason)
+	metrics.SurgeBuffersCollected.WithLabelValues(surgeBuffer.GetNamespace(), reason).Inc()
+	c.recordSurgeBufferCollectedEvent(surgeBuffer, vpa, corev1.EventTypeWarning, EventReasonSurgeBufferCollected, "Deleted orphaned surge buffer %s %s, reason: %s", surgeBuffer.GetKind(), surgeBuffer.GetName(), reason)
+
+	// A failure is only logged, the retention policy of the surge buffer StatefulSet deletes its PVCs too
+	if _, err := deleteSurgeBufferPVCs(ctx, c.dynamicClient, surgeBuffer.GetNamespace(), surgeBuffer.GetName(), volumeClaimTemplateNames(surgeBuffer.Object)); err != nil {
+		log.Error("Error deleting PVCs of orphaned surge buffer workload", "err", err, "SurgeBufferWorkloadName", surgeBuffer.GetName(), "Namespace", surgeBuffer.GetNamespace())
+	}
+}
+
+// Records an Event on the surge buffer workload and, if it still exists, on its VPA
+func (c *Controller) recordSurgeBufferCollectedEvent(surgeBuffer *unstructured.Unstructured, vpa *v1.VerticalPodAutoscaler, eventType, reason, messageFmt string, args ...interface{}) {
+	if vpa != nil {
+		recordEvent(c.recorder, *vpa, surgeBuffer.Object, eventType, reason, messageFmt, args...)
+		return
+	}
+	c.recorder.Eventf(workloadReference(surgeBuffer.Object), eventType, reason, messageFmt, args...)
+}
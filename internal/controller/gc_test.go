@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func testSurgeBuffer(age time.Duration, vpaUID string) *unstructured.Unstructured {
+	surgeBuffer := &unstructured.Unstructured{Object: testutil.CreateTestWorkload(surgeBufferWorkloadName("test-deployment"), "default", "")}
+	surgeBuffer.SetLabels(map[string]string{utils.LabelSurgeBuffer: "true", utils.LabelSurgeBufferVPAUID: vpaUID})
+	surgeBuffer.SetCreationTimestamp(metav1.NewTime(time.Now().Add(-age)))
+	surgeBuffer.SetUID("surge-buffer-uid")
+	return surgeBuffer
+}
+
+func TestSurgeBufferIsOrphaned(t *testing.T) {
+	pendingVPA := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "pending"))
+	pendingVPA.UID = "vpa-uid"
+	completeVPA := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "complete"))
+	completeVPA.UID = "vpa-uid"
+
+	tests := []struct {
+		name           string
+		surgeBuffer    *unstructured.Unstructured
+		vpa            *v1.VerticalPodAutoscaler
+		maxAge         time.Duration
+		expectOrphaned bool
+		expectReason   string
+	}{
+		{
+			name:           "Surge buffer of a pending rollout is kept",
+			surgeBuffer:    testSurgeBuffer(time.Hour, "vpa-uid"),
+			vpa:            &pendingVPA,
+			maxAge:         3 * time.Hour,
+			expectOrphaned: false,
+		},
+		{
+			name:           "Surge buffer within the grace period is kept",
+			surgeBuffer:    testSurgeBuffer(time.Minute, "vpa-uid"),
+			vpa:            nil,
+			maxAge:         3 * time.Hour,
+			expectOrphaned: false,
+		},
+		{
+			name:           "Surge buffer without a VPA is collected",
+			surgeBuffer:    testSurgeBuffer(time.Hour, "vpa-uid"),
+			vpa:            nil,
+			maxAge:         3 * time.Hour,
+			expectOrphaned: true,
+			expectReason:   metrics.SurgeBufferGCReasonVPANotFound,
+		},
+		{
+			name:           "Surge buffer of a recreated VPA is collected",
+			surgeBuffer:    testSurgeBuffer(time.Hour, "old-vpa-uid"),
+			vpa:            &pendingVPA,
+			maxAge:         3 * time.Hour,
+			expectOrphaned: true,
+			expectReason:   metrics.SurgeBufferGCReasonVPANotFound,
+		},
+		{
+			name:           "Surge buffer of a complete rollout is collected",
+			surgeBuffer:    testSurgeBuffer(time.Hour, "vpa-uid"),
+			vpa:            &completeVPA,
+			maxAge:         3 * time.Hour,
+			expectOrphaned: true,
+			expectReason:   metrics.SurgeBufferGCReasonRolloutNotActive,
+		},
+		{
+			name:           "Surge buffer past the max age is collected",
+			surgeBuffer:    testSurgeBuffer(4*time.Hour, "vpa-uid"),
+			vpa:            &pendingVPA,
+			maxAge:         3 * time.Hour,
+			expectOrphaned: true,
+			expectReason:   metrics.SurgeBufferGCReasonMaxAgeExceeded,
+		},
+		{
+			name:           "Max age of 0 is disabled",
+			surgeBuffer:    testSurgeBuffer(24*time.Hour, "vpa-uid"),
+			vpa:            &pendingVPA,
+			maxAge:         0,
+			expectOrphaned: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orphaned, reason := surgeBufferIsOrphaned(tt.surgeBuffer, tt.vpa, tt.maxAge)
+			if orphaned != tt.expectOrphaned {
+				t.Errorf("expected orphaned to be %v, got: %v", tt.expectOrphaned, orphaned)
+			}
+			if reason != tt.expectReason {
+				t.Errorf("expected reason %q, got: %q", tt.expectReason, reason)
+			}
+		})
+	}
+}
+
+func TestCollectSurgeBuffer(t *testing.T) {
+	ctx := context.Background()
+	gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	t.Run("Orphaned surge buffer is deleted", func(t *testing.T) {
+		recorder := record.NewFakeRecorder(10)
+		surgeBuffer := testSurgeBuffer(time.Hour, "vpa-uid")
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), surgeBuffer.DeepCopy())
+		c := &Controller{dynamicClient: dynamicClient, recorder: recorder}
+
+		c.collectSurgeBuffer(ctx, gvr, surgeBuffer, nil, metrics.SurgeBufferGCReasonVPANotFound)
+
+		actions := dynamicClient.Actions()
+		if len(actions) != 1 || actions[0].GetVerb() != "delete" {
+			t.Fatalf("expected the surge buffer to be deleted, got: %v", actions)
+		}
+		event := <-recorder.Events
+		if !strings.HasPrefix(event, "Warning "+EventReasonSurgeBufferCollected) {
+			t.Errorf("expected a %s event, got: %s", EventReasonSurgeBufferCollected, event)
+		}
+	})
+
+	t.Run("Orphaned surge buffer is kept in dry run", func(t *testing.T) {
+		recorder := record.NewFakeRecorder(10)
+		surgeBuffer := testSurgeBuffer(time.Hour, "vpa-uid")
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), surgeBuffer.DeepCopy())
+		c := &Controller{config: Config{DryRun: true}, dynamicClient: dynamicClient, recorder: recorder}
+
+		c.collectSurgeBuffer(ctx, gvr, surgeBuffer, nil, metrics.SurgeBufferGCReasonVPANotFound)
+
+		if len(dynamicClient.Actions()) != 0 {
+			t.Errorf("expected no API calls in dry run, got: %v", dynamicClient.Actions())
+		}
+		event := <-recorder.Events
+		if !strings.HasPrefix(event, "Normal "+EventReasonDryRun) {
+			t.Errorf("expected a %s event, got: %s", EventReasonDryRun, event)
+		}
+	})
+}
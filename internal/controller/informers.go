@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WorkloadListers provides listers for the workload resources targeted by VPAs, keyed by their GroupVersionResource
+type WorkloadListers interface {
+	ForResource(ctx context.Context, gvr schema.GroupVersionResource) (cache.GenericLister, error)
+}
+
+// Maximum time to wait for a workload informer to sync, e.g. when the controller is not allowed to list the workload kind
+const workloadInformerSyncTimeout = 30 * time.Second
+
+// Time after an informer timed out syncing during which ForResource fails right away, instead of blocking a worker for the sync timeout again.
+// The informer keeps retrying in the background, and its lister is returned as soon as it syncs.
+const workloadInformerSyncBackoff = 5 * time.Minute
+
+// Lazily starts a shared informer for each workload resource type that is targeted by a VPA.
+// Workload kinds are not known in advance (e.g. OpenKruise CloneSets), so informers are added on first use.
+type workloadInformers struct {
+	mu        sync.Mutex
+	factory   dynamicinformer.DynamicSharedInformerFactory
+	handler   cache.ResourceEventHandler
+	informers map[schema.GroupVersionResource]informers.GenericInformer
+	stopCh    <-chan struct{}
+	// Maximum time ForResource waits for an informer to sync
+	syncTimeout time.Duration
+	// Time at which each informer that has not synced yet last timed out, and how long to fail right away after it
+	syncFailures map[schema.GroupVersionResource]time.Time
+	syncBackoff  time.Duration
+}
+
+func newWorkloadInformers(ctx context.Context, factory dynamicinformer.DynamicSharedInformerFactory, handler cache.ResourceEventHandler) *workloadInformers {
+	return &workloadInformers{
+		factory:      factory,
+		handler:      handler,
+		informers:    make(map[schema.GroupVersionResource]informers.GenericInformer),
+		stopCh:       ctx.Done(),
+		syncTimeout:  workloadInformerSyncTimeout,
+		syncFailures: make(map[schema.GroupVersionResource]time.Time),
+		syncBackoff:  workloadInformerSyncBackoff,
+	}
+}
+
+// Registers the informer for the given resource without starting it, so it is started along with the factory
+func (w *workloadInformers) register(gvr schema.GroupVersionResource) (informers.GenericInformer, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.registerLocked(gvr)
+}
+
+func (w *workloadInformers) registerLocked(gvr schema.GroupVersionResource) (informers.GenericInformer, error) {
+	if informer, ok := w.informers[gvr]; ok {
+		return informer, nil
+	}
+	informer := w.factory.ForResource(gvr)
+	if _, err := informer.Informer().AddEventHandler(w.handler); err != nil {
+		return nil, fmt.Errorf("error adding event handler to %s informer: %v", gvr.String(), err)
+	}
+	w.informers[gvr] = informer
+	return informer, nil
+}
+
+// Returns a lister for the given workload resource, starting and syncing its informer if needed.
+// The lock is not held while waiting for the informer to sync, so that an informer that cannot sync, e.g. because listing
+// its resource is forbidden, does not block the other workers and event handlers. It returns an error after the sync timeout,
+// so that the VPA is requeued with backoff. After a timeout, it fails right away until the sync backoff has elapsed.
+func (w *workloadInformers) ForResource(ctx context.Context, gvr schema.GroupVersionResource) (cache.GenericLister, error) {
+	w.mu.Lock()
+	informer, err := w.registerLocked(gvr)
+	if err == nil && !informer.Informer().HasSynced() {
+		if failedAt, found := w.syncFailures[gvr]; found && time.Since(failedAt) < w.syncBackoff {
+			w.mu.Unlock()
+			return nil, fmt.Errorf("%s informer has not synced, it timed out %s ago", gvr.String(), time.Since(failedAt).Round(time.Second))
+		}
+		// Start is a no-op for informers that are already running
+		w.factory.Start(w.stopCh)
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if !informer.Informer().HasSynced() {
+		syncCtx, cancel := context.WithTimeout(ctx, w.syncTimeout)
+		defer cancel()
+		if !cache.WaitForCacheSync(syncCtx.Done(), informer.Informer().HasSynced) {
+			w.mu.Lock()
+			w.syncFailures[gvr] = time.Now()
+			w.mu.Unlock()
+			return nil, fmt.Errorf("timed out waiting for %s informer to sync", gvr.String())
+		}
+	}
+	return informer.Lister(), nil
+}
+
+// Returns the lister for the given workload resource only if its informer is already running and synced
+func (w *workloadInformers) existing(gvr schema.GroupVersionResource) (cache.GenericLister, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	informer, ok := w.informers[gvr]
+	if !ok || !informer.Informer().HasSynced() {
+		return nil, false
+	}
+	return informer.Lister(), true
+}
+
+// Returns the listers of all the workload resources whose informer is running and synced
+func (w *workloadInformers) synced() map[schema.GroupVersionResource]cache.GenericLister {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	listers := make(map[schema.GroupVersionResource]cache.GenericLister, len(w.informers))
+	for gvr, informer := range w.informers {
+		if informer.Informer().HasSynced() {
+			listers[gvr] = informer.Lister()
+		}
+	}
+	return listers
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestWorkloadInformersForResourceSyncTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gvr := schema.GroupVersionResource{Group: "apps.kruise.io", Version: "v1alpha1", Resource: "clonesets"}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{gvr: "CloneSetList"})
+	// The controller is not allowed to list the workload kind, so its informer never syncs
+	dynamicClient.PrependReactor("list", gvr.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(gvr.GroupResource(), "", nil)
+	})
+	workloads := newWorkloadInformers(ctx, dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0), cache.ResourceEventHandlerFuncs{})
+	workloads.syncTimeout = 500 * time.Millisecond
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := workloads.ForResource(ctx, gvr)
+		errs <- err
+	}()
+
+	// The other workers and event handlers are not blocked while the informer syncs
+	time.Sleep(100 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		workloads.existing(gvr)
+		workloads.synced()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatalf("expected the informers not to be locked while waiting for the sync")
+	}
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("expected an error for an informer that cannot sync")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected ForResource to time out")
+	}
+
+	// Within the sync backoff, the next workers fail right away instead of waiting for the sync timeout again
+	startedAt := time.Now()
+	if _, err := workloads.ForResource(ctx, gvr); err == nil {
+		t.Errorf("expected an error for an informer that timed out syncing")
+	}
+	if elapsed := time.Since(startedAt); elapsed >= workloads.syncTimeout {
+		t.Errorf("expected ForResource to fail right away within the sync backoff, took: %s", elapsed)
+	}
+
+	// Once the backoff has elapsed, the informer is waited for again
+	workloads.syncBackoff = 0
+	startedAt = time.Now()
+	if _, err := workloads.ForResource(ctx, gvr); err == nil {
+		t.Errorf("expected an error for an informer that cannot sync")
+	}
+	if elapsed := time.Since(startedAt); elapsed < workloads.syncTimeout {
+		t.Errorf("expected ForResource to wait for the sync timeout once the backoff has elapsed, took: %s", elapsed)
+	}
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// Reason of the termination of a container killed for exceeding its memory limit
+const oomKilledReason = "OOMKilled"
+
+// OOM kills of a container across the workload's pods
+type oomKills struct {
+	// Pods in which the container was OOM killed within the window, and their restart counts of the container
+	Pods     int
+	Restarts int32
+	// Time of the latest OOM kill
+	LastKilledAt time.Time
+}
+
+// Get the containers of the pods that were OOM killed within the window, by container name.
+// A container was OOM killed if its current or last termination has the OOMKilled reason, and its restart count tells how many times it restarted.
+// Init containers are included, since native sidecars run alongside the containers. A window of 0 disables it.
+func recentOOMKills(pods []corev1.Pod, window time.Duration, now time.Time) map[string]oomKills {
+	kills := map[string]oomKills{}
+	if window == 0 {
+		return kills
+	}
+	for _, pod := range pods {
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			killedAt, killed := containerOOMKilledAt(status)
+			if !killed || now.Sub(killedAt) > window {
+				continue
+			}
+			containerKills := kills[status.Name]
+			containerKills.Pods++
+			containerKills.Restarts += status.RestartCount
+			if killedAt.After(containerKills.LastKilledAt) {
+				containerKills.LastKilledAt = killedAt
+			}
+			kills[status.Name] = containerKills
+		}
+	}
+	return kills
+}
+
+// Get the time at which a container was last OOM killed, from its current or last termination
+func containerOOMKilledAt(status corev1.ContainerStatus) (time.Time, bool) {
+	for _, terminated := range []*corev1.ContainerStateTerminated{status.State.Terminated, status.LastTerminationState.Terminated} {
+		if terminated != nil && terminated.Reason == oomKilledReason {
+			return terminated.FinishedAt.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Check if any of the workload's pods had a container OOM killed within the window
+func WorkloadHasRecentOOMKills(ctx context.Context, podLister corelisters.PodLister, workload map[string]interface{}, window time.Duration) (bool, error) {
+	if window == 0 {
+		return false, nil
+	}
+	podList, err := getTargetWorkloadPods(ctx, workload, podLister)
+	if err != nil {
+		slog.Default().Error("Error getting pods for workload", "err", err, "workloadName", workload["metadata"].(map[string]interface{})["name"], "workloadNamespace", workload["metadata"].(map[string]interface{})["namespace"])
+		return false, err
+	}
+	return len(recentOOMKills(podList.Items, window, time.Now())) > 0, nil
+}
+
+// Get the containers that were recently OOM killed and need a rollout for their memory increase, for which the cooldown is bypassed.
+// The memory increase must trigger a rollout on its own, so that a container needing a rollout for its CPU does not bypass it.
+func memoryIncreasesAfterOOMKills(containerDiffs []ContainerDiff) []ContainerDiff {
+	var increases []ContainerDiff
+	for _, containerDiff := range containerDiffs {
+		if containerDiff.OOMKills.Pods > 0 && containerDiff.RolloutNeeded && containerDiff.memoryIncreaseTriggered() {
+			increases = append(increases, containerDiff)
+		}
+	}
+	return increases
+}
+
+// Check if the memory of the reported pod triggers the memory increase rule of the container's trigger mode
+func (d ContainerDiff) memoryIncreaseTriggered() bool {
+	if d.TriggerMode == utils.TriggerModeBounds {
+		return boundsTriggeredRule(corev1.ResourceMemory, d.MemoryRequest, d.MemoryLowerBound, d.MemoryUpperBound) == TriggerRuleMemoryBelowLowerBound
+	}
+	return d.Thresholds.triggeredRule(corev1.ResourceMemory, d.MemoryRequest, d.MemoryTarget) == TriggerRuleMemoryIncrease
+}
+
+// Get the containers that were recently OOM killed and whose memory the rollout would decrease, which blocks the rollout
+func memoryDecreasesAfterOOMKills(containerDiffs []ContainerDiff) []ContainerDiff {
+	var decreases []ContainerDiff
+	for _, containerDiff := range containerDiffs {
+		if containerDiff.OOMKills.Pods > 0 && !containerDiff.MemoryTarget.IsZero() && containerDiff.MemoryTarget.Cmp(containerDiff.MemoryRequest) < 0 {
+			decreases = append(decreases, containerDiff)
+		}
+	}
+	return decreases
+}
+
+// Describe the memory changes of recently OOM killed containers, for logs and Events
+func formatOOMKilledMemoryChanges(containerDiffs []ContainerDiff) string {
+	var descriptions []string
+	for _, containerDiff := range containerDiffs {
+		descriptions = append(descriptions, fmt.Sprintf("container %s (OOM killed in %d pods with %d restarts, last at %s) from %s to %s memory",
+			containerDiff.ContainerName, containerDiff.OOMKills.Pods, containerDiff.OOMKills.Restarts, containerDiff.OOMKills.LastKilledAt.UTC().Format(time.RFC3339),
+			containerDiff.MemoryRequest.String(), containerDiff.MemoryTarget.String()))
+	}
+	return strings.Join(descriptions, "; ")
+}
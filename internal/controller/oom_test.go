@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+// Status of a container that restarted after it was terminated for the given reason at the given time
+func terminatedContainerStatus(name, reason string, finishedAt time.Time, restartCount int32) corev1.ContainerStatus {
+	return corev1.ContainerStatus{
+		Name:         name,
+		Ready:        true,
+		RestartCount: restartCount,
+		LastTerminationState: corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{Reason: reason, ExitCode: 137, FinishedAt: metav1.NewTime(finishedAt)},
+		},
+	}
+}
+
+func TestRecentOOMKills(t *testing.T) {
+	now := time.Now()
+	pods := []corev1.Pod{
+		{Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				terminatedContainerStatus("app", oomKilledReason, now.Add(-10*time.Minute), 2),
+				terminatedContainerStatus("sidecar", "Error", now.Add(-10*time.Minute), 1),
+			},
+			InitContainerStatuses: []corev1.ContainerStatus{
+				terminatedContainerStatus("proxy", oomKilledReason, now.Add(-2*time.Hour), 1),
+			},
+		}},
+		{Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				// Currently terminated, waiting to be restarted
+				{Name: "app", RestartCount: 1, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: oomKilledReason, FinishedAt: metav1.NewTime(now.Add(-time.Minute))}}},
+			},
+		}},
+	}
+
+	kills := recentOOMKills(pods, time.Hour, now)
+	if len(kills) != 1 {
+		t.Fatalf("expected only the app container to be recently OOM killed, got: %v", kills)
+	}
+	if kills["app"].Pods != 2 || kills["app"].Restarts != 3 || !kills["app"].LastKilledAt.Equal(now.Add(-time.Minute)) {
+		t.Errorf("expected the app container to be OOM killed in 2 pods with 3 restarts, last a minute ago, got: %+v", kills["app"])
+	}
+
+	if kills := recentOOMKills(pods, 3*time.Hour, now); kills["proxy"].Pods != 1 {
+		t.Errorf("expected the OOM kills of init containers within the window to be counted, got: %v", kills)
+	}
+	if kills := recentOOMKills(pods, 0, now); len(kills) != 0 {
+		t.Errorf("expected a window of 0 to disable it, got: %v", kills)
+	}
+}
+
+func TestRolloutIsNeededOOMKills(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+
+	tests := []struct {
+		name                string
+		appMemoryRequest    string
+		oomKilledAt         time.Duration
+		oomWindow           time.Duration
+		oomOnly             bool
+		crashLooping        bool
+		expectRolloutNeeded bool
+		expectIncreases     int
+		expectEvent         string
+	}{
+		{
+			name:                "Memory decreases of recently OOM killed containers are blocked",
+			appMemoryRequest:    "200Mi",
+			oomKilledAt:         10 * time.Minute,
+			oomWindow:           time.Hour,
+			expectRolloutNeeded: false,
+			expectEvent:         EventReasonMemoryDecreaseBlocked,
+		},
+		{
+			name:                "Memory decreases are not blocked once the OOM window has passed",
+			appMemoryRequest:    "200Mi",
+			oomKilledAt:         2 * time.Hour,
+			oomWindow:           time.Hour,
+			expectRolloutNeeded: true,
+			expectEvent:         EventReasonRolloutNeeded,
+		},
+		{
+			name:                "Memory decreases are not blocked when the OOM window is disabled",
+			appMemoryRequest:    "200Mi",
+			oomKilledAt:         10 * time.Minute,
+			expectRolloutNeeded: true,
+			expectEvent:         EventReasonRolloutNeeded,
+		},
+		{
+			name:                "Memory increases of recently OOM killed containers are reported",
+			appMemoryRequest:    "50Mi",
+			oomKilledAt:         10 * time.Minute,
+			oomWindow:           time.Hour,
+			expectRolloutNeeded: true,
+			expectIncreases:     1,
+			expectEvent:         EventReasonRolloutNeeded,
+		},
+		{
+			// The CPU of the app container triggers the rollout, while its memory is within the threshold
+			name:                "CPU increases of recently OOM killed containers do not bypass the cooldown",
+			appMemoryRequest:    "95Mi",
+			oomKilledAt:         10 * time.Minute,
+			oomWindow:           time.Hour,
+			expectRolloutNeeded: true,
+			expectIncreases:     0,
+			expectEvent:         EventReasonRolloutNeeded,
+		},
+		{
+			name:                "During the cooldown, memory increases of recently OOM killed containers need a rollout",
+			appMemoryRequest:    "50Mi",
+			oomKilledAt:         10 * time.Minute,
+			oomWindow:           time.Hour,
+			oomOnly:             true,
+			expectRolloutNeeded: true,
+			expectIncreases:     1,
+			expectEvent:         EventReasonRolloutNeeded,
+		},
+		{
+			name:                "During the cooldown, CPU increases of recently OOM killed containers are not reported",
+			appMemoryRequest:    "95Mi",
+			oomKilledAt:         10 * time.Minute,
+			oomWindow:           time.Hour,
+			oomOnly:             true,
+			expectRolloutNeeded: false,
+			expectIncreases:     0,
+		},
+		{
+			name:                "Crash looping OOM killed containers do not need to be ready",
+			appMemoryRequest:    "50Mi",
+			oomKilledAt:         time.Minute,
+			oomWindow:           time.Hour,
+			crashLooping:        true,
+			expectRolloutNeeded: true,
+			expectIncreases:     1,
+			expectEvent:         EventReasonRolloutNeeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vpa, pod := createTestDriftVPAAndPod()
+			pod.Spec.Containers[1].Resources.Requests[corev1.ResourceMemory] = resource.MustParse(tt.appMemoryRequest)
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+				{Name: "sidecar", Ready: true},
+				terminatedContainerStatus("app", oomKilledReason, time.Now().Add(-tt.oomKilledAt), 1),
+			}
+			if tt.crashLooping {
+				pod.Status.ContainerStatuses[1].Ready = false
+				pod.Status.ContainerStatuses[1].State.Waiting = &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}
+			}
+			recorder := record.NewFakeRecorder(10)
+
+			rolloutIsNeeded, containerDiffs, _, err := RolloutIsNeeded(ctx, testutil.CreateTestPodLister(pod), nil, limitrange.NewNoopLimitsCalculator(), recorder, vpa, workload, percentTriggerThresholds(10), StabilizationConfig{}, NewDryRunDriftHistories(), tt.oomWindow, "", tt.oomOnly, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rolloutIsNeeded != tt.expectRolloutNeeded {
+				t.Errorf("expected rollout needed to be %v, got: %v", tt.expectRolloutNeeded, rolloutIsNeeded)
+			}
+			if increases := memoryIncreasesAfterOOMKills(containerDiffs); len(increases) != tt.expectIncreases {
+				t.Errorf("expected %d memory increases of OOM killed containers, got: %v", tt.expectIncreases, increases)
+			}
+			if tt.expectEvent == "" {
+				if len(recorder.Events) != 0 {
+					t.Errorf("expected no event, got: %s", <-recorder.Events)
+				}
+				return
+			}
+			if event := <-recorder.Events; !strings.Contains(event, tt.expectEvent) {
+				t.Errorf("expected a %s event, got: %s", tt.expectEvent, event)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	vpa_api_util "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/vpa"
+	"k8s.io/client-go/tools/record"
+)
+
+// Compute the recommendation the VPA admission controller actually applies to a pod, rather than the raw one from the VPA status.
+// Like the admission controller, it caps the recommendation to:
+// - the namespace's Pod LimitRange, scaling the containers' recommendations proportionally
+// - the namespace's Container LimitRange min and max, keeping the containers' limit to request ratio
+// - the container policy's minAllowed and maxAllowed
+// - the container's limits, under 'RequestsOnly' controlled values
+// Containers of the pod without a recommendation are left out, and a nil recommendation is returned if the VPA has none.
+func EffectiveRecommendation(vpa v1.VerticalPodAutoscaler, pod *corev1.Pod, limitRanges limitrange.LimitRangeCalculator) (*v1.RecommendedPodResources, error) {
+	if vpa.Status.Recommendation == nil {
+		return nil, nil
+	}
+	recommendation, _, err := vpa_api_util.NewCappingRecommendationProcessor(limitRanges).Apply(&vpa, pod)
+	if err != nil {
+		return nil, fmt.Errorf("error computing the effective recommendation of VPA %s for pod %s: %v", vpa.Name, pod.Name, err)
+	}
+	return recommendation, nil
+}
+
+// Get the default limits of the namespace's Container LimitRange, which the admission controller scales like the containers' own limits
+func defaultContainerLimits(limitRanges limitrange.LimitRangeCalculator, namespace string) (corev1.ResourceList, error) {
+	limitRangeItem, err := limitRanges.GetContainerLimitRangeItem(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the container LimitRange of namespace %s: %v", namespace, err)
+	}
+	if limitRangeItem == nil {
+		return nil, nil
+	}
+	return limitRangeItem.Default, nil
+}
+
+// Build a pod from the pod template of a workload, to compute the effective recommendation of the pods it creates
+func podFromWorkloadTemplate(workload map[string]interface{}) (*corev1.Pod, error) {
+	template, ok := workload["spec"].(map[string]interface{})["template"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("workload has no pod template")
+	}
+	var podTemplate corev1.PodTemplateSpec
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(template, &podTemplate); err != nil {
+		return nil, fmt.Errorf("error reading the workload's pod template: %v", err)
+	}
+	pod := &corev1.Pod{ObjectMeta: podTemplate.ObjectMeta, Spec: podTemplate.Spec}
+	pod.Namespace, _ = workload["metadata"].(map[string]interface{})["namespace"].(string)
+	return pod, nil
+}
+
+// Read which init containers of the workload's pods are handled like regular containers from the VPA's annotation.
+// An invalid annotation is reported with an Event and returned as an error.
+func getInitContainersScope(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler) (string, error) {
+	switch scope := vpa.Annotations[utils.VPAAnnotationInitContainers]; scope {
+	case "":
+		return utils.InitContainersNone, nil
+	case utils.InitContainersNone, utils.InitContainersSidecars, utils.InitContainersAll:
+		return scope, nil
+	default:
+		err := fmt.Errorf("must be %s, %s or %s", utils.InitContainersNone, utils.InitContainersSidecars, utils.InitContainersAll)
+		recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationInitContainers, err)
+		return "", fmt.Errorf("error parsing annotation %s: %v", utils.VPAAnnotationInitContainers, err)
+	}
+}
+
+// Check if an init container is handled like a regular container in a scope.
+// Native sidecars are the init containers whose restartPolicy is 'Always', which keep running alongside the containers.
+func initContainerIsInScope(container corev1.Container, scope string) bool {
+	switch scope {
+	case utils.InitContainersAll:
+		return true
+	case utils.InitContainersSidecars:
+		return container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways
+	default:
+		return false
+	}
+}
+
+// Get a copy of a pod where the init containers in scope are appended to the containers, so that they are compared with
+// and capped to the recommendation like the regular containers. The pod itself is returned when no init container is in scope.
+func podWithInitContainers(pod *corev1.Pod, scope string) *corev1.Pod {
+	var initContainers []corev1.Container
+	for _, container := range pod.Spec.InitContainers {
+		if initContainerIsInScope(container, scope) {
+			initContainers = append(initContainers, container)
+		}
+	}
+	if len(initContainers) == 0 {
+		return pod
+	}
+	podCopy := pod.DeepCopy()
+	podCopy.Spec.Containers = append(podCopy.Spec.Containers, initContainers...)
+	return podCopy
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Check if the VPA's recommendation can be acted on, from the conditions the VPA recommender sets on the VPA's status.
+// A recommendation is skipped when:
+// - the recommender could not use the VPA's configuration ('ConfigUnsupported')
+// - the VPA does not match any pod ('NoPodsMatched')
+// - the recommender did not provide a recommendation ('RecommendationProvided' is not true, or there is no recommendation without the condition)
+// - the recommendation is based on too little usage history ('LowConfidence')
+// - the recommendation has not changed for longer than the maximum age, which 0 disables
+// A skipped recommendation is reported with an Event and counted by the RecommendationsSkipped metric when the reason to skip it changes, not on each evaluation.
+func RecommendationIsUsable(ctx context.Context, recorder record.EventRecorder, recommendations *RecommendationTracker, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, recommendationMaxAge time.Duration) (bool, error) {
+	log := slog.Default()
+
+	effectiveMaxAge, err := durationFromAnnotation(recorder, vpa, utils.VPAAnnotationRecommendationMaxAge, recommendationMaxAge)
+	if err != nil {
+		return false, err
+	}
+
+	key := vpa.Namespace + "/" + vpa.Name
+	now := time.Now()
+	reason, eventType, message := recommendationSkipReason(vpa, effectiveMaxAge, recommendations.seenAt(key, vpa.Status.Recommendation, now), now)
+	if !recommendations.setSkipReason(key, reason) {
+		if reason != "" {
+			log.Debug("Still skipping the VPA recommendation", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "Reason", reason)
+		}
+		return reason == "", nil
+	}
+	if reason == "" {
+		return true, nil
+	}
+	log.Info("Skipping the VPA recommendation", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name, "Reason", reason, "Message", message)
+	metrics.RecommendationsSkipped.WithLabelValues(vpa.Namespace, reason).Inc()
+	recordEvent(recorder, vpa, workload, eventType, EventReasonRecommendationSkipped, "Not acting on the VPA recommendation: %s", message)
+	return false, nil
+}
+
+// Get the reason to skip the VPA's recommendation, along with the type and message of its Event, or "" if the recommendation is usable.
+// seenAt is the time at which the current recommendation was first seen.
+func recommendationSkipReason(vpa v1.VerticalPodAutoscaler, maxAge time.Duration, seenAt, now time.Time) (string, string, string) {
+	if condition := vpaCondition(vpa, v1.ConfigUnsupported); condition != nil && condition.Status == corev1.ConditionTrue {
+		return metrics.RecommendationSkipReasonConfigUnsupported, corev1.EventTypeWarning, fmt.Sprintf("the VPA configuration is not supported by the recommender: %s", condition.Message)
+	}
+	if condition := vpaCondition(vpa, v1.NoPodsMatched); condition != nil && condition.Status == corev1.ConditionTrue {
+		return metrics.RecommendationSkipReasonNoPodsMatched, corev1.EventTypeNormal, fmt.Sprintf("the VPA does not match any pod: %s", condition.Message)
+	}
+	condition := vpaCondition(vpa, v1.RecommendationProvided)
+	if (condition != nil && condition.Status != corev1.ConditionTrue) || vpa.Status.Recommendation == nil || len(vpa.Status.Recommendation.ContainerRecommendations) == 0 {
+		return metrics.RecommendationSkipReasonNotProvided, corev1.EventTypeNormal, "the recommender has not provided a recommendation"
+	}
+	if condition := vpaCondition(vpa, v1.LowConfidence); condition != nil && condition.Status == corev1.ConditionTrue {
+		return metrics.RecommendationSkipReasonLowConfidence, corev1.EventTypeNormal, fmt.Sprintf("the recommendation has a low confidence: %s", condition.Message)
+	}
+	if age := now.Sub(seenAt); maxAge > 0 && age > maxAge {
+		return metrics.RecommendationSkipReasonStale, corev1.EventTypeWarning, fmt.Sprintf("the recommendation has not changed for %s, more than its maximum age of %s", age.Round(time.Second), maxAge)
+	}
+	return "", "", ""
+}
+
+// RecommendationTracker keeps, by VPA key, when the current recommendation of each VPA was first seen and why it was last skipped.
+// The VPA status has no update timestamp, and the transitions of its conditions do not change while the recommender keeps refreshing the recommendation,
+// so a recommendation's age is the time since the controller first saw its values. Recommendations seen before the controller started are as old as the controller.
+type RecommendationTracker struct {
+	mu              sync.Mutex
+	recommendations map[string]trackedRecommendation
+}
+
+type trackedRecommendation struct {
+	recommendation *v1.RecommendedPodResources
+	seenAt         time.Time
+	skipReason     string
+}
+
+func NewRecommendationTracker() *RecommendationTracker {
+	return &RecommendationTracker{recommendations: make(map[string]trackedRecommendation)}
+}
+
+// Get the time at which the VPA's current recommendation was first seen, now if it changed since the last call
+func (t *RecommendationTracker) seenAt(key string, recommendation *v1.RecommendedPodResources, now time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tracked, found := t.recommendations[key]
+	if !found || !equality.Semantic.DeepEqual(tracked.recommendation, recommendation) {
+		tracked.recommendation = recommendation.DeepCopy()
+		tracked.seenAt = now
+		t.recommendations[key] = tracked
+	}
+	return tracked.seenAt
+}
+
+// Record the reason the VPA's recommendation is skipped, "" if it is usable. It returns true if the reason changed.
+func (t *RecommendationTracker) setSkipReason(key, reason string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tracked := t.recommendations[key]
+	if tracked.skipReason == reason {
+		return false
+	}
+	tracked.skipReason = reason
+	t.recommendations[key] = tracked
+	return true
+}
+
+// Forget a VPA that no longer exists
+func (t *RecommendationTracker) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.recommendations, key)
+}
+
+// Get a condition of the VPA's status, or nil if the recommender did not set it
+func vpaCondition(vpa v1.VerticalPodAutoscaler, conditionType v1.VerticalPodAutoscalerConditionType) *v1.VerticalPodAutoscalerCondition {
+	for i := range vpa.Status.Conditions {
+		if vpa.Status.Conditions[i].Type == conditionType {
+			return &vpa.Status.Conditions[i]
+		}
+	}
+	return nil
+}
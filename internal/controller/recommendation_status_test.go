@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestRecommendationSkipReason(t *testing.T) {
+	now := time.Now()
+	recommendation := testutil.WithRecommendation(testutil.WithTargetCPU(resource.MustParse("100m")))
+
+	tests := []struct {
+		name         string
+		options      []testutil.VPAOption
+		maxAge       time.Duration
+		seenAgo      time.Duration
+		expectReason string
+	}{
+		{
+			name:         "Recommendation without conditions is usable",
+			options:      []testutil.VPAOption{recommendation},
+			expectReason: "",
+		},
+		{
+			name:         "Provided recommendation is usable",
+			options:      []testutil.VPAOption{recommendation, testutil.WithCondition(v1.RecommendationProvided, corev1.ConditionTrue, now.Add(-time.Hour))},
+			maxAge:       2 * time.Hour,
+			seenAgo:      time.Hour,
+			expectReason: "",
+		},
+		{
+			name:         "Missing recommendation is skipped",
+			expectReason: metrics.RecommendationSkipReasonNotProvided,
+		},
+		{
+			name:         "Recommendation that is not provided anymore is skipped",
+			options:      []testutil.VPAOption{recommendation, testutil.WithCondition(v1.RecommendationProvided, corev1.ConditionFalse, now)},
+			expectReason: metrics.RecommendationSkipReasonNotProvided,
+		},
+		{
+			name:         "Low confidence recommendation is skipped",
+			options:      []testutil.VPAOption{recommendation, testutil.WithCondition(v1.LowConfidence, corev1.ConditionTrue, now)},
+			expectReason: metrics.RecommendationSkipReasonLowConfidence,
+		},
+		{
+			name:         "VPA matching no pods is skipped",
+			options:      []testutil.VPAOption{recommendation, testutil.WithCondition(v1.NoPodsMatched, corev1.ConditionTrue, now)},
+			expectReason: metrics.RecommendationSkipReasonNoPodsMatched,
+		},
+		{
+			name:         "Unsupported VPA configuration is skipped",
+			options:      []testutil.VPAOption{recommendation, testutil.WithCondition(v1.ConfigUnsupported, corev1.ConditionTrue, now)},
+			expectReason: metrics.RecommendationSkipReasonConfigUnsupported,
+		},
+		{
+			name:         "Conditions that are not true are ignored",
+			options:      []testutil.VPAOption{recommendation, testutil.WithCondition(v1.LowConfidence, corev1.ConditionFalse, now)},
+			expectReason: "",
+		},
+		{
+			name: "Recommendation that changed recently is usable, whatever its conditions' transition times",
+			options: []testutil.VPAOption{recommendation,
+				testutil.WithCondition(v1.RecommendationProvided, corev1.ConditionTrue, now.Add(-3*time.Hour)),
+				testutil.WithCondition(v1.LowConfidence, corev1.ConditionFalse, now.Add(-4*time.Hour)),
+			},
+			maxAge:       2 * time.Hour,
+			seenAgo:      time.Minute,
+			expectReason: "",
+		},
+		{
+			name:         "Recommendation that has not changed for longer than the maximum age is skipped",
+			options:      []testutil.VPAOption{recommendation, testutil.WithCondition(v1.RecommendationProvided, corev1.ConditionTrue, now.Add(-3*time.Hour))},
+			maxAge:       2 * time.Hour,
+			seenAgo:      3 * time.Hour,
+			expectReason: metrics.RecommendationSkipReasonStale,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason, _, _ := recommendationSkipReason(testutil.CreateTestVPA(tt.options...), tt.maxAge, now.Add(-tt.seenAgo), now); reason != tt.expectReason {
+				t.Errorf("expected reason %q, got: %q", tt.expectReason, reason)
+			}
+		})
+	}
+}
+
+func TestRecommendationIsUsable(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	vpa := testutil.CreateTestVPA(
+		testutil.WithRecommendation(testutil.WithTargetCPU(resource.MustParse("100m"))),
+		testutil.WithCondition(v1.RecommendationProvided, corev1.ConditionTrue, time.Now().Add(-3*time.Hour)),
+	)
+	key := vpa.Namespace + "/" + vpa.Name
+	recommendations := NewRecommendationTracker()
+
+	recorder := record.NewFakeRecorder(10)
+	usable, err := RecommendationIsUsable(ctx, recorder, recommendations, vpa, workload, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !usable || len(recorder.Events) != 0 {
+		t.Errorf("expected the recommendation to be usable without a maximum age")
+	}
+
+	vpa.Annotations[utils.VPAAnnotationRecommendationMaxAge] = "2h"
+	usable, err = RecommendationIsUsable(ctx, recorder, recommendations, vpa, workload, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !usable {
+		t.Errorf("expected a recommendation first seen just now to be usable, whatever its conditions' transition times")
+	}
+
+	// The recommendation has not changed for 3 hours
+	tracked := recommendations.recommendations[key]
+	tracked.seenAt = time.Now().Add(-3 * time.Hour)
+	recommendations.recommendations[key] = tracked
+	usable, err = RecommendationIsUsable(ctx, recorder, recommendations, vpa, workload, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if usable {
+		t.Errorf("expected the recommendation to be stale with the annotation's maximum age")
+	}
+	// One event on the VPA and one on the workload
+	if len(recorder.Events) != 2 {
+		t.Fatalf("expected 2 events, got: %d", len(recorder.Events))
+	}
+	for i := 0; i < 2; i++ {
+		if event := <-recorder.Events; !strings.Contains(event, corev1.EventTypeWarning+" "+EventReasonRecommendationSkipped) || !strings.Contains(event, "maximum age of 2h0m0s") {
+			t.Errorf("expected a %s Warning event, got: %s", EventReasonRecommendationSkipped, event)
+		}
+	}
+
+	// Skipping it again for the same reason is not reported again
+	usable, err = RecommendationIsUsable(ctx, recorder, recommendations, vpa, workload, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if usable || len(recorder.Events) != 0 {
+		t.Errorf("expected the stale recommendation to be skipped without another event, got %d events", len(recorder.Events))
+	}
+
+	// A refreshed recommendation is usable again
+	vpa.Status.Recommendation.ContainerRecommendations[0].Target[corev1.ResourceCPU] = resource.MustParse("200m")
+	usable, err = RecommendationIsUsable(ctx, recorder, recommendations, vpa, workload, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !usable {
+		t.Errorf("expected the refreshed recommendation to be usable")
+	}
+
+	vpa.Annotations[utils.VPAAnnotationRecommendationMaxAge] = "two hours"
+	if _, err := RecommendationIsUsable(ctx, record.NewFakeRecorder(10), recommendations, vpa, workload, 0); err == nil {
+		t.Errorf("expected an error for an invalid maximum age")
+	}
+}
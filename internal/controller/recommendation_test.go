@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	vpa_api_util "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/vpa"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func createTestLimitRange(namespace string, limitType corev1.LimitType, max, defaultLimits corev1.ResourceList) *corev1.LimitRange {
+	return &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{Name: "limits", Namespace: namespace},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{{Type: limitType, Max: max, Default: defaultLimits}},
+		},
+	}
+}
+
+func createTestRecommendationPod(requests, limits corev1.ResourceList) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-0", Namespace: "default", Labels: map[string]string{"app": "myapp"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "container-0", Resources: corev1.ResourceRequirements{Requests: requests, Limits: limits}}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestEffectiveRecommendation(t *testing.T) {
+	vpa := testutil.CreateTestVPA(
+		testutil.WithStatus(
+			testutil.WithRecommendation(
+				testutil.WithTargetCPU(resource.MustParse("2")),
+				testutil.WithTargetMemory(resource.MustParse("2Gi")),
+			),
+		),
+	)
+	requests := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m"), corev1.ResourceMemory: resource.MustParse("512Mi")}
+	limits := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), corev1.ResourceMemory: resource.MustParse("512Mi")}
+	maxAllowedMemory := v1.PodResourcePolicy{ContainerPolicies: []v1.ContainerResourcePolicy{{
+		ContainerName: "*",
+		MaxAllowed:    corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+	}}}
+
+	tests := []struct {
+		name         string
+		limitRanges  limitrange.LimitRangeCalculator
+		policy       *v1.PodResourcePolicy
+		expectCPU    string
+		expectMemory string
+	}{
+		{
+			name:         "Recommendation is kept without LimitRanges nor policy",
+			limitRanges:  limitrange.NewNoopLimitsCalculator(),
+			expectCPU:    "2",
+			expectMemory: "2Gi",
+		},
+		{
+			name:         "Container LimitRange max caps the requests to keep the limit to request ratio",
+			limitRanges:  testutil.CreateTestLimitRangeCalculator(createTestLimitRange("default", corev1.LimitTypeContainer, corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}, nil)),
+			expectCPU:    "1",
+			expectMemory: "2Gi",
+		},
+		{
+			name:         "LimitRanges of other namespaces are ignored",
+			limitRanges:  testutil.CreateTestLimitRangeCalculator(createTestLimitRange("other", corev1.LimitTypeContainer, corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}, nil)),
+			expectCPU:    "2",
+			expectMemory: "2Gi",
+		},
+		{
+			name:         "Pod LimitRange max caps the containers proportionally",
+			limitRanges:  testutil.CreateTestLimitRangeCalculator(createTestLimitRange("default", corev1.LimitTypePod, corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}, nil)),
+			expectCPU:    "2",
+			expectMemory: "1Gi",
+		},
+		{
+			name:         "Policy maxAllowed caps the recommendation",
+			limitRanges:  limitrange.NewNoopLimitsCalculator(),
+			policy:       &maxAllowedMemory,
+			expectCPU:    "2",
+			expectMemory: "1Gi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vpa := *vpa.DeepCopy()
+			vpa.Spec.ResourcePolicy = tt.policy
+			recommendation, err := EffectiveRecommendation(vpa, createTestRecommendationPod(requests, limits), tt.limitRanges)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			containerRecommendation := vpa_api_util.GetRecommendationForContainer("container-0", recommendation)
+			if containerRecommendation == nil {
+				t.Fatalf("expected a recommendation for container-0, got: %v", recommendation)
+			}
+			if cpu := containerRecommendation.Target.Cpu(); cpu.Cmp(resource.MustParse(tt.expectCPU)) != 0 {
+				t.Errorf("expected CPU target %s, got: %s", tt.expectCPU, cpu.String())
+			}
+			if memory := containerRecommendation.Target.Memory(); memory.Cmp(resource.MustParse(tt.expectMemory)) != 0 {
+				t.Errorf("expected memory target %s, got: %s", tt.expectMemory, memory.String())
+			}
+		})
+	}
+
+	t.Run("No recommendation", func(t *testing.T) {
+		recommendation, err := EffectiveRecommendation(testutil.CreateTestVPA(), createTestRecommendationPod(requests, limits), limitrange.NewNoopLimitsCalculator())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if recommendation != nil {
+			t.Errorf("expected no recommendation, got: %v", recommendation)
+		}
+	})
+}
+
+func TestRolloutIsNeededWithEffectiveRecommendation(t *testing.T) {
+	ctx := context.Background()
+	vpa := testutil.CreateTestVPA(
+		testutil.WithStatus(
+			testutil.WithRecommendation(
+				testutil.WithTargetCPU(resource.MustParse("2")),
+				testutil.WithTargetMemory(resource.MustParse("512Mi")),
+			),
+		),
+	)
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	// The pod already runs with the highest requests the LimitRange allows
+	pod := createTestRecommendationPod(
+		corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), corev1.ResourceMemory: resource.MustParse("512Mi")},
+		corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), corev1.ResourceMemory: resource.MustParse("512Mi")},
+	)
+	podLister := testutil.CreateTestPodLister(pod)
+
+	rolloutIsNeeded, _, _, err := RolloutIsNeeded(ctx, podLister, nil, limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), vpa, workload, percentTriggerThresholds(10), StabilizationConfig{}, NewDryRunDriftHistories(), 0, "", false, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !rolloutIsNeeded {
+		t.Errorf("expected a rollout to be needed against the raw recommendation")
+	}
+
+	limitRanges := testutil.CreateTestLimitRangeCalculator(createTestLimitRange("default", corev1.LimitTypeContainer, corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}, nil))
+	rolloutIsNeeded, _, _, err = RolloutIsNeeded(ctx, podLister, nil, limitRanges, record.NewFakeRecorder(10), vpa, workload, percentTriggerThresholds(10), StabilizationConfig{}, NewDryRunDriftHistories(), 0, "", false, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rolloutIsNeeded {
+		t.Errorf("expected no rollout to be needed against the capped recommendation")
+	}
+}
+
+func TestPodFromWorkloadTemplate(t *testing.T) {
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	workload["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "myapp"}},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{
+					"name":      "container-0",
+					"resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": "100m"}},
+				},
+			},
+		},
+	}
+
+	pod, err := podFromWorkloadTemplate(workload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pod.Namespace != "default" {
+		t.Errorf("expected namespace default, got: %s", pod.Namespace)
+	}
+	if len(pod.Spec.Containers) != 1 || pod.Spec.Containers[0].Resources.Requests.Cpu().String() != "100m" {
+		t.Errorf("expected container-0 with a 100m CPU request, got: %v", pod.Spec.Containers)
+	}
+
+	delete(workload["spec"].(map[string]interface{}), "template")
+	if _, err := podFromWorkloadTemplate(workload); err == nil {
+		t.Errorf("expected an error for a workload without a pod template")
+	}
+}
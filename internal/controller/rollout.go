@@ -2,109 +2,162 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math"
-	"strconv"
 	"time"
 
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
 	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
 
-	"k8s.io/apimachinery/pkg/api/resource"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	vpa_api_util "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/vpa"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
-// Check if a rollout is needed based on the VPA recommendation and the workload's pods' current resource requests
-func RolloutIsNeeded(ctx context.Context, clientset kubernetes.Interface, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, diffPercentTrigger int) (bool, error) {
+// Returned when a Deployment's rollout exceeded its 'progressDeadlineSeconds'
+var errRolloutProgressDeadlineExceeded = errors.New("rollout exceeded its progress deadline")
+
+// Check if the error means that the workload's rollout stopped progressing and will not complete on its own
+func rolloutProgressDeadlineExceeded(err error) bool {
+	return errors.Is(err, errRolloutProgressDeadlineExceeded)
+}
+
+// Tolerance when comparing the workload's restart time to the time the VPA's rollout status was set, which are set a few moments apart
+const rolloutRestartTolerance = time.Minute
+
+// Check if a rollout is needed based on the effective VPA recommendation and the workload's pods' current resource requests.
+// Every container of the recommendation is evaluated, unless excluded by the VPA's annotations, and the drift of each of them is returned.
+// With a stabilization window, a rollout is only needed once the same drift has been observed for long enough, see driftIsStable.
+// While it waits for the window, it returns the time remaining until the drift can be stable. In dry-run, the drift histories are kept in dryRunHistories.
+// A rollout that would decrease the memory of a container OOM killed within the OOM window is blocked.
+// With oomOnly, during the cooldown period, only a memory increase of the recently OOM killed containers can need a rollout:
+// any other drift is left for the evaluation after the cooldown, without recording it or advancing its stabilization.
+func RolloutIsNeeded(ctx context.Context, podLister corelisters.PodLister, dynamicClient dynamic.Interface, limitRanges limitrange.LimitRangeCalculator, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, thresholds TriggerThresholds, stabilization StabilizationConfig, dryRunHistories *DryRunDriftHistories, oomWindow time.Duration, patchOperationFieldManager string, oomOnly bool, dryRun bool) (bool, []ContainerDiff, time.Duration, error) {
 
 	log := slog.Default()
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
 	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
 
-	rolloutNeeded := false
-
 	// Ensure the workload's pods are healthy before proceeding
-	healthy, err := workloadPodsAreHealthy(ctx, workload, clientset)
+	healthy, err := workloadPodsAreHealthy(ctx, workload, podLister, oomWindow)
 	if err != nil {
 		log.Error("Error checking workload pods health", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-		return false, err
+		return false, nil, 0, err
 	}
 	if !healthy {
 		log.Info("Workload pods are not healthy, skipping rollout", "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-		return false, nil
+		return false, nil, 0, nil
+	}
+
+	// Get the containers to evaluate and their thresholds, which the VPA annotations can override
+	driftPolicy, err := getContainerDriftPolicy(recorder, vpa, thresholds)
+	if err != nil {
+		log.Error("Error parsing the container drift annotations of the VPA", "err", err, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
+		return false, nil, 0, err
+	}
+	stabilization, err = getStabilizationConfig(recorder, vpa, stabilization)
+	if err != nil {
+		return false, nil, 0, err
 	}
 
-	// Override the diffPercentTrigger if the VPA annotation is specified
-	var effectiveDiffPercentTrigger int
-	if vpa.Annotations != nil && vpa.Annotations[utils.VPAAnnotationDiffPercentTrigger] != "" {
-		overridenDiffPercentTrigger, err := strconv.Atoi(vpa.Annotations[utils.VPAAnnotationDiffPercentTrigger])
+	if vpa.Status.Recommendation == nil || len(vpa.Status.Recommendation.ContainerRecommendations) == 0 {
+		log.Debug("No recommendation for VPA", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name)
+		return false, nil, 0, nil
+	}
+
+	// List the workload's pods once, and get the target CPU and Memory requests the VPA admission controller would apply to each of them.
+	// The init containers in the VPA's scope, e.g. native sidecars, are evaluated like the regular containers.
+	podList, err := getTargetWorkloadPods(ctx, workload, podLister)
+	if err != nil {
+		log.Error("Error getting pods for workload", "error", err.Error(), "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+		return false, nil, 0, err
+	}
+	pods := make([]corev1.Pod, len(podList.Items))
+	effectiveRecommendations := make([]*v1.RecommendedPodResources, len(podList.Items))
+	for i := range podList.Items {
+		pods[i] = *podWithInitContainers(&podList.Items[i], driftPolicy.initContainers)
+		effectiveRecommendations[i], err = EffectiveRecommendation(vpa, &pods[i], limitRanges)
 		if err != nil {
-			log.Error("Error parsing diffPercentTrigger from VPA annotation", "err", err, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
-			return false, err
+			log.Error("Error computing the effective VPA recommendation", "err", err, "vpaName", vpa.Name, "vpaNamespace", vpa.Namespace, "podName", pods[i].Name)
+			return false, nil, 0, err
 		}
-		effectiveDiffPercentTrigger = overridenDiffPercentTrigger
+	}
 
-	} else {
-		effectiveDiffPercentTrigger = diffPercentTrigger
-	}
-
-	if vpa.Status.Recommendation != nil && vpa.Status.Recommendation.ContainerRecommendations != nil {
-		for _, recommendation := range vpa.Status.Recommendation.ContainerRecommendations {
-			if recommendation.Target != nil {
-				log.Debug("Processing VPA Recommendation", "ContainerName", recommendation.ContainerName, "ContainerTargetCPU", recommendation.Target.Cpu(), "ContainerTargetMemory", recommendation.Target.Memory())
-				if recommendation.Target.Cpu() != nil && recommendation.Target.Memory() != nil {
-
-					// Get the current CPU and Memory request from the target workload
-					podList, err := getTargetWorkloadPods(ctx, workload, clientset)
-					if err != nil {
-						log.Error("Error getting pods for workload", "error", err.Error(), "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-						return false, err
-					}
-					// Check if any of the workload's pods need a rollout based on the VPA recommendation
-
-					for _, pod := range podList.Items {
-						var containerCPU, containerMemory *resource.Quantity
-						for _, container := range pod.Spec.Containers {
-							if container.Name == recommendation.ContainerName {
-								containerResources := container.Resources
-								containerCPU = containerResources.Requests.Cpu()
-								containerMemory = containerResources.Requests.Memory()
-								log.Debug("Container Spec values", "vpaName", vpa.Name, "vpaNamespace", vpa.Namespace, "podName", pod.Name, "ContainerName", container.Name, "ContainerCPURequests", containerCPU.String(), "ContainerMemoryRequests", containerMemory.String())
-							}
-						}
-
-						// Get the target CPU and Memory request from the VPA recommendation
-						vpaTargetCpuQuantity, _ := resource.ParseQuantity(recommendation.Target.Cpu().String())
-						vpaTargetMemoryQuantity, _ := resource.ParseQuantity(recommendation.Target.Memory().String())
-						log.Debug("VPA Status values", "VpaTargetCpuQuantity", vpaTargetCpuQuantity.String(), "VpaTargetMemoryQuantity", vpaTargetMemoryQuantity.String())
-						// Calculate the difference between current and target CPU and Memory requests
-						cpuDiff := math.Abs(containerCPU.AsApproximateFloat64() - vpaTargetCpuQuantity.AsApproximateFloat64())
-						cpuDiffPercent := cpuDiff / vpaTargetCpuQuantity.AsApproximateFloat64() * 100
-						memoryDiff := math.Abs(containerMemory.AsApproximateFloat64() - vpaTargetMemoryQuantity.AsApproximateFloat64())
-						memoryDiffPercent := memoryDiff / vpaTargetMemoryQuantity.AsApproximateFloat64() * 100
-						log.Debug("Calculated diff between VPA Resource Target and Workload Resources", "CPUDiff", cpuDiff, "CPUDiffPercent", cpuDiffPercent, "MemoryDiff", memoryDiff, "MemoryDiffPercent", memoryDiffPercent)
-
-						// If difference between current and target CPU or Memory is greater than the threshold, trigger a rollout
-						if cpuDiffPercent > float64(effectiveDiffPercentTrigger) || memoryDiffPercent > float64(effectiveDiffPercentTrigger) {
-							log.Info("Rollout needed for VPA Target Workload", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name, "cpuDiffPercent", cpuDiffPercent, "memoryDiffPercent", memoryDiffPercent, "diffPercentTrigger", effectiveDiffPercentTrigger)
-							rolloutNeeded = true
-							break
-						}
-					}
-					return rolloutNeeded, nil
-				}
-			}
+	oomKills := recentOOMKills(podList.Items, oomWindow, time.Now())
+
+	rolloutNeeded := false
+	var containerDiffs []ContainerDiff
+	for _, recommendation := range vpa.Status.Recommendation.ContainerRecommendations {
+		if !driftPolicy.evaluates(recommendation.ContainerName) {
+			log.Debug("Skipping container excluded by the VPA annotations", "vpaName", vpa.Name, "vpaNamespace", vpa.Namespace, "ContainerName", recommendation.ContainerName)
+			continue
 		}
-	} else {
-		log.Debug("No recommendation for VPA", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name)
-		return rolloutNeeded, nil
+		// The admission controller leaves the containers whose scaling mode is 'Off' unchanged, so a rollout would not change them either
+		containerPolicy := vpa_api_util.GetContainerResourcePolicy(recommendation.ContainerName, vpa.Spec.ResourcePolicy)
+		if containerPolicy != nil && containerPolicy.Mode != nil && *containerPolicy.Mode == v1.ContainerScalingModeOff {
+			log.Debug("Skipping container whose VPA scaling mode is Off", "vpaName", vpa.Name, "vpaNamespace", vpa.Namespace, "ContainerName", recommendation.ContainerName)
+			continue
+		}
+
+		containerDiff, found := computeContainerDiff(recommendation, pods, effectiveRecommendations, driftPolicy.mode, driftPolicy.containerThresholds(recommendation.ContainerName))
+		if !found {
+			log.Debug("No pod of the workload runs the recommended container", "vpaName", vpa.Name, "vpaNamespace", vpa.Namespace, "ContainerName", recommendation.ContainerName)
+			continue
+		}
+		containerDiff.OOMKills = oomKills[containerDiff.ContainerName]
+		log.Debug("Calculated diff between VPA Resource Target and Workload Resources", "ContainerName", containerDiff.ContainerName, "PodName", containerDiff.PodName, "CPUDiffPercent", containerDiff.CPUDiffPercent, "MemoryDiffPercent", containerDiff.MemoryDiffPercent, "CPUOutsideBounds", containerDiff.CPUOutsideBounds, "MemoryOutsideBounds", containerDiff.MemoryOutsideBounds, "TriggerMode", containerDiff.TriggerMode, "TriggeredRule", containerDiff.TriggeredRule, "OOMKilledPods", containerDiff.OOMKills.Pods)
+		metrics.ResourceDiffPercent.WithLabelValues(vpa.Namespace, vpa.Name, containerDiff.ContainerName, "cpu").Set(containerDiff.CPUDiffPercent)
+		metrics.ResourceDiffPercent.WithLabelValues(vpa.Namespace, vpa.Name, containerDiff.ContainerName, "memory").Set(containerDiff.MemoryDiffPercent)
+		metrics.ResourceOutsideBounds.WithLabelValues(vpa.Namespace, vpa.Name, containerDiff.ContainerName, "cpu").Set(boolToFloat64(containerDiff.CPUOutsideBounds))
+		metrics.ResourceOutsideBounds.WithLabelValues(vpa.Namespace, vpa.Name, containerDiff.ContainerName, "memory").Set(boolToFloat64(containerDiff.MemoryOutsideBounds))
+		metrics.RecentOOMKills.WithLabelValues(vpa.Namespace, vpa.Name, containerDiff.ContainerName).Set(float64(containerDiff.OOMKills.Pods))
+		containerDiffs = append(containerDiffs, containerDiff)
+
+		// If difference between current and target CPU or Memory exceeds the thresholds of one of the rules, trigger a rollout
+		if containerDiff.RolloutNeeded {
+			log.Info("Rollout needed for VPA Target Workload container", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name, "ContainerName", containerDiff.ContainerName, "cpuDiffPercent", containerDiff.CPUDiffPercent, "memoryDiffPercent", containerDiff.MemoryDiffPercent, "triggerMode", containerDiff.TriggerMode, "triggeredRule", containerDiff.describeTriggeredRule())
+			rolloutNeeded = true
+		}
+	}
+
+	if oomOnly && len(memoryIncreasesAfterOOMKills(containerDiffs)) == 0 {
+		log.Info("No memory increase of the recently OOM killed containers, waiting for the cooldown period", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name, "RolloutNeeded", rolloutNeeded)
+		return false, containerDiffs, 0, nil
 	}
-	return rolloutNeeded, fmt.Errorf("error verifying if rollout is needed for VPA %s", vpa.Name)
+	for _, containerDiff := range containerDiffs {
+		if containerDiff.RolloutNeeded {
+			metrics.RolloutTriggerRules.WithLabelValues(vpa.Namespace, containerDiff.TriggerMode, containerDiff.TriggeredRule).Inc()
+		}
+	}
+
+	// Wait for the drift to be stable, so that a short spike of the recommendation does not restart the workload
+	if !rolloutNeeded {
+		return false, containerDiffs, 0, resetDriftHistory(ctx, dynamicClient, recorder, vpa, dryRunHistories, patchOperationFieldManager, dryRun)
+	}
+	// Lowering the memory of containers that were just OOM killed would make them OOM again, so wait for the OOM window to pass
+	if decreases := memoryDecreasesAfterOOMKills(containerDiffs); len(decreases) > 0 {
+		log.Info("Rollout needed, but blocked by memory decreases of recently OOM killed containers", "Name", vpa.Name, "Namespace", vpa.Namespace, "WorkloadKind", vpa.Spec.TargetRef.Kind, "WorkloadName", vpa.Spec.TargetRef.Name, "OOMWindow", oomWindow, "MemoryDecreases", formatOOMKilledMemoryChanges(decreases))
+		metrics.OOMDecisions.WithLabelValues(vpa.Namespace, metrics.OOMDecisionMemoryDecreaseBlocked).Inc()
+		recordEvent(recorder, vpa, workload, corev1.EventTypeWarning, EventReasonMemoryDecreaseBlocked, "Rollout blocked, it would decrease the memory of containers OOM killed within the last %s: %s", oomWindow, formatOOMKilledMemoryChanges(decreases))
+		return false, containerDiffs, 0, nil
+	}
+	if stabilization.enabled() {
+		stable, stabilizationRemaining, err := driftIsStable(ctx, dynamicClient, recorder, vpa, workload, containerDiffs, stabilization, dryRunHistories, patchOperationFieldManager, dryRun)
+		if err != nil || !stable {
+			return false, containerDiffs, stabilizationRemaining, err
+		}
+	}
+	recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonRolloutNeeded, "Rollout needed: %s", formatContainerDiffs(containerDiffs))
+	return true, containerDiffs, 0, nil
 }
 
 // Get the current rollout status of the VPA from its annotation
@@ -115,11 +168,30 @@ func GetRolloutStatus(ctx context.Context, vpa v1.VerticalPodAutoscaler) string
 	return vpa.Annotations[utils.VPAAnnotationRolloutStatus]
 }
 
-// Set the VPA annotation that reflects the latest status of a rollout
-func SetRolloutStatus(ctx context.Context, vpa v1.VerticalPodAutoscaler, dynamicClient dynamic.Interface, patchOperationFieldManager string, status string) error {
+// Get the time at which the VPA's rollout status was last set, from its annotation
+func GetRolloutStatusUpdatedAt(ctx context.Context, vpa v1.VerticalPodAutoscaler) (time.Time, bool) {
+	if vpa.Annotations == nil || vpa.Annotations[utils.VPAAnnotationRolloutStatusUpdatedAt] == "" {
+		return time.Time{}, false
+	}
+	updatedAt, err := time.Parse(time.RFC3339, vpa.Annotations[utils.VPAAnnotationRolloutStatusUpdatedAt])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return updatedAt, true
+}
+
+// Set the VPA annotations that reflect the latest status of a rollout and when it was set
+// In dry-run, the status change is only logged and recorded as an Event.
+func SetRolloutStatus(ctx context.Context, vpa v1.VerticalPodAutoscaler, dynamicClient dynamic.Interface, recorder record.EventRecorder, patchOperationFieldManager string, status string, dryRun bool) error {
 	log := slog.Default()
 
-	patchData := fmt.Sprintf(`{"metadata":{"annotations":{"%s":"%s"}}}`, utils.VPAAnnotationRolloutStatus, status)
+	if dryRun {
+		log.Info("Dry run: would set rollout status for workload", "VPA", vpa.Name, "VPA Namespace", vpa.Namespace, "CurrentStatus", GetRolloutStatus(ctx, vpa), "Status", status)
+		recordEvent(recorder, vpa, nil, corev1.EventTypeNormal, EventReasonDryRun, "Dry run: would set the rollout status from '%s' to '%s'", GetRolloutStatus(ctx, vpa), status)
+		return nil
+	}
+
+	patchData := fmt.Sprintf(`{"metadata":{"annotations":{"%s":"%s","%s":"%s"}}}`, utils.VPAAnnotationRolloutStatus, status, utils.VPAAnnotationRolloutStatusUpdatedAt, time.Now().UTC().Format(time.RFC3339))
 	gvr := schema.GroupVersionResource{
 		Group:    "autoscaling.k8s.io",
 		Version:  "v1",
@@ -128,6 +200,8 @@ func SetRolloutStatus(ctx context.Context, vpa v1.VerticalPodAutoscaler, dynamic
 	_, err := dynamicClient.Resource(gvr).Namespace(vpa.Namespace).Patch(ctx, vpa.Name, types.MergePatchType, []byte(patchData), metav1.PatchOptions{FieldManager: patchOperationFieldManager})
 	if err != nil {
 		log.Error("Error setting rollout status for workload", "err", err, "vpaName", vpa.Name, "vpaNamespace", vpa.Namespace, "status", status)
+		metrics.APIErrors.WithLabelValues(metrics.OperationPatchVPA).Inc()
+		recordAPIErrorEvent(recorder, vpa, nil, fmt.Sprintf("setting the rollout status to '%s'", status), err)
 		return fmt.Errorf("error setting rollout status to '%s' for workload %s: %v", status, vpa.Name, err)
 	}
 
@@ -136,55 +210,185 @@ func SetRolloutStatus(ctx context.Context, vpa v1.VerticalPodAutoscaler, dynamic
 	return nil
 }
 
-// Check if the workload pods are ready and restarted since the last rollout
-func RolloutIsCompleted(ctx context.Context, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, clientset kubernetes.Interface) (bool, error) {
+// Check if the rollout of the workload is completed.
+// Deployments and StatefulSets are checked from their status, like 'kubectl rollout status' does, and other kinds from their pods.
+func RolloutIsCompleted(ctx context.Context, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, podLister corelisters.PodLister) (bool, error) {
 	log := slog.Default()
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
 	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
 
-	// Check if the workload's pods are healthy
-	healthy, err := workloadPodsAreHealthy(ctx, workload, clientset)
+	restartedAt, found, err := workloadRestartedAt(workload)
 	if err != nil {
-		log.Error("Error checking workload pods health", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+		log.Error("Error parsing last rollout time from workload template annotations", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 		return false, err
 	}
-	if !healthy {
-		log.Info("Workload pods are not healthy, rollout is not complete", "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+	if !found {
+		log.Info("No last rollout time found in workload template annotations, assuming rollout is not complete", "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+		return false, nil
+	}
+	// The workload comes from the informer cache, which may not have caught up with the restart yet.
+	// Its status would then describe the previous rollout.
+	if rolloutStatusUpdatedAt, ok := GetRolloutStatusUpdatedAt(ctx, vpa); ok && restartedAt.Before(rolloutStatusUpdatedAt.Add(-rolloutRestartTolerance)) {
+		log.Info("Workload has not been restarted since the rollout was triggered yet, rollout is not complete", "restartedAt", restartedAt, "rolloutStatusUpdatedAt", rolloutStatusUpdatedAt, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 		return false, nil
 	}
 
-	// Check if the pods' age is less than the time since the last rollout
-	podList, err := getTargetWorkloadPods(ctx, workload, clientset)
+	var completed bool
+	var reason string
+	apiVersion, _ := workload["apiVersion"].(string)
+	switch {
+	case apiVersion == "apps/v1" && workload["kind"] == "Deployment":
+		completed, reason, err = deploymentRolloutIsCompleted(workload)
+	case apiVersion == "apps/v1" && workload["kind"] == "StatefulSet":
+		completed, reason, err = statefulSetRolloutIsCompleted(workload)
+	default:
+		completed, reason, err = podsRolloutIsCompleted(ctx, workload, podLister, restartedAt)
+	}
 	if err != nil {
-		log.Error("Error getting pods for workload", "error", err.Error(), "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+		log.Error("Error checking if rollout is completed", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 		return false, err
 	}
-	for _, pod := range podList.Items {
-		var lastRolloutTimeStr string
-		if templateAnnotations, ok := workload["spec"].(map[string]interface{})["template"].(map[string]interface{})["metadata"].(map[string]interface{})["annotations"].(map[string]interface{}); ok {
-			if restartedAt, ok := templateAnnotations["kubectl.kubernetes.io/restartedAt"]; ok && restartedAt != nil {
-				lastRolloutTimeStr, _ = restartedAt.(string)
-			}
+	if !completed {
+		log.Info("Rollout is still in progress for VPA", "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace, "reason", reason)
+		return false, nil
+	}
+
+	log.Info("Rollout is completed for VPA", "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+	return true, nil
+}
+
+// Check the rollout of a Deployment from its status.
+// The available replicas only count pods that have been ready for 'minReadySeconds'.
+func deploymentRolloutIsCompleted(workload map[string]interface{}) (bool, string, error) {
+	generation, _, _ := unstructured.NestedInt64(workload, "metadata", "generation")
+	observedGeneration, _, _ := unstructured.NestedInt64(workload, "status", "observedGeneration")
+	if observedGeneration < generation {
+		return false, fmt.Sprintf("waiting for the Deployment spec update to be observed, generation %d, observed generation %d", generation, observedGeneration), nil
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(workload, "status", "conditions")
+	for _, condition := range conditions {
+		condition, ok := condition.(map[string]interface{})
+		if !ok || condition["type"] != "Progressing" {
+			continue
 		}
-		if lastRolloutTimeStr == "" {
-			log.Info("No last rollout time found in workload template annotations, assuming rollout is not complete", "podName", pod.Name, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-			return false, nil
+		if condition["reason"] == "ProgressDeadlineExceeded" {
+			return false, "", fmt.Errorf("error checking the rollout of Deployment %s: %w", workload["metadata"].(map[string]interface{})["name"], errRolloutProgressDeadlineExceeded)
 		}
-		lastRolloutTime, err := time.Parse(time.RFC3339, lastRolloutTimeStr)
-		if err != nil {
-			log.Error("Error parsing last rollout time from pod annotations", "err", err, "podName", pod.Name, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-			return false, err
+		if condition["status"] != "True" || condition["reason"] != "NewReplicaSetAvailable" {
+			return false, fmt.Sprintf("waiting for the Deployment's new ReplicaSet to be available, Progressing condition reason is %v", condition["reason"]), nil
+		}
+	}
+
+	replicas := workloadReplicas(workload)
+	updatedReplicas, _, _ := unstructured.NestedInt64(workload, "status", "updatedReplicas")
+	statusReplicas, _, _ := unstructured.NestedInt64(workload, "status", "replicas")
+	availableReplicas, _, _ := unstructured.NestedInt64(workload, "status", "availableReplicas")
+	if updatedReplicas < replicas {
+		return false, fmt.Sprintf("%d out of %d new replicas have been updated", updatedReplicas, replicas), nil
+	}
+	if statusReplicas > updatedReplicas {
+		return false, fmt.Sprintf("%d old replicas are pending termination", statusReplicas-updatedReplicas), nil
+	}
+	if availableReplicas < updatedReplicas {
+		return false, fmt.Sprintf("%d of %d updated replicas are available", availableReplicas, updatedReplicas), nil
+	}
+	return true, "", nil
+}
+
+// Check the rollout of a StatefulSet from its status.
+// The available replicas only count pods that have been ready for 'minReadySeconds'.
+func statefulSetRolloutIsCompleted(workload map[string]interface{}) (bool, string, error) {
+	generation, _, _ := unstructured.NestedInt64(workload, "metadata", "generation")
+	observedGeneration, _, _ := unstructured.NestedInt64(workload, "status", "observedGeneration")
+	if observedGeneration < generation {
+		return false, fmt.Sprintf("waiting for the StatefulSet spec update to be observed, generation %d, observed generation %d", generation, observedGeneration), nil
+	}
+
+	replicas := workloadReplicas(workload)
+	updatedReplicas, _, _ := unstructured.NestedInt64(workload, "status", "updatedReplicas")
+	availableReplicas, _, _ := unstructured.NestedInt64(workload, "status", "availableReplicas")
+	// With a partition, only the pods with an ordinal greater or equal to it are updated, and the current revision never catches up
+	partition, found, _ := unstructured.NestedInt64(workload, "spec", "updateStrategy", "rollingUpdate", "partition")
+	if found && partition > 0 {
+		if updatedReplicas < replicas-partition {
+			return false, fmt.Sprintf("%d out of %d new pods have been updated", updatedReplicas, replicas-partition), nil
+		}
+	} else {
+		currentRevision, _, _ := unstructured.NestedString(workload, "status", "currentRevision")
+		updateRevision, _, _ := unstructured.NestedString(workload, "status", "updateRevision")
+		if currentRevision != updateRevision {
+			return false, fmt.Sprintf("%d out of %d new pods have been updated to revision %s", updatedReplicas, replicas, updateRevision), nil
+		}
+	}
+	if availableReplicas < replicas {
+		return false, fmt.Sprintf("%d of %d pods are available", availableReplicas, replicas), nil
+	}
+	return true, "", nil
+}
+
+// Check the rollout of a workload of another kind from its pods: all of them must have been created after the restart, be healthy, and have been ready for 'minReadySeconds'
+func podsRolloutIsCompleted(ctx context.Context, workload map[string]interface{}, podLister corelisters.PodLister, restartedAt time.Time) (bool, string, error) {
+	healthy, err := workloadPodsAreHealthy(ctx, workload, podLister, 0)
+	if err != nil {
+		return false, "", err
+	}
+	if !healthy {
+		return false, "workload pods are not healthy", nil
+	}
+
+	podList, err := getTargetWorkloadPods(ctx, workload, podLister)
+	if err != nil {
+		return false, "", err
+	}
+	minReadySeconds, _, _ := unstructured.NestedInt64(workload, "spec", "minReadySeconds")
+	for _, pod := range podList.Items {
+		if pod.CreationTimestamp.Time.Before(restartedAt) {
+			return false, fmt.Sprintf("pod %s has not been restarted since the last rollout", pod.Name), nil
 		}
-		podAge := time.Since(pod.GetCreationTimestamp().Time)
-		if podAge < time.Since(lastRolloutTime) {
-			log.Info("Pod has been restarted since the last rollout", "podName", pod.Name, "podStartTime", pod.Status.StartTime, "lastRolloutTime", lastRolloutTime, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-			return true, nil
-		} else {
-			log.Info("Pod has not been restarted since the last rollout", "podName", pod.Name, "podStartTime", pod.Status.StartTime, "lastRolloutTime", lastRolloutTime, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-			return false, nil
+		if !podIsAvailable(&pod, time.Duration(minReadySeconds)*time.Second) {
+			return false, fmt.Sprintf("pod %s has not been ready for %ds", pod.Name, minReadySeconds), nil
 		}
 	}
+	return true, "", nil
+}
 
-	log.Info("Rollout is still in progress for VPA", "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
-	return false, nil
+// Check if the pod has been ready for at least minReadySeconds
+func podIsAvailable(pod *corev1.Pod, minReadySeconds time.Duration) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue && time.Since(condition.LastTransitionTime.Time) >= minReadySeconds
+		}
+	}
+	return false
+}
+
+// Get the time of the latest rollout restart, from the 'kubectl.kubernetes.io/restartedAt' annotation of the workload's pod template
+func workloadRestartedAt(workload map[string]interface{}) (time.Time, bool, error) {
+	restartedAtStr, found, err := unstructured.NestedString(workload, "spec", "template", "metadata", "annotations", "kubectl.kubernetes.io/restartedAt")
+	if err != nil || !found || restartedAtStr == "" {
+		return time.Time{}, false, nil
+	}
+	restartedAt, err := time.Parse(time.RFC3339, restartedAtStr)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error parsing restartedAt annotation %q: %v", restartedAtStr, err)
+	}
+	return restartedAt, true, nil
+}
+
+// Get the number of replicas of the workload, which defaults to 1 when not set
+func workloadReplicas(workload map[string]interface{}) int64 {
+	replicas, found, err := unstructured.NestedInt64(workload, "spec", "replicas")
+	if err != nil || !found {
+		return 1
+	}
+	return replicas
+}
+
+// Convert a boolean to a gauge value
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
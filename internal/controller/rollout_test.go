@@ -2,18 +2,25 @@ package controller
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/client-go/kubernetes/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
 
 	testutil "github.com/influxdata/vpa-rollout-controller/test"
 )
 
 func TestRolloutIsNeeded(t *testing.T) {
 	ctx := context.Background()
-	clientset := fake.NewSimpleClientset()
+	podLister := testutil.CreateTestPodLister()
 	vpa := testutil.CreateTestVPA(
 		testutil.WithStatus(
 			testutil.WithRecommendation(
@@ -24,9 +31,8 @@ func TestRolloutIsNeeded(t *testing.T) {
 		testutil.WithAnnotation(utils.VPAAnnotationDiffPercentTrigger, "10"),
 	)
 	workload := testutil.CreateTestWorkload("my-workload", "default", "2025-01-01T00:00:00Z")
-	diffPercentTrigger := 10
 
-	rolloutIsNeeded, err := RolloutIsNeeded(ctx, clientset, vpa, workload, diffPercentTrigger)
+	rolloutIsNeeded, _, _, err := RolloutIsNeeded(ctx, podLister, nil, limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), vpa, workload, percentTriggerThresholds(10), StabilizationConfig{}, NewDryRunDriftHistories(), 0, "", false, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -44,8 +50,217 @@ func TestTriggerRollout(t *testing.T) {
 	patchOperationFieldManager := "test-field-manager"
 	vpa := testutil.CreateTestVPA()
 
-	err := TriggerRollout(ctx, workload, vpa, dynamicClient, patchOperationFieldManager)
+	err := TriggerRollout(ctx, workload, vpa, dynamicClient, testutil.CreateTestRESTMapper(), &testutil.FakeWorkloadListers{}, limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), patchOperationFieldManager, SurgeBufferConfig{}, false)
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
 }
+
+func TestTriggerRolloutDryRun(t *testing.T) {
+	ctx := context.Background()
+	// Record the actions sent to the API server, there should be none in dry-run
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	recorder := record.NewFakeRecorder(10)
+	workload := testutil.CreateTestWorkload("my-workload", "default", "2025-01-01T00:00:00Z")
+	vpa := testutil.CreateTestVPA()
+
+	err := TriggerRollout(ctx, workload, vpa, dynamicClient, testutil.CreateTestRESTMapper(), &testutil.FakeWorkloadListers{}, limitrange.NewNoopLimitsCalculator(), recorder, "test-field-manager", SurgeBufferConfig{}, true)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(dynamicClient.Actions()) != 0 {
+		t.Errorf("expected no API calls in dry-run, got: %v", dynamicClient.Actions())
+	}
+	// One event for the rollout restart on the VPA and the workload, one for the rollout status on the VPA
+	if len(recorder.Events) != 3 {
+		t.Fatalf("expected 3 events, got: %d", len(recorder.Events))
+	}
+	for i := 0; i < 3; i++ {
+		event := <-recorder.Events
+		if !strings.HasPrefix(event, "Normal "+EventReasonDryRun) {
+			t.Errorf("expected a Normal %s event, got: %s", EventReasonDryRun, event)
+		}
+	}
+}
+
+func TestGetRolloutStatusUpdatedAt(t *testing.T) {
+	ctx := context.Background()
+
+	vpa := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatusUpdatedAt, "2025-01-01T00:00:00Z"),
+	)
+	updatedAt, found := GetRolloutStatusUpdatedAt(ctx, vpa)
+	if !found {
+		t.Fatalf("expected the rollout status timestamp to be found")
+	}
+	if !updatedAt.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected 2025-01-01T00:00:00Z, got: %v", updatedAt)
+	}
+
+	// Invalid or missing timestamps are ignored
+	vpaInvalid := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatusUpdatedAt, "yesterday"),
+	)
+	if _, found := GetRolloutStatusUpdatedAt(ctx, vpaInvalid); found {
+		t.Errorf("expected an invalid rollout status timestamp to be ignored")
+	}
+	if _, found := GetRolloutStatusUpdatedAt(ctx, testutil.CreateTestVPA()); found {
+		t.Errorf("expected no rollout status timestamp")
+	}
+}
+
+func TestRolloutIsCompleted(t *testing.T) {
+	ctx := context.Background()
+	restartedAt := time.Now().Add(-5 * time.Minute).UTC().Format(time.RFC3339)
+	vpa := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatus, "in-progress"),
+		testutil.WithAnnotation(utils.VPAAnnotationRolloutStatusUpdatedAt, restartedAt),
+	)
+
+	// Builds a workload restarted at the given time, with the given status
+	newWorkload := func(kind string, restartedAt string, status map[string]interface{}) map[string]interface{} {
+		workload := testutil.CreateTestWorkload("test-workload", "default", "")
+		workload["kind"] = kind
+		workload["metadata"].(map[string]interface{})["generation"] = int64(2)
+		spec := workload["spec"].(map[string]interface{})
+		spec["replicas"] = int64(2)
+		spec["template"] = map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{"kubectl.kubernetes.io/restartedAt": restartedAt},
+			},
+		}
+		workload["status"] = status
+		return workload
+	}
+
+	tests := []struct {
+		name        string
+		workload    map[string]interface{}
+		pods        []*corev1.Pod
+		completed   bool
+		expectError bool
+	}{
+		{
+			name: "Deployment rollout is completed",
+			workload: newWorkload("Deployment", restartedAt, map[string]interface{}{
+				"observedGeneration": int64(2), "replicas": int64(2), "updatedReplicas": int64(2), "availableReplicas": int64(2),
+				"conditions": []interface{}{map[string]interface{}{"type": "Progressing", "status": "True", "reason": "NewReplicaSetAvailable"}},
+			}),
+			completed: true,
+		},
+		{
+			name: "Deployment spec update is not observed yet",
+			workload: newWorkload("Deployment", restartedAt, map[string]interface{}{
+				"observedGeneration": int64(1), "replicas": int64(2), "updatedReplicas": int64(2), "availableReplicas": int64(2),
+			}),
+		},
+		{
+			name: "Deployment has old replicas left",
+			workload: newWorkload("Deployment", restartedAt, map[string]interface{}{
+				"observedGeneration": int64(2), "replicas": int64(3), "updatedReplicas": int64(2), "availableReplicas": int64(2),
+				"conditions": []interface{}{map[string]interface{}{"type": "Progressing", "status": "True", "reason": "ReplicaSetUpdated"}},
+			}),
+		},
+		{
+			name: "Deployment updated replicas are not available",
+			workload: newWorkload("Deployment", restartedAt, map[string]interface{}{
+				"observedGeneration": int64(2), "replicas": int64(2), "updatedReplicas": int64(2), "availableReplicas": int64(1),
+			}),
+		},
+		{
+			name: "Deployment exceeded its progress deadline",
+			workload: newWorkload("Deployment", restartedAt, map[string]interface{}{
+				"observedGeneration": int64(2), "replicas": int64(2), "updatedReplicas": int64(1), "availableReplicas": int64(1),
+				"conditions": []interface{}{map[string]interface{}{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"}},
+			}),
+			expectError: true,
+		},
+		{
+			name: "Deployment from a stale cache, restarted before the rollout was triggered",
+			workload: newWorkload("Deployment", time.Now().Add(-1*time.Hour).UTC().Format(time.RFC3339), map[string]interface{}{
+				"observedGeneration": int64(2), "replicas": int64(2), "updatedReplicas": int64(2), "availableReplicas": int64(2),
+			}),
+		},
+		{
+			name: "StatefulSet rollout is completed",
+			workload: newWorkload("StatefulSet", restartedAt, map[string]interface{}{
+				"observedGeneration": int64(2), "currentRevision": "rev-2", "updateRevision": "rev-2", "updatedReplicas": int64(2), "availableReplicas": int64(2),
+			}),
+			completed: true,
+		},
+		{
+			name: "StatefulSet revision is not current yet",
+			workload: newWorkload("StatefulSet", restartedAt, map[string]interface{}{
+				"observedGeneration": int64(2), "currentRevision": "rev-1", "updateRevision": "rev-2", "updatedReplicas": int64(1), "availableReplicas": int64(2),
+			}),
+		},
+		{
+			name:     "Other kind with all pods restarted and ready",
+			workload: newWorkload("CloneSet", restartedAt, nil),
+			pods: []*corev1.Pod{
+				testPod("pod-1", time.Now().Add(-4*time.Minute), time.Now().Add(-3*time.Minute)),
+				testPod("pod-2", time.Now().Add(-3*time.Minute), time.Now().Add(-2*time.Minute)),
+			},
+			completed: true,
+		},
+		{
+			name:     "Other kind with a pod older than the restart",
+			workload: newWorkload("CloneSet", restartedAt, nil),
+			pods: []*corev1.Pod{
+				testPod("pod-1", time.Now().Add(-4*time.Minute), time.Now().Add(-3*time.Minute)),
+				testPod("pod-2", time.Now().Add(-1*time.Hour), time.Now().Add(-1*time.Hour)),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completed, err := RolloutIsCompleted(ctx, vpa, tt.workload, testutil.CreateTestPodLister(tt.pods...))
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if completed != tt.completed {
+				t.Errorf("expected completed to be %v, got: %v", tt.completed, completed)
+			}
+		})
+	}
+
+	t.Run("Other kind respects minReadySeconds", func(t *testing.T) {
+		workload := newWorkload("CloneSet", restartedAt, nil)
+		workload["spec"].(map[string]interface{})["minReadySeconds"] = int64(300)
+		podLister := testutil.CreateTestPodLister(
+			testPod("pod-1", time.Now().Add(-4*time.Minute), time.Now().Add(-3*time.Minute)),
+			testPod("pod-2", time.Now().Add(-3*time.Minute), time.Now().Add(-2*time.Minute)),
+		)
+		completed, err := RolloutIsCompleted(ctx, vpa, workload, podLister)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if completed {
+			t.Errorf("expected the rollout not to be completed before the pods have been ready for minReadySeconds")
+		}
+	})
+}
+
+// Builds a running and ready pod of the test workload
+func testPod(name string, createdAt, readyAt time.Time) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			Labels:            map[string]string{"app": "myapp"},
+			CreationTimestamp: metav1.NewTime(createdAt),
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(readyAt)},
+			},
+		},
+	}
+}
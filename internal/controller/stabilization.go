@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+)
+
+// How long the drift from the recommendation must stay the same before it triggers a rollout.
+// When both are set, both must be reached. Zero values disable the stabilization.
+type StabilizationConfig struct {
+	// Time since the drift was first observed
+	Window time.Duration
+	// Number of evaluations the drift was observed in
+	Observations int
+}
+
+// Check if the VPA waits for its drift to be stable before a rollout
+func (s StabilizationConfig) enabled() bool {
+	return s.Window > 0 || s.Observations > 0
+}
+
+// Drift that needs a rollout, as observed while waiting for it to be stable.
+// It is kept in an annotation of the VPA, so that the stabilization survives controller restarts.
+type driftHistory struct {
+	// Containers and rules that need a rollout, e.g. "app:cpu-increase,sidecar:memory-decrease"
+	Rules string `json:"rules"`
+	// Time at which the drift was first observed
+	Since time.Time `json:"since"`
+	// Number of evaluations the drift was observed in
+	Observations int `json:"observations"`
+}
+
+// Drift histories of the VPAs in dry-run, by VPA key. The drift history annotation is not updated in dry-run,
+// so the stabilization of those VPAs is kept in memory instead, and restarts with the controller.
+type DryRunDriftHistories struct {
+	mu        sync.Mutex
+	histories map[string]driftHistory
+}
+
+func NewDryRunDriftHistories() *DryRunDriftHistories {
+	return &DryRunDriftHistories{histories: make(map[string]driftHistory)}
+}
+
+// Get the drift history of a VPA in dry-run, or nil if it has none
+func (h *DryRunDriftHistories) get(vpa v1.VerticalPodAutoscaler) *driftHistory {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	history, found := h.histories[vpa.Namespace+"/"+vpa.Name]
+	if !found {
+		return nil
+	}
+	return &history
+}
+
+// Set the drift history of a VPA in dry-run, or remove it if the history is nil
+func (h *DryRunDriftHistories) set(vpa v1.VerticalPodAutoscaler, history *driftHistory) {
+	if history == nil {
+		h.forget(vpa.Namespace + "/" + vpa.Name)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.histories[vpa.Namespace+"/"+vpa.Name] = *history
+}
+
+// Forget a VPA that no longer exists
+func (h *DryRunDriftHistories) forget(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.histories, key)
+}
+
+// Get the stabilization of a VPA: the cluster-wide one, overridden by the VPA's annotations
+func getStabilizationConfig(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, stabilization StabilizationConfig) (StabilizationConfig, error) {
+	window, err := durationFromAnnotation(recorder, vpa, utils.VPAAnnotationStabilizationWindow, stabilization.Window)
+	if err != nil {
+		return stabilization, err
+	}
+	stabilization.Window = window
+	if value := vpa.Annotations[utils.VPAAnnotationStabilizationObservations]; value != "" {
+		observations, err := strconv.Atoi(value)
+		if err != nil {
+			recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationStabilizationObservations, err)
+			return stabilization, fmt.Errorf("error parsing annotation %s: %v", utils.VPAAnnotationStabilizationObservations, err)
+		}
+		stabilization.Observations = observations
+	}
+	return stabilization, nil
+}
+
+// Check if the drift that needs a rollout has stayed the same, i.e. the same containers need a rollout for the same rules,
+// for the VPA's stabilization window and number of observations, where every evaluation of the same drift is an observation.
+// The drift history annotation of the VPA is updated with the latest observation, and reset when the drift changes.
+// In dry-run, the history is kept in dryRunHistories instead. While the drift is not stable, it returns the time remaining in the window, if any.
+func driftIsStable(ctx context.Context, dynamicClient dynamic.Interface, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, containerDiffs []ContainerDiff, stabilization StabilizationConfig, dryRunHistories *DryRunDriftHistories, patchOperationFieldManager string, dryRun bool) (bool, time.Duration, error) {
+	log := slog.Default()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	rules := driftRules(containerDiffs)
+	history := getDriftHistory(vpa)
+	if dryRun {
+		history = dryRunHistories.get(vpa)
+	}
+	if history == nil || history.Rules != rules {
+		history = &driftHistory{Rules: rules, Since: now}
+	}
+	history.Observations++
+	if dryRun {
+		log.Info("Dry run: would record the drift history of the VPA", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "Rules", history.Rules, "Since", history.Since, "Observations", history.Observations)
+		dryRunHistories.set(vpa, history)
+	} else if err := patchDriftHistory(ctx, dynamicClient, recorder, vpa, history, patchOperationFieldManager); err != nil {
+		return false, 0, err
+	}
+
+	elapsed := now.Sub(history.Since)
+	if elapsed >= stabilization.Window && history.Observations >= stabilization.Observations {
+		log.Debug("Drift of the VPA is stable", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "Rules", history.Rules, "Elapsed", elapsed, "Observations", history.Observations)
+		return true, 0, nil
+	}
+	log.Info("Rollout needed, waiting for the drift to be stable", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "Rules", history.Rules, "Elapsed", elapsed, "Window", stabilization.Window, "Observations", history.Observations, "RequiredObservations", stabilization.Observations)
+	var progress []string
+	if stabilization.Window > 0 {
+		progress = append(progress, fmt.Sprintf("observed for %s of %s", elapsed, stabilization.Window))
+	}
+	if stabilization.Observations > 0 {
+		progress = append(progress, fmt.Sprintf("observed %d of %d times", history.Observations, stabilization.Observations))
+	}
+	recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonRolloutStabilizing, "Rollout needed for %s, waiting for the drift to be stable: %s", history.Rules, strings.Join(progress, " and "))
+	return false, max(stabilization.Window-elapsed, 0), nil
+}
+
+// Remove the drift history of a VPA whose drift does not need a rollout anymore, so that the next drift starts a new stabilization
+func resetDriftHistory(ctx context.Context, dynamicClient dynamic.Interface, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, dryRunHistories *DryRunDriftHistories, patchOperationFieldManager string, dryRun bool) error {
+	if dryRun {
+		dryRunHistories.set(vpa, nil)
+	}
+	if _, found := vpa.Annotations[utils.VPAAnnotationDriftHistory]; !found {
+		return nil
+	}
+	if dryRun {
+		slog.Default().Info("Dry run: would reset the drift history of the VPA", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace)
+		return nil
+	}
+	return patchDriftHistory(ctx, dynamicClient, recorder, vpa, nil, patchOperationFieldManager)
+}
+
+// Read the drift history of a VPA from its annotation. An invalid history is ignored, which restarts the stabilization.
+func getDriftHistory(vpa v1.VerticalPodAutoscaler) *driftHistory {
+	value := vpa.Annotations[utils.VPAAnnotationDriftHistory]
+	if value == "" {
+		return nil
+	}
+	var history driftHistory
+	if err := json.Unmarshal([]byte(value), &history); err != nil {
+		slog.Default().Warn("Ignoring invalid drift history of the VPA", "err", err, "VPAName", vpa.Name, "VPANamespace", vpa.Namespace)
+		return nil
+	}
+	return &history
+}
+
+// Set the drift history annotation of a VPA, or remove it if the history is nil
+func patchDriftHistory(ctx context.Context, dynamicClient dynamic.Interface, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, history *driftHistory, patchOperationFieldManager string) error {
+	var value interface{}
+	if history != nil {
+		encodedHistory, err := json.Marshal(history)
+		if err != nil {
+			return fmt.Errorf("error encoding the drift history of VPA %s: %v", vpa.Name, err)
+		}
+		value = string(encodedHistory)
+	}
+	patchData, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]interface{}{utils.VPAAnnotationDriftHistory: value}}})
+	if err != nil {
+		return fmt.Errorf("error encoding the drift history patch of VPA %s: %v", vpa.Name, err)
+	}
+	gvr := schema.GroupVersionResource{
+		Group:    "autoscaling.k8s.io",
+		Version:  "v1",
+		Resource: "verticalpodautoscalers",
+	}
+	_, err = dynamicClient.Resource(gvr).Namespace(vpa.Namespace).Patch(ctx, vpa.Name, types.MergePatchType, patchData, metav1.PatchOptions{FieldManager: patchOperationFieldManager})
+	if err != nil {
+		slog.Default().Error("Error setting the drift history of the VPA", "err", err, "VPAName", vpa.Name, "VPANamespace", vpa.Namespace)
+		metrics.APIErrors.WithLabelValues(metrics.OperationPatchVPA).Inc()
+		recordAPIErrorEvent(recorder, vpa, nil, "setting the drift history", err)
+		return fmt.Errorf("error setting the drift history of VPA %s: %v", vpa.Name, err)
+	}
+	return nil
+}
+
+// Describe the containers that need a rollout and the rules they triggered, sorted so that the same drift is always described the same way
+func driftRules(containerDiffs []ContainerDiff) string {
+	var rules []string
+	for _, containerDiff := range containerDiffs {
+		if containerDiff.RolloutNeeded {
+			rules = append(rules, containerDiff.ContainerName+":"+containerDiff.TriggeredRule)
+		}
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ",")
+}
@@ -0,0 +1,215 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestRolloutIsNeededStabilization(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	vpa, pod := createTestDriftVPAAndPod()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), testVPAObject(vpa))
+	stabilization := StabilizationConfig{Observations: 3}
+
+	// Evaluate the VPA with the drift history annotation of the latest patch, as the informer would deliver it
+	evaluate := func() (bool, *record.FakeRecorder) {
+		t.Helper()
+		patched, err := dynamicClient.Resource(schema.GroupVersionResource{Group: "autoscaling.k8s.io", Version: "v1", Resource: "verticalpodautoscalers"}).Namespace(vpa.Namespace).Get(ctx, vpa.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if history, found := patched.GetAnnotations()[utils.VPAAnnotationDriftHistory]; found {
+			vpa.Annotations[utils.VPAAnnotationDriftHistory] = history
+		} else {
+			delete(vpa.Annotations, utils.VPAAnnotationDriftHistory)
+		}
+		recorder := record.NewFakeRecorder(10)
+		rolloutIsNeeded, _, _, err := RolloutIsNeeded(ctx, testutil.CreateTestPodLister(pod), dynamicClient, limitrange.NewNoopLimitsCalculator(), recorder, vpa, workload, percentTriggerThresholds(10), stabilization, NewDryRunDriftHistories(), 0, "test-field-manager", false, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rolloutIsNeeded, recorder
+	}
+
+	rolloutIsNeeded, recorder := evaluate()
+	if rolloutIsNeeded {
+		t.Errorf("expected the first observation of the drift to wait for stabilization")
+	}
+	if event := <-recorder.Events; !strings.Contains(event, EventReasonRolloutStabilizing) || !strings.Contains(event, "app:cpu-increase") || !strings.Contains(event, "observed 1 of 3 times") {
+		t.Errorf("expected a %s event, got: %s", EventReasonRolloutStabilizing, event)
+	}
+
+	// Evaluating a steady recommendation again is another observation
+	rolloutIsNeeded, recorder = evaluate()
+	if rolloutIsNeeded {
+		t.Errorf("expected the second observation of the drift to wait for stabilization")
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "observed 2 of 3 times") {
+		t.Errorf("expected the same recommendation to count as another observation, got: %s", event)
+	}
+
+	// A new recommendation with a drift in the same direction keeps the stabilization going, and completes it
+	vpa.Status.Recommendation.ContainerRecommendations[1].Target[corev1.ResourceCPU] = resource.MustParse("110m")
+	rolloutIsNeeded, recorder = evaluate()
+	if !rolloutIsNeeded {
+		t.Errorf("expected a rollout to be needed after 3 observations")
+	}
+	if event := <-recorder.Events; !strings.Contains(event, EventReasonRolloutNeeded) {
+		t.Errorf("expected a %s event, got: %s", EventReasonRolloutNeeded, event)
+	}
+
+	// The history is reset once the drift is gone
+	pod.Spec.Containers[1].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("110m")
+	if rolloutIsNeeded, _ := evaluate(); rolloutIsNeeded {
+		t.Errorf("expected no rollout to be needed without drift")
+	}
+	patched, err := dynamicClient.Resource(schema.GroupVersionResource{Group: "autoscaling.k8s.io", Version: "v1", Resource: "verticalpodautoscalers"}).Namespace(vpa.Namespace).Get(ctx, vpa.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if history, found := patched.GetAnnotations()[utils.VPAAnnotationDriftHistory]; found {
+		t.Errorf("expected the drift history to be removed, got: %s", history)
+	}
+}
+
+func TestRolloutIsNeededStabilizationDryRun(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	vpa, pod := createTestDriftVPAAndPod()
+	dryRunHistories := NewDryRunDriftHistories()
+	stabilization := StabilizationConfig{Observations: 2}
+
+	// Nothing is patched in dry-run, so the VPA is never updated and the client is never called
+	evaluate := func() (bool, *record.FakeRecorder) {
+		t.Helper()
+		recorder := record.NewFakeRecorder(10)
+		rolloutIsNeeded, _, _, err := RolloutIsNeeded(ctx, testutil.CreateTestPodLister(pod), nil, limitrange.NewNoopLimitsCalculator(), recorder, vpa, workload, percentTriggerThresholds(10), stabilization, dryRunHistories, 0, "", false, true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rolloutIsNeeded, recorder
+	}
+
+	rolloutIsNeeded, recorder := evaluate()
+	if rolloutIsNeeded {
+		t.Errorf("expected the first observation of the drift to wait for stabilization")
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "observed 1 of 2 times") {
+		t.Errorf("expected a %s event, got: %s", EventReasonRolloutStabilizing, event)
+	}
+
+	// The drift history is kept in memory, so the stabilization progresses
+	if rolloutIsNeeded, _ := evaluate(); !rolloutIsNeeded {
+		t.Errorf("expected a rollout to be needed after 2 observations in dry-run")
+	}
+
+	// The history is reset once the drift is gone
+	pod.Spec.Containers[1].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("100m")
+	if rolloutIsNeeded, _ := evaluate(); rolloutIsNeeded {
+		t.Errorf("expected no rollout to be needed without drift")
+	}
+	if history := dryRunHistories.get(vpa); history != nil {
+		t.Errorf("expected the dry-run drift history to be removed, got: %+v", history)
+	}
+}
+
+// The VPA as the dynamic client serves it, for the drift history patches
+func testVPAObject(vpa v1.VerticalPodAutoscaler) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "autoscaling.k8s.io/v1",
+		"kind":       "VerticalPodAutoscaler",
+		"metadata":   map[string]interface{}{"name": vpa.Name, "namespace": vpa.Namespace},
+	}}
+}
+
+func TestDriftIsStableWindow(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	containerDiffs := []ContainerDiff{
+		{ContainerName: "app", TriggeredRule: TriggerRuleMemoryIncrease, RolloutNeeded: true},
+		{ContainerName: "sidecar"},
+	}
+
+	tests := []struct {
+		name            string
+		history         driftHistory
+		expectStable    bool
+		expectRemaining time.Duration
+	}{
+		{
+			name:         "Drift observed for longer than the window is stable",
+			history:      driftHistory{Rules: "app:memory-increase", Since: time.Now().Add(-20 * time.Minute)},
+			expectStable: true,
+		},
+		{
+			name:            "Drift observed for less than the window is not stable",
+			history:         driftHistory{Rules: "app:memory-increase", Since: time.Now().Add(-10 * time.Minute)},
+			expectStable:    false,
+			expectRemaining: 5 * time.Minute,
+		},
+		{
+			name:            "Drift that changed direction restarts the window",
+			history:         driftHistory{Rules: "app:memory-decrease", Since: time.Now().Add(-20 * time.Minute)},
+			expectStable:    false,
+			expectRemaining: 15 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vpa, _ := createTestDriftVPAAndPod()
+			encodedHistory, _ := json.Marshal(tt.history)
+			vpa.Annotations[utils.VPAAnnotationDriftHistory] = string(encodedHistory)
+
+			stable, remaining, err := driftIsStable(ctx, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), testVPAObject(vpa)), record.NewFakeRecorder(10), vpa, workload, containerDiffs, StabilizationConfig{Window: 15 * time.Minute}, NewDryRunDriftHistories(), "", false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stable != tt.expectStable {
+				t.Errorf("expected stable to be %v, got: %v", tt.expectStable, stable)
+			}
+			// The VPA is re-evaluated once the window has passed, up to a second off since the history is kept in seconds
+			if (remaining - tt.expectRemaining).Abs() > time.Second {
+				t.Errorf("expected %s of the window to remain, got: %s", tt.expectRemaining, remaining)
+			}
+		})
+	}
+}
+
+func TestGetStabilizationConfig(t *testing.T) {
+	vpa := testutil.CreateTestVPA(
+		testutil.WithAnnotation(utils.VPAAnnotationStabilizationWindow, "30m"),
+		testutil.WithAnnotation(utils.VPAAnnotationStabilizationObservations, "3"),
+	)
+	stabilization, err := getStabilizationConfig(record.NewFakeRecorder(10), vpa, StabilizationConfig{Window: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stabilization != (StabilizationConfig{Window: 30 * time.Minute, Observations: 3}) {
+		t.Errorf("expected the annotations to override the stabilization, got: %+v", stabilization)
+	}
+
+	vpa = testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationStabilizationObservations, "three"))
+	if _, err := getStabilizationConfig(record.NewFakeRecorder(10), vpa, StabilizationConfig{}); err == nil {
+		t.Errorf("expected an error for invalid observations")
+	}
+}
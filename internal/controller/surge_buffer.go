@@ -3,85 +3,244 @@ package controller
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"log/slog"
-	"strconv"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
 
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
 	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	vpa_api_util "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/vpa"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
-// Create a "surge buffer" workload resource, which is a copy of the target workload with the resource requests overridden to match the VPA recommendation.
+// Cluster-wide settings of the surge buffer workloads, some of which can be overridden per VPA with annotations
+type SurgeBufferConfig struct {
+	// How the surge buffer of a StatefulSet is built: 'statefulset', 'ephemeral' or 'deployment'
+	StatefulSetMode string
+	// Changes applied to the pod template of every surge buffer, before the VPA's own overrides
+	PodTemplateOverrides PodTemplateOverrides
+}
+
+const (
+	// Suffix of the surge buffer workloads' names
+	surgeBufferNameSuffix = "-surge-buffer"
+	// Maximum length of a surge buffer workload's name, so that it can be used as a label value, e.g. in its pods' labels
+	surgeBufferNameMaxLength = 63
+)
+
+// Get the name of the surge buffer workload of a workload.
+// Names that would exceed 63 characters are truncated, and a hash of the full workload name keeps them unique.
+func surgeBufferWorkloadName(workloadName string) string {
+	name := workloadName + surgeBufferNameSuffix
+	if len(name) <= surgeBufferNameMaxLength {
+		return name
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(workloadName))
+	hashSuffix := fmt.Sprintf("-%08x", hash.Sum32())
+	prefix := strings.TrimRight(workloadName[:surgeBufferNameMaxLength-len(surgeBufferNameSuffix)-len(hashSuffix)], "-.")
+	return prefix + hashSuffix + surgeBufferNameSuffix
+}
+
+// Check if the workload is a surge buffer workload, from its labels
+func isSurgeBufferWorkload(workload map[string]interface{}) bool {
+	surgeBufferLabel, _, _ := unstructured.NestedString(workload, "metadata", "labels", utils.LabelSurgeBuffer)
+	return surgeBufferLabel == "true"
+}
+
+// Create or update the "surge buffer" workload resource, which is a copy of the target workload with the resource requests overridden to match the VPA recommendation.
+// A surge buffer that already exists, e.g. left over from a previous attempt or built from an older recommendation, is updated to match the latest recommendation and number of replicas,
+// or deleted and created again if the update is rejected, e.g. because it changes an immutable field.
+// It returns true if the surge buffer was created, updated or recreated, in which case its pods are not ready yet.
+// In dry-run, the surge buffer workload is built but only logged and recorded as an Event.
+func EnsureSurgeBufferWorkload(ctx context.Context, dynamicClient dynamic.Interface, restMapper meta.RESTMapper, workloadListers WorkloadListers, limitRanges limitrange.LimitRangeCalculator, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, surgeBufferConfig SurgeBufferConfig, dryRun bool) (bool, error) {
+	log := slog.Default()
+
+	surgeBufferWorkload, surgeBufferReplicas, surgeBufferRequests, err := buildSurgeBufferWorkload(recorder, limitRanges, vpa, workload, surgeBufferConfig)
+	if err != nil {
+		return false, err
+	}
+	surgeBufferWorkloadResource := &unstructured.Unstructured{Object: surgeBufferWorkload}
+	surgeBufferName := surgeBufferWorkloadResource.GetName()
+	workloadName := (&unstructured.Unstructured{Object: workload}).GetName()
+	workloadNamespace := surgeBufferWorkloadResource.GetNamespace()
+	gvk := surgeBufferWorkloadResource.GroupVersionKind()
+	gvr, err := workloadGVR(restMapper, gvk.GroupVersion().String(), gvk.Kind)
+	if err != nil {
+		return false, err
+	}
+
+	// Look for an existing surge buffer in the cache first, to avoid a call to the API server on each reconciliation of a pending rollout
+	var existing *unstructured.Unstructured
+	workloadLister, err := workloadListers.ForResource(ctx, gvr)
+	if err != nil {
+		log.Error("Error getting workload lister", "err", err, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		return false, fmt.Errorf("error getting workload lister: %v", err)
+	}
+	existingObject, err := workloadLister.ByNamespace(workloadNamespace).Get(surgeBufferName)
+	if err != nil && !errors.IsNotFound(err) {
+		log.Error("Error getting existing surge buffer workload", "err", err, "SurgeBufferWorkloadName", surgeBufferName, "WorkloadNamespace", workloadNamespace)
+		return false, fmt.Errorf("error getting existing surge buffer workload: %v", err)
+	}
+	if err == nil {
+		var ok bool
+		existing, ok = existingObject.(*unstructured.Unstructured)
+		if !ok {
+			return false, fmt.Errorf("error getting existing surge buffer workload: unexpected object type %T", existingObject)
+		}
+	}
+
+	if existing == nil {
+		if dryRun {
+			log.Info("Dry run: would create surge buffer workload", "WorkloadName", workloadName, "SurgeWorkload", surgeBufferWorkload)
+			recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonDryRun, "Dry run: would create surge buffer %s %s with %d replicas and requests %s", gvk.Kind, surgeBufferName, surgeBufferReplicas, formatSurgeBufferRequests(surgeBufferRequests))
+			return true, nil
+		}
+		_, err = dynamicClient.Resource(gvr).Namespace(workloadNamespace).Create(ctx, surgeBufferWorkloadResource, metav1.CreateOptions{})
+		if err == nil {
+			log.Info("Created surge buffer workload", "WorkloadName", workloadName, "SurgeWorkload", surgeBufferWorkload)
+			recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonSurgeBufferCreated, "Created surge buffer %s %s with %d replicas", gvk.Kind, surgeBufferName, surgeBufferReplicas)
+			recordZeroMaxSurgeEvent(recorder, vpa, workload)
+			return true, nil
+		}
+		if !errors.IsAlreadyExists(err) {
+			log.Error("Error creating surge buffer workload", "err", err, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+			metrics.APIErrors.WithLabelValues(metrics.OperationCreateSurgeBuffer).Inc()
+			recordAPIErrorEvent(recorder, vpa, workload, "surge buffer creation", err)
+			return false, fmt.Errorf("error creating surge buffer workload: %v", err)
+		}
+		// The cache has not seen the surge buffer yet, get it from the API server
+		existing, err = dynamicClient.Resource(gvr).Namespace(workloadNamespace).Get(ctx, surgeBufferName, metav1.GetOptions{})
+		if err != nil {
+			log.Error("Error getting existing surge buffer workload", "err", err, "SurgeBufferWorkloadName", surgeBufferName, "WorkloadNamespace", workloadNamespace)
+			return false, fmt.Errorf("error getting existing surge buffer workload: %v", err)
+		}
+	}
+
+	// Never overwrite a workload that merely has the surge buffer's name
+	if !isSurgeBufferWorkload(existing.UnstructuredContent()) {
+		log.Error("Workload with the surge buffer's name is not a surge buffer", "SurgeBufferWorkloadName", surgeBufferName, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		return false, fmt.Errorf("workload %s %s already exists and is not a surge buffer", gvk.Kind, surgeBufferName)
+	}
+	if surgeBufferWorkloadIsUpToDate(existing.UnstructuredContent(), surgeBufferWorkload) {
+		log.Debug("Surge buffer workload is up to date", "SurgeBufferWorkloadName", surgeBufferName, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		return false, nil
+	}
+
+	if dryRun {
+		log.Info("Dry run: would update surge buffer workload", "WorkloadName", workloadName, "SurgeWorkload", surgeBufferWorkload)
+		recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonDryRun, "Dry run: would update surge buffer %s %s to %d replicas and requests %s", gvk.Kind, surgeBufferName, surgeBufferReplicas, formatSurgeBufferRequests(surgeBufferRequests))
+		return true, nil
+	}
+	surgeBufferWorkloadResource.SetResourceVersion(existing.GetResourceVersion())
+	_, err = dynamicClient.Resource(gvr).Namespace(workloadNamespace).Update(ctx, surgeBufferWorkloadResource, metav1.UpdateOptions{})
+	if err == nil {
+		log.Info("Updated surge buffer workload", "WorkloadName", workloadName, "SurgeWorkload", surgeBufferWorkload)
+		recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonSurgeBufferUpdated, "Updated surge buffer %s %s to %d replicas and requests %s", gvk.Kind, surgeBufferName, surgeBufferReplicas, formatSurgeBufferRequests(surgeBufferRequests))
+		return true, nil
+	}
+	if !errors.IsInvalid(err) {
+		log.Error("Error updating surge buffer workload", "err", err, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		metrics.APIErrors.WithLabelValues(metrics.OperationUpdateSurgeBuffer).Inc()
+		recordAPIErrorEvent(recorder, vpa, workload, "surge buffer update", err)
+		return false, fmt.Errorf("error updating surge buffer workload: %v", err)
+	}
+
+	// The update changes an immutable field, e.g. the selector or the volumeClaimTemplates of a StatefulSet, so recreate the surge buffer
+	log.Info("Surge buffer workload cannot be updated, recreating it", "err", err, "SurgeBufferWorkloadName", surgeBufferName, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+	uid := existing.GetUID()
+	err = dynamicClient.Resource(gvr).Namespace(workloadNamespace).Delete(ctx, surgeBufferName, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+	if err != nil && !errors.IsNotFound(err) {
+		log.Error("Error deleting surge buffer workload", "err", err, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		metrics.APIErrors.WithLabelValues(metrics.OperationDeleteSurgeBuffer).Inc()
+		recordAPIErrorEvent(recorder, vpa, workload, "surge buffer deletion", err)
+		return false, fmt.Errorf("error deleting surge buffer workload: %v", err)
+	}
+	surgeBufferWorkloadResource.SetResourceVersion("")
+	_, err = dynamicClient.Resource(gvr).Namespace(workloadNamespace).Create(ctx, surgeBufferWorkloadResource, metav1.CreateOptions{})
+	if err != nil {
+		// The deletion may not be finished yet, the surge buffer is created on the next reconciliation
+		log.Error("Error recreating surge buffer workload", "err", err, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		metrics.APIErrors.WithLabelValues(metrics.OperationCreateSurgeBuffer).Inc()
+		recordAPIErrorEvent(recorder, vpa, workload, "surge buffer creation", err)
+		return false, fmt.Errorf("error recreating surge buffer workload: %v", err)
+	}
+
+	log.Info("Recreated surge buffer workload", "WorkloadName", workloadName, "SurgeWorkload", surgeBufferWorkload)
+	recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonSurgeBufferUpdated, "Recreated surge buffer %s %s with %d replicas and requests %s", gvk.Kind, surgeBufferName, surgeBufferReplicas, formatSurgeBufferRequests(surgeBufferRequests))
+
+	return true, nil
+}
+
+// Build the "surge buffer" workload resource of a workload, along with its number of replicas and its per-container CPU and memory requests.
 // It uses 'unstructured' to handle different workload types (e.g., Deployment, StatefulSet, etc.) without needing to know the specific type at compile time.
-func CreateSurgeBufferWorkload(ctx context.Context, dynamicClient dynamic.Interface, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}) error {
+func buildSurgeBufferWorkload(recorder record.EventRecorder, limitRanges limitrange.LimitRangeCalculator, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, surgeBufferConfig SurgeBufferConfig) (map[string]interface{}, int, map[string]map[string]*resource.Quantity, error) {
 	log := slog.Default()
 
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
 	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
 
-	// Check that the VPA has a recommendation and store the CPU and memory requests
+	// Check that the VPA has a recommendation
 	if vpa.Status.Recommendation == nil || len(vpa.Status.Recommendation.ContainerRecommendations) == 0 {
 		log.Error("VPA recommendation is nil or empty", "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
-		return fmt.Errorf("VPA recommendation is nil or empty for VPA %s in namespace %s", vpa.Name, vpa.Namespace)
-	}
-
-	// Two-level map to store CPU and memory requests for each container
-	vpaRecommendationRequests := make(map[string]map[string]*resource.Quantity)
-	vpaRecommendationRequests["cpu"] = make(map[string]*resource.Quantity)
-	vpaRecommendationRequests["memory"] = make(map[string]*resource.Quantity)
-	for i, container := range vpa.Status.Recommendation.ContainerRecommendations {
-		if vpa.Status.Recommendation.ContainerRecommendations[i].Target.Cpu() != nil || vpa.Status.Recommendation.ContainerRecommendations[i].Target.Memory() != nil {
-			vpaRecommendationRequests["cpu"][container.ContainerName] = vpa.Status.Recommendation.ContainerRecommendations[i].Target.Cpu()
-			vpaRecommendationRequests["memory"][container.ContainerName] = vpa.Status.Recommendation.ContainerRecommendations[i].Target.Memory()
-		} else {
-			log.Error("VPA recommendation for container is missing CPU or memory target", "ContainerName", container.ContainerName, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
-			return fmt.Errorf("VPA recommendation for container %s is missing CPU or memory target in VPA %s in namespace %s", container.ContainerName, vpa.Name, vpa.Namespace)
-		}
+		return nil, 0, nil, fmt.Errorf("VPA recommendation is nil or empty for VPA %s in namespace %s", vpa.Name, vpa.Namespace)
 	}
 
 	// Determine the number of surge buffer pods
-	var surgeBufferReplicas string
-	if vpa.Annotations != nil && vpa.Annotations[utils.VPAAnnotationNumberOfSurgeBufferPods] != "" {
-		surgeBufferReplicas = vpa.Annotations[utils.VPAAnnotationNumberOfSurgeBufferPods]
-	} else {
-		surgeBufferReplicas = utils.DefaultSurgeBufferReplicas
-	}
-	surgeBufferReplicasInt, err := strconv.Atoi(surgeBufferReplicas)
+	surgeBufferReplicasInt, err := surgeBufferReplicas(recorder, vpa, workload)
 	if err != nil {
-		log.Error("Error parsing surge buffer replicas from VPA annotation", "err", err, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
-		return fmt.Errorf("error parsing surge buffer replicas from VPA annotation: %v", err)
+		return nil, 0, nil, err
 	}
 
 	// Make a deep copy of the workload to create the surge buffer pod and override a few fields
 	surgeBufferWorkload := runtime.DeepCopyJSON(workload)
 	// Explicitly set the contents of the "metadata" fields, since we know exactly what we want to set
 	surgeBufferMetadata := make(map[string]interface{})
-	surgeBufferMetadata["name"] = fmt.Sprintf("%s-surge-buffer", workloadName)
+	surgeBufferMetadata["name"] = surgeBufferWorkloadName(workloadName.(string))
 	surgeBufferMetadata["namespace"] = workloadNamespace
 	// Add surge buffer-specific annotations
 	surgeBufferMetadata["annotations"] = make(map[string]interface{})
 	for key, value := range utils.SurgeBufferWorkloadAnnotations {
 		surgeBufferMetadata["annotations"].(map[string]interface{})[key] = value
 	}
-	// Add surge buffer-specific labels
+	surgeBufferMetadata["annotations"].(map[string]interface{})[utils.AnnotationSurgeBufferVPAName] = vpa.Name
+	surgeBufferMetadata["annotations"].(map[string]interface{})[utils.AnnotationSurgeBufferSourceWorkloadName] = workloadName
+	// Add surge buffer-specific labels, linking it to its VPA and source workload
 	surgeBufferMetadata["labels"] = make(map[string]interface{})
 	for key, value := range utils.SurgeBufferWorkloadLabels {
 		surgeBufferMetadata["labels"].(map[string]interface{})[key] = value
 	}
-	log.Debug("Creating surge buffer workload", "WorkloadName", workloadName, "SurgeBufferWorkloadName", surgeBufferMetadata["name"], "WorkloadNamespace", workloadNamespace, "SurgeBufferReplicas", surgeBufferReplicasInt)
+	surgeBufferMetadata["labels"].(map[string]interface{})[utils.LabelSurgeBufferVPAUID] = string(vpa.UID)
+	surgeBufferMetadata["labels"].(map[string]interface{})[utils.LabelSurgeBufferSourceWorkloadUID] = string((&unstructured.Unstructured{Object: workload}).GetUID())
+	// The VPA owns the surge buffer, so that deleting the VPA garbage collects it
+	surgeBufferMetadata["ownerReferences"] = []interface{}{
+		map[string]interface{}{
+			"apiVersion": v1.SchemeGroupVersion.String(),
+			"kind":       "VerticalPodAutoscaler",
+			"name":       vpa.Name,
+			"uid":        string(vpa.UID),
+		},
+	}
+	log.Debug("Building surge buffer workload", "WorkloadName", workloadName, "SurgeBufferWorkloadName", surgeBufferMetadata["name"], "WorkloadNamespace", workloadNamespace, "SurgeBufferReplicas", surgeBufferReplicasInt)
 	surgeBufferWorkload["metadata"] = surgeBufferMetadata
 
 	// Only override a few fields in the "spec", since we want to keep the rest of the workload as is
 	// Set the "replicas" field to the number of surge buffer pods
-	surgeBufferWorkload["spec"].(map[string]interface{})["replicas"] = surgeBufferReplicasInt
+	surgeBufferWorkload["spec"].(map[string]interface{})["replicas"] = int64(surgeBufferReplicasInt)
 	// Add the "surge-buffer" annotation and labels to the pod template
 	podTemplate := surgeBufferWorkload["spec"].(map[string]interface{})["template"].(map[string]interface{})
 	for key, value := range utils.SurgeBufferPodAnnotations {
@@ -96,91 +255,290 @@ func CreateSurgeBufferWorkload(ctx context.Context, dynamicClient dynamic.Interf
 		}
 		podTemplate["metadata"].(map[string]interface{})["labels"].(map[string]interface{})[key] = value
 	}
-	// Override the resource requests in the podTemplate with the VPA recommendation
-	for i, container := range surgeBufferWorkload["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{}) {
-		for containerName := range vpaRecommendationRequests["cpu"] {
-			if containerName == container.(map[string]interface{})["name"] {
-				podTemplate["spec"].(map[string]interface{})["containers"].([]interface{})[i].(map[string]interface{})["resources"].(map[string]interface{})["requests"].(map[string]interface{})[string(corev1.ResourceCPU)] = vpaRecommendationRequests["cpu"][containerName].String()
-				podTemplate["spec"].(map[string]interface{})["containers"].([]interface{})[i].(map[string]interface{})["resources"].(map[string]interface{})["requests"].(map[string]interface{})[string(corev1.ResourceMemory)] = vpaRecommendationRequests["memory"][containerName].String()
-				podTemplate["spec"].(map[string]interface{})["containers"].([]interface{})[i].(map[string]interface{})["resources"].(map[string]interface{})["limits"].(map[string]interface{})[string(corev1.ResourceMemory)] = vpaRecommendationRequests["memory"][containerName].String()
+	// Apply the cluster-wide and the VPA's pod template overrides, e.g. to schedule the surge buffer pods on dedicated nodes
+	podTemplateOverrides, err := surgeBufferPodTemplateOverrides(recorder, vpa, surgeBufferConfig.PodTemplateOverrides)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	selectorLabels, _, _ := unstructured.NestedStringMap(workload, "spec", "selector", "matchLabels")
+	if err := applyPodTemplateOverrides(podTemplate, selectorLabels, podTemplateOverrides); err != nil {
+		log.Error("Error applying surge buffer pod template overrides", "err", err, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
+		return nil, 0, nil, err
+	}
+	// Set the containers' resources as the VPA admission controller will for the pods created by the rollout, and keep the resulting CPU and memory requests.
+	// The init containers in the VPA's scope, e.g. native sidecars, get their recommendation like the regular containers.
+	initContainersScope, err := getInitContainersScope(recorder, vpa)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	pod, err := podFromWorkloadTemplate(workload)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var initContainerNames []string
+	for _, container := range pod.Spec.InitContainers {
+		if initContainerIsInScope(container, initContainersScope) {
+			initContainerNames = append(initContainerNames, container.Name)
+		}
+	}
+	effectiveRecommendation, err := EffectiveRecommendation(vpa, podWithInitContainers(pod, initContainersScope), limitRanges)
+	if err != nil {
+		log.Error("Error computing the effective VPA recommendation", "err", err, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
+		return nil, 0, nil, err
+	}
+	defaultLimits, err := defaultContainerLimits(limitRanges, pod.Namespace)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	vpaRecommendationRequests := map[string]map[string]*resource.Quantity{"cpu": {}, "memory": {}}
+	for _, field := range []string{"containers", "initContainers"} {
+		containers, found, _ := unstructured.NestedSlice(podTemplate, "spec", field)
+		if !found {
+			continue
+		}
+		for _, container := range containers {
+			container, ok := container.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			containerName, _ := container["name"].(string)
+			if field == "initContainers" && !slices.Contains(initContainerNames, containerName) {
+				continue
+			}
+			recommendation := vpa_api_util.GetRecommendationForContainer(containerName, effectiveRecommendation)
+			if recommendation == nil {
+				continue
+			}
+			resources, err := setContainerResourcesForRecommendation(container, recommendation.Target, vpa.Spec.ResourcePolicy, defaultLimits)
+			if err != nil {
+				log.Error("Error setting surge buffer container resources", "err", err, "ContainerName", containerName, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
+				return nil, 0, nil, err
+			}
+			if cpu, found := resources.Requests[corev1.ResourceCPU]; found {
+				vpaRecommendationRequests["cpu"][containerName] = &cpu
+			}
+			if memory, found := resources.Requests[corev1.ResourceMemory]; found {
+				vpaRecommendationRequests["memory"][containerName] = &memory
 			}
 		}
-
+		if err := unstructured.SetNestedSlice(podTemplate, containers, "spec", field); err != nil {
+			return nil, 0, nil, fmt.Errorf("error setting surge buffer %s: %v", field, err)
+		}
 	}
 	// Remove the "status" field from the surge buffer workload, since we don't want to set it
 	delete(surgeBufferWorkload, "status")
 
-	// Create the surge buffer workload using the typed client
-	surgeBufferWorkloadResource := &unstructured.Unstructured{Object: surgeBufferWorkload}
-	gvk := surgeBufferWorkloadResource.GroupVersionKind()
-	gvr := schema.GroupVersionResource{
-		Group:    gvk.Group,
-		Version:  gvk.Version,
-		Resource: strings.ToLower(gvk.Kind) + "s",
+	// StatefulSets are not copied as is, to not leave PVCs behind nor share the workload's identity
+	if workload["kind"] == "StatefulSet" {
+		buildStatefulSetSurgeBuffer(surgeBufferWorkload, surgeBufferStatefulSetMode(recorder, vpa, surgeBufferConfig.StatefulSetMode), vpa.Annotations[utils.VPAAnnotationSurgeBufferServiceName])
 	}
-	_, err = dynamicClient.Resource(gvr).Namespace(workloadNamespace.(string)).Create(ctx, surgeBufferWorkloadResource, metav1.CreateOptions{})
-	if err != nil {
-		log.Error("Error creating surge buffer workload", "err", err, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
-		return fmt.Errorf("error creating surge buffer workload: %v", err)
+
+	return surgeBufferWorkload, surgeBufferReplicasInt, vpaRecommendationRequests, nil
+}
+
+// Pod template fields of the surge buffer that are copied from the workload or set by the pod template overrides
+var surgeBufferTemplateFields = [][]string{
+	{"metadata", "labels"},
+	{"metadata", "annotations"},
+	{"spec", "priorityClassName"},
+	{"spec", "nodeSelector"},
+	{"spec", "tolerations"},
+	{"spec", "affinity"},
+}
+
+// Check if an existing surge buffer workload matches the desired one: same VPA, number of replicas, container and init container
+// resources, and pod template labels, annotations and scheduling fields
+func surgeBufferWorkloadIsUpToDate(existing, desired map[string]interface{}) bool {
+	existingVPAUID, _, _ := unstructured.NestedString(existing, "metadata", "labels", utils.LabelSurgeBufferVPAUID)
+	desiredVPAUID, _, _ := unstructured.NestedString(desired, "metadata", "labels", utils.LabelSurgeBufferVPAUID)
+	if existingVPAUID != desiredVPAUID {
+		return false
+	}
+	if workloadReplicas(existing) != workloadReplicas(desired) {
+		return false
 	}
 
-	log.Info("Created surge buffer workload", "WorkloadName", workloadName, "SurgeWorkload", surgeBufferWorkload)
+	for _, field := range []string{"containers", "initContainers"} {
+		existingContainers, _, _ := unstructured.NestedSlice(existing, "spec", "template", "spec", field)
+		desiredContainers, _, _ := unstructured.NestedSlice(desired, "spec", "template", "spec", field)
+		if len(existingContainers) != len(desiredContainers) {
+			return false
+		}
+		for i, desiredContainer := range desiredContainers {
+			existingContainer, ok := existingContainers[i].(map[string]interface{})
+			if !ok {
+				return false
+			}
+			desiredContainer, ok := desiredContainer.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			if existingContainer["name"] != desiredContainer["name"] {
+				return false
+			}
+			for _, field := range []string{"requests", "limits"} {
+				existingResources, _, _ := unstructured.NestedMap(existingContainer, "resources", field)
+				desiredResources, _, _ := unstructured.NestedMap(desiredContainer, "resources", field)
+				if !resourceListsAreEqual(existingResources, desiredResources) {
+					return false
+				}
+			}
+		}
+	}
 
-	return nil
+	for _, field := range surgeBufferTemplateFields {
+		path := append([]string{"spec", "template"}, field...)
+		existingValue, _, _ := unstructured.NestedFieldNoCopy(existing, path...)
+		desiredValue, _, _ := unstructured.NestedFieldNoCopy(desired, path...)
+		if !unstructuredFieldsAreEqual(existingValue, desiredValue) {
+			return false
+		}
+	}
+	return true
+}
 
+// Compare two unstructured fields, where a missing field is the same as an empty one, since the API server drops empty fields
+func unstructuredFieldsAreEqual(a, b interface{}) bool {
+	isEmpty := func(value interface{}) bool {
+		if value == nil {
+			return true
+		}
+		switch v := reflect.ValueOf(value); v.Kind() {
+		case reflect.Map, reflect.Slice, reflect.String:
+			return v.Len() == 0
+		}
+		return false
+	}
+	if isEmpty(a) || isEmpty(b) {
+		return isEmpty(a) && isEmpty(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Compare two unstructured resource lists, e.g. {"cpu": "100m", "memory": "128Mi"}, by quantity rather than by their string representation
+func resourceListsAreEqual(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, aValue := range a {
+		bValue, found := b[name]
+		if !found {
+			return false
+		}
+		aQuantity, err := resource.ParseQuantity(fmt.Sprint(aValue))
+		if err != nil {
+			return false
+		}
+		bQuantity, err := resource.ParseQuantity(fmt.Sprint(bValue))
+		if err != nil {
+			return false
+		}
+		if aQuantity.Cmp(bQuantity) != 0 {
+			return false
+		}
+	}
+	return true
 }
 
-// Delete the surge buffer workload resource created for the VPA target workload.
+// Delete the surge buffer workload resource created for the VPA target workload, and the PVCs of its pods if it is a StatefulSet.
 // This is used to clean up the surge buffer workload after the rollout is complete.
-func DeleteSurgeBufferWorkload(ctx context.Context, dynamicClient dynamic.Interface, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}) error {
+// In dry-run, the deletion is only logged and recorded as an Event.
+func DeleteSurgeBufferWorkload(ctx context.Context, dynamicClient dynamic.Interface, restMapper meta.RESTMapper, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, surgeBufferConfig SurgeBufferConfig, dryRun bool) error {
 	log := slog.Default()
 
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
 	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
 
-	surgeBufferWorkloadName := fmt.Sprintf("%s-surge-buffer", workloadName)
+	surgeBufferWorkloadName := surgeBufferWorkloadName(workloadName.(string))
+
+	gvk := surgeBufferGroupVersionKind(recorder, vpa, workload, surgeBufferConfig)
+	gvr, err := workloadGVR(restMapper, gvk.GroupVersion().String(), gvk.Kind)
+	if err != nil {
+		return err
+	}
 
-	gvr := schema.GroupVersionResource{
-		Group:    strings.SplitN(vpa.Spec.TargetRef.APIVersion, "/", 2)[0],
-		Version:  strings.SplitN(vpa.Spec.TargetRef.APIVersion, "/", 2)[1],
-		Resource: strings.ToLower(vpa.Spec.TargetRef.Kind + "s"),
+	if dryRun {
+		log.Info("Dry run: would delete surge buffer workload", "SurgeBufferWorkloadName", surgeBufferWorkloadName, "WorkloadName", workloadName)
+		recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonDryRun, "Dry run: would delete surge buffer %s %s", gvk.Kind, surgeBufferWorkloadName)
+		return nil
 	}
 
 	// Delete the surge buffer workload
-	err := dynamicClient.Resource(gvr).Namespace(workloadNamespace.(string)).Delete(ctx, surgeBufferWorkloadName, metav1.DeleteOptions{})
+	err = dynamicClient.Resource(gvr).Namespace(workloadNamespace.(string)).Delete(ctx, surgeBufferWorkloadName, metav1.DeleteOptions{})
 	if err != nil {
 		log.Error("Error deleting surge buffer workload", "err", err, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		metrics.APIErrors.WithLabelValues(metrics.OperationDeleteSurgeBuffer).Inc()
+		recordAPIErrorEvent(recorder, vpa, workload, "surge buffer deletion", err)
 		return fmt.Errorf("error deleting surge buffer workload: %v", err)
 	}
 
 	log.Info("Deleted surge buffer workload", "SurgeBufferWorkloadName", surgeBufferWorkloadName, "WorkloadName", workloadName)
+	recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonSurgeBufferDeleted, "Deleted surge buffer %s %s", gvk.Kind, surgeBufferWorkloadName)
+
+	// The surge buffer is gone at this point, so a failure is only reported, the PVCs' retention policy deletes them too
+	if gvk.Kind == "StatefulSet" {
+		if _, err := deleteSurgeBufferPVCs(ctx, dynamicClient, workloadNamespace.(string), surgeBufferWorkloadName, volumeClaimTemplateNames(workload)); err != nil {
+			recordAPIErrorEvent(recorder, vpa, workload, "surge buffer PVC deletion", err)
+		}
+	}
 
 	return nil
 }
 
+// Formats the per-container requests of a surge buffer, e.g. "app: cpu=100m memory=128Mi"
+func formatSurgeBufferRequests(requests map[string]map[string]*resource.Quantity) string {
+	containerNames := make([]string, 0, len(requests["cpu"]))
+	for containerName := range requests["cpu"] {
+		containerNames = append(containerNames, containerName)
+	}
+	// Containers with a memory-only policy have no CPU request set
+	for containerName := range requests["memory"] {
+		if _, found := requests["cpu"][containerName]; !found {
+			containerNames = append(containerNames, containerName)
+		}
+	}
+	sort.Strings(containerNames)
+	formatted := make([]string, 0, len(containerNames))
+	for _, containerName := range containerNames {
+		formatted = append(formatted, fmt.Sprintf("%s: cpu=%s memory=%s", containerName, formatRequest(requests["cpu"][containerName]), formatRequest(requests["memory"][containerName])))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func formatRequest(request *resource.Quantity) string {
+	if request == nil {
+		return "unset"
+	}
+	return request.String()
+}
+
 // Returns the status of the surge buffer workload.
 // It returns :
 // - "Ready" if the workload is healthy (based on workloadPodsAreHealthy function)
 // - "NotReady" if the workload is not healthy (based on workloadPodsAreHealthy function)
 // - "NotFound" if the  workload does not exist
 // - "Error" if there was an error checking the workload status
-func GetSurgeBufferWorkloadStatus(ctx context.Context, dynamicClient dynamic.Interface, clientset kubernetes.Interface, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}) (string, error) {
+func GetSurgeBufferWorkloadStatus(ctx context.Context, workloadListers WorkloadListers, restMapper meta.RESTMapper, podLister corelisters.PodLister, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, surgeBufferConfig SurgeBufferConfig) (string, error) {
 	log := slog.Default()
 
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
 	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
 
-	surgeBufferWorkloadName := fmt.Sprintf("%s-surge-buffer", workloadName)
+	surgeBufferWorkloadName := surgeBufferWorkloadName(workloadName.(string))
 
-	gvr := schema.GroupVersionResource{
-		Group:    strings.SplitN(vpa.Spec.TargetRef.APIVersion, "/", 2)[0],
-		Version:  strings.SplitN(vpa.Spec.TargetRef.APIVersion, "/", 2)[1],
-		Resource: strings.ToLower(vpa.Spec.TargetRef.Kind + "s"),
+	gvk := surgeBufferGroupVersionKind(recorder, vpa, workload, surgeBufferConfig)
+	gvr, err := workloadGVR(restMapper, gvk.GroupVersion().String(), gvk.Kind)
+	if err != nil {
+		return "Error", err
 	}
-
-	sbwObject, err := dynamicClient.Resource(gvr).Namespace(workloadNamespace.(string)).Get(ctx, surgeBufferWorkloadName, metav1.GetOptions{})
+	workloadLister, err := workloadListers.ForResource(ctx, gvr)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
+		log.Error("Error getting workload lister", "err", err, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		return "Error", fmt.Errorf("error getting workload lister: %v", err)
+	}
+	sbwObject, err := workloadLister.ByNamespace(workloadNamespace.(string)).Get(surgeBufferWorkloadName)
+	if err != nil {
+		if errors.IsNotFound(err) {
 			log.Debug("Surge buffer workload does not exist", "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
 			return "NotFound", nil
 		} else {
@@ -188,8 +546,17 @@ func GetSurgeBufferWorkloadStatus(ctx context.Context, dynamicClient dynamic.Int
 			return "Error", fmt.Errorf("error checking if surge buffer workload exists: %v", err)
 		}
 	}
+	sbwUnstructured, ok := sbwObject.(*unstructured.Unstructured)
+	if !ok {
+		return "Error", fmt.Errorf("error checking if surge buffer workload exists: unexpected object type %T", sbwObject)
+	}
+	// Never treat a workload that merely has the surge buffer's name as one, e.g. to delete it
+	if !isSurgeBufferWorkload(sbwUnstructured.UnstructuredContent()) {
+		log.Warn("Workload with the surge buffer's name is not a surge buffer, ignoring it", "SurgeBufferWorkloadName", surgeBufferWorkloadName, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace)
+		return "NotFound", nil
+	}
 	// Check if the surge buffer workload is healthy
-	healthy, err := workloadPodsAreHealthy(ctx, sbwObject.UnstructuredContent(), clientset)
+	healthy, err := workloadPodsAreHealthy(ctx, sbwUnstructured.UnstructuredContent(), podLister, 0)
 	if err != nil {
 		log.Error("Error checking workload pods health", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 		return "Error", err
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/yaml"
+)
+
+// Changes applied to the pod template of the surge buffer workloads, on top of the workload's own pod template.
+// They are set cluster-wide from a file, and per VPA from an annotation holding the same fields in JSON.
+type PodTemplateOverrides struct {
+	// Annotations added to the surge buffer pods, or removed from them
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	RemoveAnnotations []string          `json:"removeAnnotations,omitempty"`
+	// Labels added to the surge buffer pods, or removed from them. The workload's selector labels are never removed.
+	Labels       map[string]string `json:"labels,omitempty"`
+	RemoveLabels []string          `json:"removeLabels,omitempty"`
+	// Replaces the workload's priorityClassName
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// Merged into the workload's nodeSelector
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Added to the workload's tolerations
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Replaces the workload's affinity
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+}
+
+// Read the cluster-wide pod template overrides of the surge buffer workloads from a YAML or JSON file
+func LoadPodTemplateOverrides(path string) (PodTemplateOverrides, error) {
+	var overrides PodTemplateOverrides
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return overrides, fmt.Errorf("error reading surge buffer pod template overrides: %v", err)
+	}
+	if err := yaml.UnmarshalStrict(data, &overrides); err != nil {
+		return overrides, fmt.Errorf("error parsing surge buffer pod template overrides: %v", err)
+	}
+	return overrides, nil
+}
+
+// Get the pod template overrides of a VPA's surge buffer: the cluster-wide ones, with the VPA's annotation applied on top of them
+func surgeBufferPodTemplateOverrides(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, clusterOverrides PodTemplateOverrides) (PodTemplateOverrides, error) {
+	value := vpa.Annotations[utils.VPAAnnotationSurgeBufferPodTemplateOverrides]
+	if value == "" {
+		return clusterOverrides, nil
+	}
+	var vpaOverrides PodTemplateOverrides
+	if err := yaml.UnmarshalStrict([]byte(value), &vpaOverrides); err != nil {
+		slog.Default().Error("Error parsing surge buffer pod template overrides from VPA annotation", "err", err, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
+		recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationSurgeBufferPodTemplateOverrides, err)
+		return PodTemplateOverrides{}, fmt.Errorf("error parsing annotation %s: %v", utils.VPAAnnotationSurgeBufferPodTemplateOverrides, err)
+	}
+	return mergePodTemplateOverrides(clusterOverrides, vpaOverrides), nil
+}
+
+// Apply overrides on top of base ones: maps are merged and lists appended, while the override's priorityClassName and affinity win when they are set
+func mergePodTemplateOverrides(base, override PodTemplateOverrides) PodTemplateOverrides {
+	merged := PodTemplateOverrides{
+		Annotations:       mergeStringMaps(base.Annotations, override.Annotations),
+		RemoveAnnotations: append(slices.Clone(base.RemoveAnnotations), override.RemoveAnnotations...),
+		Labels:            mergeStringMaps(base.Labels, override.Labels),
+		RemoveLabels:      append(slices.Clone(base.RemoveLabels), override.RemoveLabels...),
+		PriorityClassName: base.PriorityClassName,
+		NodeSelector:      mergeStringMaps(base.NodeSelector, override.NodeSelector),
+		Tolerations:       append(slices.Clone(base.Tolerations), override.Tolerations...),
+		Affinity:          base.Affinity,
+	}
+	if override.PriorityClassName != "" {
+		merged.PriorityClassName = override.PriorityClassName
+	}
+	if override.Affinity != nil {
+		merged.Affinity = override.Affinity
+	}
+	// An annotation or label that is explicitly added is not removed
+	merged.RemoveAnnotations = slices.DeleteFunc(merged.RemoveAnnotations, func(key string) bool {
+		_, found := override.Annotations[key]
+		return found
+	})
+	merged.RemoveLabels = slices.DeleteFunc(merged.RemoveLabels, func(key string) bool {
+		_, found := override.Labels[key]
+		return found
+	})
+	return merged
+}
+
+func mergeStringMaps(base, override map[string]string) map[string]string {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = make(map[string]string, len(override))
+	}
+	maps.Copy(merged, override)
+	return merged
+}
+
+// Apply pod template overrides to the unstructured pod template of a surge buffer workload.
+// The selector labels and the surge buffer label are never removed or overridden, since the surge buffer and its pods are found by them.
+func applyPodTemplateOverrides(podTemplate map[string]interface{}, selectorLabels map[string]string, overrides PodTemplateOverrides) error {
+	log := slog.Default()
+
+	for _, key := range overrides.RemoveAnnotations {
+		unstructured.RemoveNestedField(podTemplate, "metadata", "annotations", key)
+	}
+	for key, value := range overrides.Annotations {
+		if err := unstructured.SetNestedField(podTemplate, value, "metadata", "annotations", key); err != nil {
+			return fmt.Errorf("error setting surge buffer pod annotation %s: %v", key, err)
+		}
+	}
+	for _, key := range overrides.RemoveLabels {
+		if _, isSelectorLabel := selectorLabels[key]; isSelectorLabel || key == utils.LabelSurgeBuffer {
+			log.Warn("Not removing a label the surge buffer pods are selected by", "Label", key)
+			continue
+		}
+		unstructured.RemoveNestedField(podTemplate, "metadata", "labels", key)
+	}
+	for key, value := range overrides.Labels {
+		if _, isSelectorLabel := selectorLabels[key]; isSelectorLabel || key == utils.LabelSurgeBuffer {
+			log.Warn("Not overriding a label the surge buffer pods are selected by", "Label", key)
+			continue
+		}
+		if err := unstructured.SetNestedField(podTemplate, value, "metadata", "labels", key); err != nil {
+			return fmt.Errorf("error setting surge buffer pod label %s: %v", key, err)
+		}
+	}
+
+	if overrides.PriorityClassName != "" {
+		if err := unstructured.SetNestedField(podTemplate, overrides.PriorityClassName, "spec", "priorityClassName"); err != nil {
+			return fmt.Errorf("error setting surge buffer priorityClassName: %v", err)
+		}
+		// The priority is resolved from the priorityClassName on admission, a copied value would conflict with it
+		unstructured.RemoveNestedField(podTemplate, "spec", "priority")
+	}
+	for key, value := range overrides.NodeSelector {
+		if err := unstructured.SetNestedField(podTemplate, value, "spec", "nodeSelector", key); err != nil {
+			return fmt.Errorf("error setting surge buffer nodeSelector %s: %v", key, err)
+		}
+	}
+	if len(overrides.Tolerations) > 0 {
+		tolerations, _, _ := unstructured.NestedSlice(podTemplate, "spec", "tolerations")
+		for i := range overrides.Tolerations {
+			toleration, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&overrides.Tolerations[i])
+			if err != nil {
+				return fmt.Errorf("error converting surge buffer toleration: %v", err)
+			}
+			tolerations = append(tolerations, toleration)
+		}
+		if err := unstructured.SetNestedSlice(podTemplate, tolerations, "spec", "tolerations"); err != nil {
+			return fmt.Errorf("error setting surge buffer tolerations: %v", err)
+		}
+	}
+	if overrides.Affinity != nil {
+		affinity, err := runtime.DefaultUnstructuredConverter.ToUnstructured(overrides.Affinity)
+		if err != nil {
+			return fmt.Errorf("error converting surge buffer affinity: %v", err)
+		}
+		if err := unstructured.SetNestedMap(podTemplate, affinity, "spec", "affinity"); err != nil {
+			return fmt.Errorf("error setting surge buffer affinity: %v", err)
+		}
+	}
+	return nil
+}
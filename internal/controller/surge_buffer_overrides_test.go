@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestSurgeBufferPodTemplateOverrides(t *testing.T) {
+	clusterOverrides := PodTemplateOverrides{
+		Annotations:       map[string]string{"karpenter.sh/do-not-disrupt": "true"},
+		RemoveAnnotations: []string{"prometheus.io/scrape"},
+		PriorityClassName: "surge-buffer",
+		Tolerations:       []corev1.Toleration{{Key: "burst", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}},
+	}
+
+	t.Run("Cluster-wide overrides are used without the annotation", func(t *testing.T) {
+		overrides, err := surgeBufferPodTemplateOverrides(record.NewFakeRecorder(10), testutil.CreateTestVPA(), clusterOverrides)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if overrides.PriorityClassName != "surge-buffer" || len(overrides.Tolerations) != 1 {
+			t.Errorf("expected the cluster-wide overrides, got: %+v", overrides)
+		}
+	})
+
+	t.Run("VPA overrides are applied on top of the cluster-wide ones", func(t *testing.T) {
+		vpa := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationSurgeBufferPodTemplateOverrides,
+			`{"priorityClassName": "critical", "annotations": {"prometheus.io/scrape": "false"}, "nodeSelector": {"pool": "burst"}}`))
+		overrides, err := surgeBufferPodTemplateOverrides(record.NewFakeRecorder(10), vpa, clusterOverrides)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if overrides.PriorityClassName != "critical" {
+			t.Errorf("expected the VPA's priorityClassName, got: %s", overrides.PriorityClassName)
+		}
+		if overrides.Annotations["karpenter.sh/do-not-disrupt"] != "true" || overrides.Annotations["prometheus.io/scrape"] != "false" {
+			t.Errorf("expected the annotations to be merged, got: %v", overrides.Annotations)
+		}
+		if len(overrides.RemoveAnnotations) != 0 {
+			t.Errorf("expected an annotation set by the VPA not to be removed, got: %v", overrides.RemoveAnnotations)
+		}
+		if overrides.NodeSelector["pool"] != "burst" || len(overrides.Tolerations) != 1 {
+			t.Errorf("expected the nodeSelector and the cluster-wide tolerations, got: %+v", overrides)
+		}
+	})
+
+	t.Run("Invalid annotation", func(t *testing.T) {
+		recorder := record.NewFakeRecorder(10)
+		vpa := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationSurgeBufferPodTemplateOverrides, `{"priorityClass": "critical"}`))
+		if _, err := surgeBufferPodTemplateOverrides(recorder, vpa, clusterOverrides); err == nil {
+			t.Errorf("expected an error for an unknown field")
+		}
+		if len(recorder.Events) != 1 {
+			t.Errorf("expected an %s event, got: %d events", EventReasonInvalidAnnotation, len(recorder.Events))
+		}
+	})
+}
+
+func TestApplyPodTemplateOverrides(t *testing.T) {
+	podTemplate := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{"app": "myapp", "team": "a", utils.LabelSurgeBuffer: "true"},
+			"annotations": map[string]interface{}{"prometheus.io/scrape": "true"},
+		},
+		"spec": map[string]interface{}{
+			"priority":     int64(1000),
+			"nodeSelector": map[string]interface{}{"kubernetes.io/os": "linux"},
+			"tolerations":  []interface{}{map[string]interface{}{"key": "dedicated", "operator": "Exists"}},
+		},
+	}
+	seconds := int64(60)
+	overrides := PodTemplateOverrides{
+		Annotations:       map[string]string{"karpenter.sh/do-not-disrupt": "true"},
+		RemoveAnnotations: []string{"prometheus.io/scrape"},
+		Labels:            map[string]string{"surge": "yes", "app": "other", utils.LabelSurgeBuffer: "false"},
+		RemoveLabels:      []string{"team", "app", utils.LabelSurgeBuffer},
+		PriorityClassName: "surge-buffer",
+		NodeSelector:      map[string]string{"pool": "burst"},
+		Tolerations:       []corev1.Toleration{{Key: "burst", Operator: corev1.TolerationOpExists, TolerationSeconds: &seconds}},
+		Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"burst"}}}}},
+		}}},
+	}
+
+	if err := applyPodTemplateOverrides(podTemplate, map[string]string{"app": "myapp"}, overrides); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	annotations, _, _ := unstructured.NestedStringMap(podTemplate, "metadata", "annotations")
+	if _, found := annotations["prometheus.io/scrape"]; found || annotations["karpenter.sh/do-not-disrupt"] != "true" {
+		t.Errorf("expected the annotations to be overridden, got: %v", annotations)
+	}
+	labels, _, _ := unstructured.NestedStringMap(podTemplate, "metadata", "labels")
+	if _, found := labels["team"]; found || labels["surge"] != "yes" {
+		t.Errorf("expected the labels to be overridden, got: %v", labels)
+	}
+	if labels["app"] != "myapp" || labels[utils.LabelSurgeBuffer] != "true" {
+		t.Errorf("expected the selector and surge buffer labels to be kept, got: %v", labels)
+	}
+	if priorityClassName, _, _ := unstructured.NestedString(podTemplate, "spec", "priorityClassName"); priorityClassName != "surge-buffer" {
+		t.Errorf("expected the priorityClassName to be set, got: %s", priorityClassName)
+	}
+	if _, found, _ := unstructured.NestedInt64(podTemplate, "spec", "priority"); found {
+		t.Errorf("expected the copied priority to be removed")
+	}
+	if nodeSelector, _, _ := unstructured.NestedStringMap(podTemplate, "spec", "nodeSelector"); len(nodeSelector) != 2 || nodeSelector["pool"] != "burst" {
+		t.Errorf("expected the nodeSelector to be merged, got: %v", nodeSelector)
+	}
+	tolerations, _, _ := unstructured.NestedSlice(podTemplate, "spec", "tolerations")
+	if len(tolerations) != 2 || tolerations[1].(map[string]interface{})["tolerationSeconds"] != int64(60) {
+		t.Errorf("expected the toleration to be added, got: %v", tolerations)
+	}
+	if _, found, _ := unstructured.NestedMap(podTemplate, "spec", "affinity", "nodeAffinity"); !found {
+		t.Errorf("expected the affinity to be set")
+	}
+}
@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Defaults of the rolling update parameters, as set by the API server when they are omitted
+var (
+	defaultDeploymentMaxSurge        = intstr.FromString("25%")
+	defaultDeploymentMaxUnavailable  = intstr.FromString("25%")
+	defaultStatefulSetMaxUnavailable = intstr.FromInt32(1)
+)
+
+// Get the number of surge buffer pods of a VPA's target workload, from the 'number-of-surge-buffer-pods' annotation.
+// With 'auto', it is derived from the workload's rolling update strategy.
+func surgeBufferReplicas(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}) (int, error) {
+	log := slog.Default()
+
+	surgeBufferReplicas := vpa.Annotations[utils.VPAAnnotationNumberOfSurgeBufferPods]
+	if surgeBufferReplicas == "" {
+		surgeBufferReplicas = utils.DefaultSurgeBufferReplicas
+	}
+	if surgeBufferReplicas == utils.SurgeBufferReplicasAuto {
+		return autoSurgeBufferReplicas(recorder, vpa, workload)
+	}
+
+	surgeBufferReplicasInt, err := strconv.Atoi(surgeBufferReplicas)
+	if err == nil && surgeBufferReplicasInt < 1 {
+		err = fmt.Errorf("must be at least 1 or %q", utils.SurgeBufferReplicasAuto)
+	}
+	if err != nil {
+		log.Error("Error parsing surge buffer replicas from VPA annotation", "err", err, "VPAName", vpa.Name, "VPANameSpace", vpa.Namespace)
+		recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationNumberOfSurgeBufferPods, err)
+		return 0, fmt.Errorf("error parsing surge buffer replicas from VPA annotation: %v", err)
+	}
+	return surgeBufferReplicasInt, nil
+}
+
+// Size the surge buffer after the workload's rolling update strategy, resolved against its current number of replicas:
+// the buffer covers both the extra pods the rollout surges (maxSurge) and the pods it takes down at once (maxUnavailable).
+func autoSurgeBufferReplicas(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}) (int, error) {
+	log := slog.Default()
+
+	kind := workload["kind"]
+	workloadName := (&unstructured.Unstructured{Object: workload}).GetName()
+	replicas := int(workloadReplicas(workload))
+
+	var maxSurge, maxUnavailable int
+	var err error
+	switch kind {
+	case "Deployment":
+		strategyType, _, _ := unstructured.NestedString(workload, "spec", "strategy", "type")
+		if strategyType == "Recreate" {
+			// Every pod is taken down before the new ones are created
+			return max(replicas, 1), nil
+		}
+		maxSurge, maxUnavailable, err = deploymentRollingUpdate(workload, replicas)
+		if err != nil {
+			return 0, err
+		}
+	case "StatefulSet":
+		// StatefulSets never surge, their pods are replaced at most maxUnavailable at a time
+		maxUnavailable, err = rollingUpdateParameter(workload, replicas, defaultStatefulSetMaxUnavailable, false, "spec", "updateStrategy", "rollingUpdate", "maxUnavailable")
+		if err != nil {
+			return 0, err
+		}
+	default:
+		log.Info("Workload kind has no rolling update strategy, using the default number of surge buffer pods", "WorkloadName", workloadName, "WorkloadKind", kind)
+		return strconv.Atoi(utils.DefaultSurgeBufferReplicas)
+	}
+
+	surgeBufferReplicas := max(maxSurge, maxUnavailable, 1)
+	log.Debug("Derived the number of surge buffer pods from the rolling update strategy", "WorkloadName", workloadName, "WorkloadKind", kind, "Replicas", replicas, "MaxSurge", maxSurge, "MaxUnavailable", maxUnavailable, "SurgeBufferReplicas", surgeBufferReplicas)
+	return surgeBufferReplicas, nil
+}
+
+// Resolve the maxSurge and maxUnavailable of a Deployment's rolling update against its number of replicas
+func deploymentRollingUpdate(workload map[string]interface{}, replicas int) (int, int, error) {
+	maxSurge, err := rollingUpdateParameter(workload, replicas, defaultDeploymentMaxSurge, true, "spec", "strategy", "rollingUpdate", "maxSurge")
+	if err != nil {
+		return 0, 0, err
+	}
+	maxUnavailable, err := rollingUpdateParameter(workload, replicas, defaultDeploymentMaxUnavailable, false, "spec", "strategy", "rollingUpdate", "maxUnavailable")
+	if err != nil {
+		return 0, 0, err
+	}
+	// As for the Deployment controller, a rollout always makes progress
+	if maxSurge == 0 && maxUnavailable == 0 {
+		maxUnavailable = 1
+	}
+	return maxSurge, maxUnavailable, nil
+}
+
+// Report a Deployment with a maxSurge of 0 whose surge buffer is sized after its rolling update strategy with a Warning Event,
+// since its rollout can only take pods down. It is recorded when the surge buffer is created, rather than each time it is built.
+func recordZeroMaxSurgeEvent(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}) {
+	if cmp.Or(vpa.Annotations[utils.VPAAnnotationNumberOfSurgeBufferPods], utils.DefaultSurgeBufferReplicas) != utils.SurgeBufferReplicasAuto || workload["kind"] != "Deployment" {
+		return
+	}
+	if strategyType, _, _ := unstructured.NestedString(workload, "spec", "strategy", "type"); strategyType == "Recreate" {
+		return
+	}
+	maxSurge, maxUnavailable, err := deploymentRollingUpdate(workload, int(workloadReplicas(workload)))
+	if err != nil || maxSurge != 0 {
+		return
+	}
+	workloadName := (&unstructured.Unstructured{Object: workload}).GetName()
+	slog.Default().Warn("Workload has a maxSurge of 0, its rollout takes pods down before replacing them", "WorkloadName", workloadName, "WorkloadKind", workload["kind"], "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "MaxUnavailable", maxUnavailable)
+	recordEvent(recorder, vpa, workload, corev1.EventTypeWarning, EventReasonZeroMaxSurge, "%s %s has a maxSurge of 0, its rollout takes up to %d pods down before replacing them", workload["kind"], workloadName, maxUnavailable)
+}
+
+// Resolve an int-or-percent rolling update parameter against the number of replicas, e.g. maxSurge or maxUnavailable
+func rollingUpdateParameter(workload map[string]interface{}, replicas int, defaultValue intstr.IntOrString, roundUp bool, fields ...string) (int, error) {
+	value := defaultValue
+	rawValue, found, _ := unstructured.NestedFieldNoCopy(workload, fields...)
+	if found {
+		switch typedValue := rawValue.(type) {
+		case int64:
+			value = intstr.FromInt(int(typedValue))
+		case string:
+			value = intstr.FromString(typedValue)
+		default:
+			return 0, fmt.Errorf("error reading %s of workload: unexpected type %T", fields[len(fields)-1], rawValue)
+		}
+	}
+	resolved, err := intstr.GetScaledValueFromIntOrPercent(&value, replicas, roundUp)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s of workload: %v", fields[len(fields)-1], err)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestSurgeBufferReplicas(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotation      string
+		kind            string
+		replicas        int64
+		strategy        map[string]interface{}
+		expectReplicas  int
+		expectError     bool
+		expectZeroSurge bool
+	}{
+		{
+			name:           "Default is 1",
+			kind:           "Deployment",
+			replicas:       10,
+			expectReplicas: 1,
+		},
+		{
+			name:           "Explicit number",
+			annotation:     "3",
+			kind:           "Deployment",
+			replicas:       10,
+			expectReplicas: 3,
+		},
+		{
+			name:        "Invalid number",
+			annotation:  "0",
+			kind:        "Deployment",
+			replicas:    10,
+			expectError: true,
+		},
+		{
+			name:           "Auto uses the Deployment defaults of 25%",
+			annotation:     "auto",
+			kind:           "Deployment",
+			replicas:       10,
+			expectReplicas: 3, // maxSurge rounds up to 3, maxUnavailable rounds down to 2
+		},
+		{
+			name:       "Auto with an integer maxSurge",
+			annotation: "auto",
+			kind:       "Deployment",
+			replicas:   10,
+			strategy: map[string]interface{}{
+				"strategy": map[string]interface{}{"rollingUpdate": map[string]interface{}{"maxSurge": int64(4), "maxUnavailable": int64(0)}},
+			},
+			expectReplicas: 4,
+		},
+		{
+			name:       "Auto flags a maxSurge of 0",
+			annotation: "auto",
+			kind:       "Deployment",
+			replicas:   10,
+			strategy: map[string]interface{}{
+				"strategy": map[string]interface{}{"rollingUpdate": map[string]interface{}{"maxSurge": "0%", "maxUnavailable": "20%"}},
+			},
+			expectReplicas:  2,
+			expectZeroSurge: true,
+		},
+		{
+			name:       "Auto with a Recreate strategy covers every replica",
+			annotation: "auto",
+			kind:       "Deployment",
+			replicas:   5,
+			strategy: map[string]interface{}{
+				"strategy": map[string]interface{}{"type": "Recreate"},
+			},
+			expectReplicas: 5,
+		},
+		{
+			name:           "Auto uses the StatefulSet default of 1",
+			annotation:     "auto",
+			kind:           "StatefulSet",
+			replicas:       10,
+			expectReplicas: 1,
+		},
+		{
+			name:       "Auto with a StatefulSet maxUnavailable percentage",
+			annotation: "auto",
+			kind:       "StatefulSet",
+			replicas:   10,
+			strategy: map[string]interface{}{
+				"updateStrategy": map[string]interface{}{"rollingUpdate": map[string]interface{}{"maxUnavailable": "30%"}},
+			},
+			expectReplicas: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			vpa := testutil.CreateTestVPA()
+			if tt.annotation != "" {
+				vpa = testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationNumberOfSurgeBufferPods, tt.annotation))
+			}
+			workload := testutil.CreateTestWorkload("test-workload", "default", "")
+			workload["kind"] = tt.kind
+			workload["spec"].(map[string]interface{})["replicas"] = tt.replicas
+			for field, value := range tt.strategy {
+				workload["spec"].(map[string]interface{})[field] = value
+			}
+
+			replicas, err := surgeBufferReplicas(recorder, vpa, workload)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if replicas != tt.expectReplicas {
+				t.Errorf("expected %d surge buffer replicas, got: %d", tt.expectReplicas, replicas)
+			}
+			// The surge buffer is built on every reconciliation, the Warning is only recorded when it is created
+			if len(recorder.Events) > 0 {
+				t.Errorf("expected no event while building the surge buffer, got: %s", <-recorder.Events)
+			}
+			recordZeroMaxSurgeEvent(recorder, vpa, workload)
+			var zeroSurgeEvents int
+			for len(recorder.Events) > 0 {
+				if strings.HasPrefix(<-recorder.Events, "Warning "+EventReasonZeroMaxSurge) {
+					zeroSurgeEvents++
+				}
+			}
+			if (zeroSurgeEvents > 0) != tt.expectZeroSurge {
+				t.Errorf("expected a %s event: %v, got %d", EventReasonZeroMaxSurge, tt.expectZeroSurge, zeroSurgeEvents)
+			}
+		})
+	}
+}
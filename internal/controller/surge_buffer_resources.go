@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	vpa_api_util "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/vpa"
+)
+
+// Resources controlled by a VPA when its container policy does not list them
+var defaultControlledResources = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+
+// Compute the resources the VPA admission controller gives a container for a recommendation, following the VPA's container policy:
+// - containers whose policy mode is 'Off' keep their resources
+// - only the 'controlledResources' (cpu and memory by default) are changed
+// - requests are set to the recommendation, and limits are scaled to keep their ratio to the requests, unless 'controlledValues' is 'RequestsOnly'
+// Containers without limits get the defaultLimits of the namespace's LimitRange scaled instead.
+// It returns false if the container's resources are not changed.
+func containerResourcesForRecommendation(containerName string, original corev1.ResourceRequirements, recommendation corev1.ResourceList, resourcePolicy *v1.PodResourcePolicy, defaultLimits corev1.ResourceList) (corev1.ResourceRequirements, bool) {
+	containerPolicy := vpa_api_util.GetContainerResourcePolicy(containerName, resourcePolicy)
+	if containerPolicy != nil && containerPolicy.Mode != nil && *containerPolicy.Mode == v1.ContainerScalingModeOff {
+		return original, false
+	}
+	controlledResources := defaultControlledResources
+	if containerPolicy != nil && containerPolicy.ControlledResources != nil {
+		controlledResources = *containerPolicy.ControlledResources
+	}
+	controlledRecommendation := corev1.ResourceList{}
+	for _, resourceName := range controlledResources {
+		if quantity, found := recommendation[resourceName]; found {
+			controlledRecommendation[resourceName] = quantity
+		}
+	}
+	if len(controlledRecommendation) == 0 {
+		return original, false
+	}
+
+	resources := *original.DeepCopy()
+	if resources.Requests == nil {
+		resources.Requests = corev1.ResourceList{}
+	}
+	for resourceName, quantity := range controlledRecommendation {
+		resources.Requests[resourceName] = quantity
+	}
+	if vpa_api_util.GetContainerControlledValues(containerName, resourcePolicy) == v1.ContainerControlledValuesRequestsAndLimits {
+		proportionalLimits, _ := vpa_api_util.GetProportionalLimit(original.Limits, original.Requests, controlledRecommendation, defaultLimits)
+		for resourceName, quantity := range proportionalLimits {
+			if resources.Limits == nil {
+				resources.Limits = corev1.ResourceList{}
+			}
+			resources.Limits[resourceName] = quantity
+		}
+	}
+	return resources, true
+}
+
+// Set the resources of an unstructured container as the VPA admission controller would for a recommendation, see containerResourcesForRecommendation.
+// Containers without a resources, requests or limits field are handled like empty ones.
+func setContainerResourcesForRecommendation(container map[string]interface{}, recommendation corev1.ResourceList, resourcePolicy *v1.PodResourcePolicy, defaultLimits corev1.ResourceList) (corev1.ResourceRequirements, error) {
+	containerName, _ := container["name"].(string)
+	var original corev1.ResourceRequirements
+	if rawResources, found := container["resources"].(map[string]interface{}); found {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawResources, &original); err != nil {
+			return original, fmt.Errorf("error reading the resources of container %s: %v", containerName, err)
+		}
+	}
+	resources, changed := containerResourcesForRecommendation(containerName, original, recommendation, resourcePolicy, defaultLimits)
+	if !changed {
+		return resources, nil
+	}
+	rawResources, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&resources)
+	if err != nil {
+		return resources, fmt.Errorf("error setting the resources of container %s: %v", containerName, err)
+	}
+	container["resources"] = rawResources
+	return resources, nil
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+)
+
+func TestContainerResourcesForRecommendation(t *testing.T) {
+	requestsOnly := v1.ContainerControlledValuesRequestsOnly
+	scalingOff := v1.ContainerScalingModeOff
+	cpuOnly := []corev1.ResourceName{corev1.ResourceCPU}
+	original := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("128Mi")},
+		Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m"), corev1.ResourceMemory: resource.MustParse("128Mi")},
+	}
+	recommendation := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("300m"), corev1.ResourceMemory: resource.MustParse("256Mi")}
+
+	tests := []struct {
+		name           string
+		policy         *v1.PodResourcePolicy
+		expectChanged  bool
+		expectRequests map[corev1.ResourceName]string
+		expectLimits   map[corev1.ResourceName]string
+	}{
+		{
+			name:           "Limits are scaled proportionally by default",
+			policy:         nil,
+			expectChanged:  true,
+			expectRequests: map[corev1.ResourceName]string{corev1.ResourceCPU: "300m", corev1.ResourceMemory: "256Mi"},
+			expectLimits:   map[corev1.ResourceName]string{corev1.ResourceCPU: "600m", corev1.ResourceMemory: "256Mi"},
+		},
+		{
+			name:           "Limits are kept with RequestsOnly",
+			policy:         &v1.PodResourcePolicy{ContainerPolicies: []v1.ContainerResourcePolicy{{ContainerName: "app", ControlledValues: &requestsOnly}}},
+			expectChanged:  true,
+			expectRequests: map[corev1.ResourceName]string{corev1.ResourceCPU: "300m", corev1.ResourceMemory: "256Mi"},
+			expectLimits:   map[corev1.ResourceName]string{corev1.ResourceCPU: "200m", corev1.ResourceMemory: "128Mi"},
+		},
+		{
+			name:           "Only the controlled resources are changed",
+			policy:         &v1.PodResourcePolicy{ContainerPolicies: []v1.ContainerResourcePolicy{{ContainerName: "*", ControlledResources: &cpuOnly}}},
+			expectChanged:  true,
+			expectRequests: map[corev1.ResourceName]string{corev1.ResourceCPU: "300m", corev1.ResourceMemory: "128Mi"},
+			expectLimits:   map[corev1.ResourceName]string{corev1.ResourceCPU: "600m", corev1.ResourceMemory: "128Mi"},
+		},
+		{
+			name:           "Containers with scaling mode Off are left alone",
+			policy:         &v1.PodResourcePolicy{ContainerPolicies: []v1.ContainerResourcePolicy{{ContainerName: "app", Mode: &scalingOff}}},
+			expectChanged:  false,
+			expectRequests: map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "128Mi"},
+			expectLimits:   map[corev1.ResourceName]string{corev1.ResourceCPU: "200m", corev1.ResourceMemory: "128Mi"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources, changed := containerResourcesForRecommendation("app", original, recommendation, tt.policy, nil)
+			if changed != tt.expectChanged {
+				t.Errorf("expected changed to be %v, got: %v", tt.expectChanged, changed)
+			}
+			for resourceName, expected := range tt.expectRequests {
+				if quantity := resources.Requests[resourceName]; quantity.Cmp(resource.MustParse(expected)) != 0 {
+					t.Errorf("expected %s request %s, got: %s", resourceName, expected, quantity.String())
+				}
+			}
+			for resourceName, expected := range tt.expectLimits {
+				if quantity := resources.Limits[resourceName]; quantity.Cmp(resource.MustParse(expected)) != 0 {
+					t.Errorf("expected %s limit %s, got: %s", resourceName, expected, quantity.String())
+				}
+			}
+		})
+	}
+}
+
+func TestSetContainerResourcesForRecommendation(t *testing.T) {
+	recommendation := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("300m"), corev1.ResourceMemory: resource.MustParse("256Mi")}
+
+	t.Run("Container without resources", func(t *testing.T) {
+		container := map[string]interface{}{"name": "app"}
+		if _, err := setContainerResourcesForRecommendation(container, recommendation, nil, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cpu, _, _ := unstructured.NestedString(container, "resources", "requests", "cpu")
+		if cpu != "300m" {
+			t.Errorf("expected a CPU request of 300m, got: %q", cpu)
+		}
+		if _, found, _ := unstructured.NestedMap(container, "resources", "limits"); found {
+			t.Errorf("expected no limits to be set")
+		}
+	})
+
+	t.Run("Container with limits only", func(t *testing.T) {
+		container := map[string]interface{}{
+			"name":      "app",
+			"resources": map[string]interface{}{"limits": map[string]interface{}{"memory": "128Mi"}},
+		}
+		if _, err := setContainerResourcesForRecommendation(container, recommendation, nil, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		memoryLimit, _, _ := unstructured.NestedString(container, "resources", "limits", "memory")
+		if memoryLimit != "256Mi" {
+			t.Errorf("expected the memory limit to follow the request, got: %q", memoryLimit)
+		}
+	})
+}
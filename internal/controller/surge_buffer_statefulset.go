@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+)
+
+var persistentVolumeClaimsGVR = schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}
+
+// Get how the surge buffer of a StatefulSet is built, from the VPA annotation or the cluster-wide default.
+// An invalid annotation is reported with an Event, and the default is used instead.
+func surgeBufferStatefulSetMode(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, defaultMode string) string {
+	mode := vpa.Annotations[utils.VPAAnnotationSurgeBufferStatefulSetMode]
+	switch mode {
+	case "":
+		return defaultMode
+	case utils.SurgeBufferStatefulSetModeStatefulSet, utils.SurgeBufferStatefulSetModeEphemeral, utils.SurgeBufferStatefulSetModeDeployment:
+		return mode
+	default:
+		slog.Default().Error("Invalid surge buffer StatefulSet mode, using the default", "Name", vpa.Name, "Namespace", vpa.Namespace, "Mode", mode, "DefaultMode", defaultMode)
+		recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationSurgeBufferStatefulSetMode, fmt.Errorf("must be one of %s, %s or %s", utils.SurgeBufferStatefulSetModeStatefulSet, utils.SurgeBufferStatefulSetModeEphemeral, utils.SurgeBufferStatefulSetModeDeployment))
+		return defaultMode
+	}
+}
+
+// Get the kind of the surge buffer workload of a workload, which is the workload's own kind unless a StatefulSet is converted to a Deployment
+func surgeBufferGroupVersionKind(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, surgeBufferConfig SurgeBufferConfig) schema.GroupVersionKind {
+	gvk := (&unstructured.Unstructured{Object: workload}).GroupVersionKind()
+	if gvk.Kind == "StatefulSet" && surgeBufferStatefulSetMode(recorder, vpa, surgeBufferConfig.StatefulSetMode) == utils.SurgeBufferStatefulSetModeDeployment {
+		return schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	}
+	return gvk
+}
+
+// Adapt the copy of a StatefulSet into its surge buffer, depending on the mode:
+// - 'statefulset' keeps the volumeClaimTemplates, and has their PVCs deleted along with the surge buffer
+// - 'ephemeral' replaces the volumeClaimTemplates with ephemeral volumes, which are deleted along with the pods
+// - 'deployment' does the same, and converts the surge buffer to a Deployment so that its pods have no ordinal identity
+// A non-empty serviceName replaces the StatefulSet's governing service.
+func buildStatefulSetSurgeBuffer(surgeBuffer map[string]interface{}, mode, serviceName string) {
+	spec := surgeBuffer["spec"].(map[string]interface{})
+	if serviceName != "" {
+		spec["serviceName"] = serviceName
+	}
+
+	claimTemplates, _, _ := unstructured.NestedSlice(spec, "volumeClaimTemplates")
+	if mode == utils.SurgeBufferStatefulSetModeStatefulSet {
+		// Supported since Kubernetes 1.27, PVCs are also deleted explicitly when the surge buffer is deleted
+		spec["persistentVolumeClaimRetentionPolicy"] = map[string]interface{}{
+			"whenDeleted": "Delete",
+			"whenScaled":  "Delete",
+		}
+		// The StatefulSet controller copies the labels of the volumeClaimTemplates to the PVCs, so that they can be listed by label
+		for _, claimTemplate := range claimTemplates {
+			if claimTemplate, ok := claimTemplate.(map[string]interface{}); ok {
+				_ = unstructured.SetNestedField(claimTemplate, "true", "metadata", "labels", utils.LabelSurgeBuffer)
+			}
+		}
+		if len(claimTemplates) > 0 {
+			spec["volumeClaimTemplates"] = claimTemplates
+		}
+		return
+	}
+
+	if len(claimTemplates) > 0 {
+		podSpec := spec["template"].(map[string]interface{})["spec"].(map[string]interface{})
+		volumes, _, _ := unstructured.NestedSlice(podSpec, "volumes")
+		podSpec["volumes"] = append(volumes, ephemeralVolumesFromClaimTemplates(claimTemplates)...)
+	}
+	delete(spec, "volumeClaimTemplates")
+	delete(spec, "persistentVolumeClaimRetentionPolicy")
+
+	if mode == utils.SurgeBufferStatefulSetModeDeployment {
+		deploymentSpec := map[string]interface{}{
+			"replicas": spec["replicas"],
+			"selector": spec["selector"],
+			"template": spec["template"],
+		}
+		for _, field := range []string{"minReadySeconds", "revisionHistoryLimit"} {
+			if value, found := spec[field]; found {
+				deploymentSpec[field] = value
+			}
+		}
+		surgeBuffer["apiVersion"] = "apps/v1"
+		surgeBuffer["kind"] = "Deployment"
+		surgeBuffer["spec"] = deploymentSpec
+	}
+}
+
+// Build one ephemeral volume per volumeClaimTemplate, with the same name so that the containers' volumeMounts still match
+func ephemeralVolumesFromClaimTemplates(claimTemplates []interface{}) []interface{} {
+	volumes := make([]interface{}, 0, len(claimTemplates))
+	for _, claimTemplate := range claimTemplates {
+		claimTemplate, ok := claimTemplate.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(claimTemplate, "metadata", "name")
+		claimSpec, _, _ := unstructured.NestedMap(claimTemplate, "spec")
+		ephemeralClaimTemplate := map[string]interface{}{"spec": claimSpec}
+		// Only labels and annotations are allowed in the metadata of an ephemeral volume's claim template
+		claimMetadata := map[string]interface{}{}
+		for _, field := range []string{"labels", "annotations"} {
+			if value, found, _ := unstructured.NestedMap(claimTemplate, "metadata", field); found {
+				claimMetadata[field] = value
+			}
+		}
+		if len(claimMetadata) > 0 {
+			ephemeralClaimTemplate["metadata"] = claimMetadata
+		}
+		volumes = append(volumes, map[string]interface{}{
+			"name":      name,
+			"ephemeral": map[string]interface{}{"volumeClaimTemplate": ephemeralClaimTemplate},
+		})
+	}
+	return volumes
+}
+
+// Get the names of the volumeClaimTemplates of a StatefulSet, or nil for other workloads
+func volumeClaimTemplateNames(workload map[string]interface{}) []string {
+	if workload["kind"] != "StatefulSet" {
+		return nil
+	}
+	claimTemplates, _, _ := unstructured.NestedSlice(workload, "spec", "volumeClaimTemplates")
+	names := make([]string, 0, len(claimTemplates))
+	for _, claimTemplate := range claimTemplates {
+		if claimTemplate, ok := claimTemplate.(map[string]interface{}); ok {
+			if name, _, _ := unstructured.NestedString(claimTemplate, "metadata", "name"); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// Delete the PVCs created for the pods of a StatefulSet surge buffer, labeled as surge buffer PVCs and named '<volumeClaimTemplate>-<surge buffer>-<ordinal>'.
+// PVCs of surge buffers created before their volumeClaimTemplates were labeled are left to the retention policy.
+// It returns the number of PVCs deleted.
+func deleteSurgeBufferPVCs(ctx context.Context, dynamicClient dynamic.Interface, namespace, surgeBufferName string, claimTemplateNames []string) (int, error) {
+	log := slog.Default()
+	if len(claimTemplateNames) == 0 {
+		return 0, nil
+	}
+
+	pvcs, err := dynamicClient.Resource(persistentVolumeClaimsGVR).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{utils.LabelSurgeBuffer: "true"}).String()})
+	if err != nil {
+		log.Error("Error listing PVCs of surge buffer workload", "err", err, "SurgeBufferWorkloadName", surgeBufferName, "Namespace", namespace)
+		metrics.APIErrors.WithLabelValues(metrics.OperationDeleteSurgeBufferPVC).Inc()
+		return 0, fmt.Errorf("error listing PVCs of surge buffer workload %s: %v", surgeBufferName, err)
+	}
+	deleted := 0
+	for _, pvc := range pvcs.Items {
+		if !isSurgeBufferPVC(pvc.GetName(), surgeBufferName, claimTemplateNames) {
+			continue
+		}
+		err := dynamicClient.Resource(persistentVolumeClaimsGVR).Namespace(namespace).Delete(ctx, pvc.GetName(), metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			log.Error("Error deleting PVC of surge buffer workload", "err", err, "PVCName", pvc.GetName(), "SurgeBufferWorkloadName", surgeBufferName, "Namespace", namespace)
+			metrics.APIErrors.WithLabelValues(metrics.OperationDeleteSurgeBufferPVC).Inc()
+			return deleted, fmt.Errorf("error deleting PVC %s of surge buffer workload %s: %v", pvc.GetName(), surgeBufferName, err)
+		}
+		log.Info("Deleted PVC of surge buffer workload", "PVCName", pvc.GetName(), "SurgeBufferWorkloadName", surgeBufferName, "Namespace", namespace)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Check if a PVC was created by the StatefulSet controller for a surge buffer pod
+func isSurgeBufferPVC(pvcName, surgeBufferName string, claimTemplateNames []string) bool {
+	for _, claimTemplateName := range claimTemplateNames {
+		ordinal, found := strings.CutPrefix(pvcName, claimTemplateName+"-"+surgeBufferName+"-")
+		if !found {
+			continue
+		}
+		if _, err := strconv.ParseUint(ordinal, 10, 32); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func testStatefulSet() map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "StatefulSet",
+		"metadata":   map[string]interface{}{"name": "test-statefulset-surge-buffer", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"replicas":            int64(1),
+			"serviceName":         "test-statefulset-headless",
+			"podManagementPolicy": "Parallel",
+			"minReadySeconds":     int64(10),
+			"selector":            map[string]interface{}{"matchLabels": map[string]interface{}{"app": "myapp"}},
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "myapp"}},
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":         "app",
+							"volumeMounts": []interface{}{map[string]interface{}{"name": "data", "mountPath": "/data"}},
+						},
+					},
+				},
+			},
+			"volumeClaimTemplates": []interface{}{
+				map[string]interface{}{
+					"metadata": map[string]interface{}{"name": "data", "labels": map[string]interface{}{"app": "myapp"}},
+					"spec": map[string]interface{}{
+						"accessModes": []interface{}{"ReadWriteOnce"},
+						"resources":   map[string]interface{}{"requests": map[string]interface{}{"storage": "1Gi"}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestBuildStatefulSetSurgeBuffer(t *testing.T) {
+	t.Run("StatefulSet mode keeps the volumeClaimTemplates and deletes their PVCs", func(t *testing.T) {
+		surgeBuffer := testStatefulSet()
+		buildStatefulSetSurgeBuffer(surgeBuffer, utils.SurgeBufferStatefulSetModeStatefulSet, "")
+		if names := volumeClaimTemplateNames(surgeBuffer); len(names) != 1 || names[0] != "data" {
+			t.Errorf("expected the volumeClaimTemplates to be kept, got: %v", names)
+		}
+		whenDeleted, _, _ := unstructured.NestedString(surgeBuffer, "spec", "persistentVolumeClaimRetentionPolicy", "whenDeleted")
+		if whenDeleted != "Delete" {
+			t.Errorf("expected the PVCs to be deleted with the surge buffer, got: %q", whenDeleted)
+		}
+		claimTemplates, _, _ := unstructured.NestedSlice(surgeBuffer, "spec", "volumeClaimTemplates")
+		claimLabels, _, _ := unstructured.NestedStringMap(claimTemplates[0].(map[string]interface{}), "metadata", "labels")
+		if claimLabels[utils.LabelSurgeBuffer] != "true" || claimLabels["app"] != "myapp" {
+			t.Errorf("expected the volumeClaimTemplates to be labeled as surge buffer PVCs, got: %v", claimLabels)
+		}
+	})
+
+	t.Run("Ephemeral mode replaces the volumeClaimTemplates with ephemeral volumes", func(t *testing.T) {
+		surgeBuffer := testStatefulSet()
+		buildStatefulSetSurgeBuffer(surgeBuffer, utils.SurgeBufferStatefulSetModeEphemeral, "test-surge-buffer-headless")
+		if surgeBuffer["kind"] != "StatefulSet" {
+			t.Errorf("expected a StatefulSet, got: %v", surgeBuffer["kind"])
+		}
+		if _, found, _ := unstructured.NestedSlice(surgeBuffer, "spec", "volumeClaimTemplates"); found {
+			t.Errorf("expected the volumeClaimTemplates to be removed")
+		}
+		volumes, _, _ := unstructured.NestedSlice(surgeBuffer, "spec", "template", "spec", "volumes")
+		if len(volumes) != 1 {
+			t.Fatalf("expected 1 volume, got: %v", volumes)
+		}
+		storage, _, _ := unstructured.NestedString(volumes[0].(map[string]interface{}), "ephemeral", "volumeClaimTemplate", "spec", "resources", "requests", "storage")
+		if volumes[0].(map[string]interface{})["name"] != "data" || storage != "1Gi" {
+			t.Errorf("expected an ephemeral 'data' volume of 1Gi, got: %v", volumes[0])
+		}
+		if serviceName, _, _ := unstructured.NestedString(surgeBuffer, "spec", "serviceName"); serviceName != "test-surge-buffer-headless" {
+			t.Errorf("expected the service name to be overridden, got: %s", serviceName)
+		}
+	})
+
+	t.Run("Deployment mode converts the surge buffer to a Deployment", func(t *testing.T) {
+		surgeBuffer := testStatefulSet()
+		buildStatefulSetSurgeBuffer(surgeBuffer, utils.SurgeBufferStatefulSetModeDeployment, "")
+		if surgeBuffer["kind"] != "Deployment" || surgeBuffer["apiVersion"] != "apps/v1" {
+			t.Errorf("expected an apps/v1 Deployment, got: %v %v", surgeBuffer["apiVersion"], surgeBuffer["kind"])
+		}
+		spec := surgeBuffer["spec"].(map[string]interface{})
+		for _, field := range []string{"serviceName", "podManagementPolicy", "volumeClaimTemplates"} {
+			if _, found := spec[field]; found {
+				t.Errorf("expected the StatefulSet field %s to be removed", field)
+			}
+		}
+		if spec["minReadySeconds"] != int64(10) || spec["replicas"] != int64(1) {
+			t.Errorf("expected minReadySeconds and replicas to be kept, got: %v", spec)
+		}
+		volumes, _, _ := unstructured.NestedSlice(surgeBuffer, "spec", "template", "spec", "volumes")
+		if len(volumes) != 1 {
+			t.Errorf("expected 1 ephemeral volume, got: %v", volumes)
+		}
+	})
+}
+
+func TestDeleteSurgeBufferPVCs(t *testing.T) {
+	ctx := context.Background()
+	pvc := func(name string, surgeBuffer bool) runtime.Object {
+		pvcLabels := map[string]interface{}{"app": "myapp"}
+		if surgeBuffer {
+			pvcLabels[utils.LabelSurgeBuffer] = "true"
+		}
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "PersistentVolumeClaim",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "default", "labels": pvcLabels},
+		}}
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{persistentVolumeClaimsGVR: "PersistentVolumeClaimList"},
+		pvc("data-test-statefulset-surge-buffer-0", true),
+		pvc("data-test-statefulset-surge-buffer-1", true),
+		pvc("data-test-statefulset-0", false),
+		pvc("data-test-statefulset-surge-buffer-backup", true),
+		// Not labeled as a surge buffer PVC, e.g. created by hand
+		pvc("data-test-statefulset-surge-buffer-2", false),
+	)
+
+	deleted, err := deleteSurgeBufferPVCs(ctx, dynamicClient, "default", "test-statefulset-surge-buffer", []string{"data"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 PVCs to be deleted, got: %d", deleted)
+	}
+	remaining, err := dynamicClient.Resource(persistentVolumeClaimsGVR).Namespace("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(remaining.Items) != 3 {
+		t.Errorf("expected the workload's PVCs to be kept, got: %d PVCs", len(remaining.Items))
+	}
+}
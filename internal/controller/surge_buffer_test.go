@@ -0,0 +1,301 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestSurgeBufferWorkloadName(t *testing.T) {
+	// Short names are kept readable
+	if name := surgeBufferWorkloadName("my-deployment"); name != "my-deployment-surge-buffer" {
+		t.Errorf("expected my-deployment-surge-buffer, got: %s", name)
+	}
+
+	// Long names are truncated to 63 characters, and stay unique
+	longName := strings.Repeat("a", 60) + "-first"
+	otherLongName := strings.Repeat("a", 60) + "-second"
+	name := surgeBufferWorkloadName(longName)
+	otherName := surgeBufferWorkloadName(otherLongName)
+	if len(name) > 63 || len(otherName) > 63 {
+		t.Errorf("expected names of at most 63 characters, got: %d and %d", len(name), len(otherName))
+	}
+	if !strings.HasSuffix(name, "-surge-buffer") {
+		t.Errorf("expected the name to end with -surge-buffer, got: %s", name)
+	}
+	if name == otherName {
+		t.Errorf("expected different names for different workloads, got: %s", name)
+	}
+	if surgeBufferWorkloadName(longName) != name {
+		t.Errorf("expected the name to be stable")
+	}
+}
+
+func TestEnsureSurgeBufferWorkload(t *testing.T) {
+	ctx := context.Background()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	vpa := testutil.CreateTestVPA(
+		testutil.WithStatus(
+			testutil.WithRecommendation(
+				testutil.WithTargetCPU(resource.MustParse("200m")),
+				testutil.WithTargetMemory(resource.MustParse("256Mi")),
+			),
+		),
+	)
+	vpa.UID = types.UID("vpa-uid")
+	workload := testutil.CreateTestWorkload("test-deployment", "default", "")
+	workload["metadata"].(map[string]interface{})["uid"] = "workload-uid"
+	workload["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "myapp"}},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{
+					"name": "container-0",
+					"resources": map[string]interface{}{
+						"requests": map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+						"limits":   map[string]interface{}{"memory": "128Mi"},
+					},
+				},
+			},
+		},
+	}
+
+	changed, err := EnsureSurgeBufferWorkload(ctx, dynamicClient, testutil.CreateTestRESTMapper(), &testutil.FakeWorkloadListers{}, limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), vpa, workload, SurgeBufferConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !changed {
+		t.Errorf("expected the surge buffer to be reported as changed")
+	}
+	surgeBuffer, err := dynamicClient.Resource(schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}).Namespace("default").Get(ctx, "test-deployment-surge-buffer", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the surge buffer to be created, got: %v", err)
+	}
+	if !isSurgeBufferWorkload(surgeBuffer.Object) {
+		t.Errorf("expected the surge buffer to have the %s label", utils.LabelSurgeBuffer)
+	}
+	if surgeBuffer.GetLabels()[utils.LabelSurgeBufferVPAUID] != "vpa-uid" || surgeBuffer.GetLabels()[utils.LabelSurgeBufferSourceWorkloadUID] != "workload-uid" {
+		t.Errorf("expected the surge buffer to be labeled with the VPA and source workload UIDs, got: %v", surgeBuffer.GetLabels())
+	}
+	ownerReferences := surgeBuffer.GetOwnerReferences()
+	if len(ownerReferences) != 1 || ownerReferences[0].Kind != "VerticalPodAutoscaler" || ownerReferences[0].Name != vpa.Name || ownerReferences[0].UID != vpa.UID {
+		t.Errorf("expected the surge buffer to be owned by the VPA, got: %v", ownerReferences)
+	}
+
+	t.Run("Up to date surge buffer is left as is", func(t *testing.T) {
+		dynamicClient.ClearActions()
+		workloadListers := &testutil.FakeWorkloadListers{Workloads: []map[string]interface{}{surgeBuffer.Object}}
+		changed, err := EnsureSurgeBufferWorkload(ctx, dynamicClient, testutil.CreateTestRESTMapper(), workloadListers, limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), vpa, workload, SurgeBufferConfig{}, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if changed || len(dynamicClient.Actions()) != 0 {
+			t.Errorf("expected no change to the surge buffer, got: %v", dynamicClient.Actions())
+		}
+	})
+
+	t.Run("Surge buffer from an older recommendation is updated", func(t *testing.T) {
+		dynamicClient.ClearActions()
+		newVPA := vpa.DeepCopy()
+		newVPA.Status.Recommendation.ContainerRecommendations[0].Target[corev1.ResourceMemory] = resource.MustParse("512Mi")
+		workloadListers := &testutil.FakeWorkloadListers{Workloads: []map[string]interface{}{surgeBuffer.Object}}
+		recorder := record.NewFakeRecorder(10)
+		changed, err := EnsureSurgeBufferWorkload(ctx, dynamicClient, testutil.CreateTestRESTMapper(), workloadListers, limitrange.NewNoopLimitsCalculator(), recorder, *newVPA, workload, SurgeBufferConfig{}, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		actions := dynamicClient.Actions()
+		if !changed || len(actions) != 1 || actions[0].GetVerb() != "update" {
+			t.Fatalf("expected the surge buffer to be updated, got: %v", actions)
+		}
+		updated, err := dynamicClient.Resource(schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}).Namespace("default").Get(ctx, "test-deployment-surge-buffer", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		containers, _, _ := unstructured.NestedSlice(updated.Object, "spec", "template", "spec", "containers")
+		memory, _, _ := unstructured.NestedString(containers[0].(map[string]interface{}), "resources", "requests", "memory")
+		if memory != "512Mi" {
+			t.Errorf("expected the memory request to be updated to 512Mi, got: %s", memory)
+		}
+		if event := <-recorder.Events; !strings.HasPrefix(event, "Normal "+EventReasonSurgeBufferUpdated) {
+			t.Errorf("expected a %s event, got: %s", EventReasonSurgeBufferUpdated, event)
+		}
+	})
+
+	t.Run("Surge buffer is updated when the pod template overrides change", func(t *testing.T) {
+		overrides := []PodTemplateOverrides{
+			{Annotations: map[string]string{"example.com/owner": "platform"}},
+			{Labels: map[string]string{"team": "platform"}},
+			{NodeSelector: map[string]string{"pool": "surge"}},
+			{Tolerations: []corev1.Toleration{{Key: "surge", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}}},
+			{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{Weight: 1, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"surge"}}}}}}}}},
+			{PriorityClassName: "surge-buffer"},
+		}
+		for _, override := range overrides {
+			dynamicClient.ClearActions()
+			workloadListers := &testutil.FakeWorkloadListers{Workloads: []map[string]interface{}{surgeBuffer.Object}}
+			changed, err := EnsureSurgeBufferWorkload(ctx, dynamicClient, testutil.CreateTestRESTMapper(), workloadListers, limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), vpa, workload, SurgeBufferConfig{PodTemplateOverrides: override}, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			actions := dynamicClient.Actions()
+			if !changed || len(actions) != 1 || actions[0].GetVerb() != "update" {
+				t.Errorf("expected the surge buffer to be updated for overrides %+v, got: %v", override, actions)
+			}
+		}
+	})
+
+	t.Run("Workload with the surge buffer's name that is not a surge buffer is never overwritten", func(t *testing.T) {
+		dynamicClient.ClearActions()
+		other := testutil.CreateTestWorkload("test-deployment-surge-buffer", "default", "")
+		workloadListers := &testutil.FakeWorkloadListers{Workloads: []map[string]interface{}{other}}
+		_, err := EnsureSurgeBufferWorkload(ctx, dynamicClient, testutil.CreateTestRESTMapper(), workloadListers, limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), vpa, workload, SurgeBufferConfig{}, false)
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+		if len(dynamicClient.Actions()) != 0 {
+			t.Errorf("expected no API calls, got: %v", dynamicClient.Actions())
+		}
+	})
+}
+
+func TestBuildSurgeBufferWorkloadEffectiveRecommendation(t *testing.T) {
+	vpa := testutil.CreateTestVPA(
+		testutil.WithStatus(
+			testutil.WithRecommendation(
+				testutil.WithTargetCPU(resource.MustParse("200m")),
+				testutil.WithTargetMemory(resource.MustParse("256Mi")),
+			),
+		),
+	)
+	workload := testutil.CreateTestWorkload("test-deployment", "default", "")
+	workload["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "myapp"}},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{
+					"name": "container-0",
+					"resources": map[string]interface{}{
+						"requests": map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+						"limits":   map[string]interface{}{"cpu": "200m"},
+					},
+				},
+			},
+		},
+	}
+	// The CPU limit may not exceed 300m, and containers get a 256Mi memory limit by default
+	limitRanges := testutil.CreateTestLimitRangeCalculator(createTestLimitRange("default", corev1.LimitTypeContainer,
+		corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("300m")},
+		corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+	))
+
+	_, _, requests, err := buildSurgeBufferWorkload(record.NewFakeRecorder(10), limitRanges, vpa, workload, SurgeBufferConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cpu := requests["cpu"]["container-0"]; cpu == nil || cpu.Cmp(resource.MustParse("150m")) != 0 {
+		t.Errorf("expected the CPU request to be capped to 150m, got: %v", cpu)
+	}
+	if memory := requests["memory"]["container-0"]; memory == nil || memory.Cmp(resource.MustParse("256Mi")) != 0 {
+		t.Errorf("expected a 256Mi memory request, got: %v", memory)
+	}
+}
+
+func TestBuildSurgeBufferWorkloadInitContainers(t *testing.T) {
+	target := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m"), corev1.ResourceMemory: resource.MustParse("256Mi")}
+	workload := testutil.CreateTestWorkload("test-deployment", "default", "")
+	workload["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "myapp"}},
+		"spec": map[string]interface{}{
+			"initContainers": []interface{}{
+				map[string]interface{}{"name": "migrate"},
+				map[string]interface{}{"name": "proxy", "restartPolicy": "Always"},
+			},
+			"containers": []interface{}{
+				map[string]interface{}{"name": "container-0"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name             string
+		scope            string
+		expectContainers []string
+	}{
+		{
+			name:             "Init containers are ignored by default",
+			expectContainers: []string{"container-0"},
+		},
+		{
+			name:             "Native sidecars get their recommendation",
+			scope:            utils.InitContainersSidecars,
+			expectContainers: []string{"container-0", "proxy"},
+		},
+		{
+			name:             "Every init container gets its recommendation",
+			scope:            utils.InitContainersAll,
+			expectContainers: []string{"container-0", "migrate", "proxy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options []testutil.VPAOption
+			if tt.scope != "" {
+				options = append(options, testutil.WithAnnotation(utils.VPAAnnotationInitContainers, tt.scope))
+			}
+			vpa := testutil.CreateTestVPA(options...)
+			vpa.Status.Recommendation = &v1.RecommendedPodResources{
+				ContainerRecommendations: []v1.RecommendedContainerResources{
+					{ContainerName: "container-0", Target: target},
+					{ContainerName: "migrate", Target: target},
+					{ContainerName: "proxy", Target: target},
+				},
+			}
+
+			surgeBufferWorkload, _, requests, err := buildSurgeBufferWorkload(record.NewFakeRecorder(10), limitrange.NewNoopLimitsCalculator(), vpa, workload, SurgeBufferConfig{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(requests["cpu"]) != len(tt.expectContainers) {
+				t.Errorf("expected requests for containers %v, got: %v", tt.expectContainers, requests["cpu"])
+			}
+			for _, containerName := range tt.expectContainers {
+				if cpu := requests["cpu"][containerName]; cpu == nil || cpu.Cmp(resource.MustParse("200m")) != 0 {
+					t.Errorf("expected a 200m CPU request for %s, got: %v", containerName, cpu)
+				}
+			}
+			initContainers, _, _ := unstructured.NestedSlice(surgeBufferWorkload, "spec", "template", "spec", "initContainers")
+			for _, initContainer := range initContainers {
+				initContainer := initContainer.(map[string]interface{})
+				_, hasResources := initContainer["resources"]
+				if expectResources := slices.Contains(tt.expectContainers, initContainer["name"].(string)); hasResources != expectResources {
+					t.Errorf("expected init container %s to have resources set: %v, got: %v", initContainer["name"], expectResources, initContainer["resources"])
+				}
+			}
+		})
+	}
+
+	vpa := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationInitContainers, "sidecar"))
+	vpa.Status.Recommendation = &v1.RecommendedPodResources{ContainerRecommendations: []v1.RecommendedContainerResources{{ContainerName: "container-0", Target: target}}}
+	if _, _, _, err := buildSurgeBufferWorkload(record.NewFakeRecorder(10), limitrange.NewNoopLimitsCalculator(), vpa, workload, SurgeBufferConfig{}); err == nil {
+		t.Errorf("expected an error for an invalid init containers scope")
+	}
+}
@@ -4,19 +4,23 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"strings"
 	"time"
 
+	"github.com/influxdata/vpa-rollout-controller/internal/metrics"
 	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
 )
 
-// Triggers the rollout process for a workload, including creating a surge buffer workload if enabled in the VPA annotations.
-func TriggerRollout(ctx context.Context, workload map[string]interface{}, vpa v1.VerticalPodAutoscaler, dynamicClient dynamic.Interface, patchOperationFieldManager string) error {
+// Triggers the rollout process for a workload, including creating or updating a surge buffer workload if enabled in the VPA annotations.
+// In dry-run, every step is only logged and recorded as an Event.
+func TriggerRollout(ctx context.Context, workload map[string]interface{}, vpa v1.VerticalPodAutoscaler, dynamicClient dynamic.Interface, restMapper meta.RESTMapper, workloadListers WorkloadListers, limitRanges limitrange.LimitRangeCalculator, recorder record.EventRecorder, patchOperationFieldManager string, surgeBufferConfig SurgeBufferConfig, dryRun bool) error {
 
 	log := slog.Default()
 
@@ -25,45 +29,59 @@ func TriggerRollout(ctx context.Context, workload map[string]interface{}, vpa v1
 
 	log.Info("Triggering rollout for workload", "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 
-	// If the VPA has the surge buffer enabled, create the surge buffer workload
+	// If the VPA has the surge buffer enabled, create the surge buffer workload, or update the one left over from a previous attempt
 	if vpa.Annotations != nil && vpa.Annotations[utils.VPAAnnotationSurgeBufferEnabled] == "true" {
-		err := CreateSurgeBufferWorkload(ctx, dynamicClient, vpa, workload)
+		_, err := EnsureSurgeBufferWorkload(ctx, dynamicClient, restMapper, workloadListers, limitRanges, recorder, vpa, workload, surgeBufferConfig, dryRun)
 		if err != nil {
 			log.Error("Error creating surge buffer workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 			return fmt.Errorf("error creating surge buffer workload for %s: %v", workloadName, err)
 		}
-		log.Info("Surge buffer workload created successfully", "workloadName", workloadName, "workloadNamespace", workloadNamespace)
-		SetRolloutStatus(ctx, vpa, dynamicClient, patchOperationFieldManager, "pending")
+		log.Info("Surge buffer workload is up to date", "workloadName", workloadName, "workloadNamespace", workloadNamespace, "dryRun", dryRun)
+		err = SetRolloutStatus(ctx, vpa, dynamicClient, recorder, patchOperationFieldManager, "pending", dryRun)
+		if err != nil {
+			log.Error("Error setting the VPA rollout status annotation to 'pending'", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+			return fmt.Errorf("error setting rollout status for workload %s: %v", workloadName, err)
+		}
 		log.Info("Set the VPA rollout status annotation to 'pending'", "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 		return nil
 	}
 
-	err := triggerRolloutRestart(ctx, workload, dynamicClient, patchOperationFieldManager)
+	err := triggerRolloutRestart(ctx, vpa, workload, dynamicClient, restMapper, recorder, patchOperationFieldManager, dryRun)
 	if err != nil {
 		log.Error("Error triggering rollout for workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+		recordAPIErrorEvent(recorder, vpa, workload, "rollout restart", err)
 		return fmt.Errorf("error triggering rollout for workload %s: %v", workloadName, err)
 	}
+	if !dryRun {
+		recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonRolloutTriggered, "Triggered a rollout restart of %s %s", workload["kind"], workloadName)
+	}
+	// Track the rollout until it completes, as we do for rollouts that were pending on a surge buffer
+	err = SetRolloutStatus(ctx, vpa, dynamicClient, recorder, patchOperationFieldManager, "in-progress", dryRun)
+	if err != nil {
+		log.Error("Error setting the VPA rollout status annotation to 'in-progress'", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+		return fmt.Errorf("error setting rollout status for workload %s: %v", workloadName, err)
+	}
 
 	return nil
 }
 
-func TriggerPendingRollout(ctx context.Context, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, dynamicClient dynamic.Interface, patchOperationFieldManager string) error {
+// Triggers the rollout of a workload whose surge buffer is ready, and sets the VPA's rollout status to 'in-progress'
+func TriggerPendingRollout(ctx context.Context, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, dynamicClient dynamic.Interface, restMapper meta.RESTMapper, recorder record.EventRecorder, patchOperationFieldManager string, dryRun bool) error {
 	log := slog.Default()
 
 	// Trigger the rollout restart
-	err := triggerRolloutRestart(ctx, workload, dynamicClient, patchOperationFieldManager)
+	err := triggerRolloutRestart(ctx, vpa, workload, dynamicClient, restMapper, recorder, patchOperationFieldManager, dryRun)
 	if err != nil {
 		log.Error("Error triggering rollout restart for workload", "err", err, "workloadName", workload["metadata"].(map[string]interface{})["name"], "workloadNamespace", workload["metadata"].(map[string]interface{})["namespace"])
+		recordAPIErrorEvent(recorder, vpa, workload, "rollout restart", err)
 		return fmt.Errorf("error triggering rollout restart for workload %s: %v", workload["metadata"].(map[string]interface{})["name"], err)
 	}
-	// Set the VPA annotation to indicate that a rollout is pending
-	patchData := fmt.Sprintf(`{"metadata":{"annotations":{"%s":"%s"}}}`, utils.VPAAnnotationRolloutStatus, "in-progress")
-	gvr := schema.GroupVersionResource{
-		Group:    "autoscaling.k8s.io",
-		Version:  "v1",
-		Resource: "verticalpodautoscalers",
+	if !dryRun {
+		recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonRolloutTriggered, "Surge buffer is ready, triggered a rollout restart of %s %s", workload["kind"], workload["metadata"].(map[string]interface{})["name"])
 	}
-	_, err = dynamicClient.Resource(gvr).Namespace(vpa.Namespace).Patch(ctx, vpa.Name, types.MergePatchType, []byte(patchData), metav1.PatchOptions{FieldManager: patchOperationFieldManager})
+
+	// Set the VPA annotation to indicate that the rollout is in progress
+	err = SetRolloutStatus(ctx, vpa, dynamicClient, recorder, patchOperationFieldManager, "in-progress", dryRun)
 	if err != nil {
 		log.Error("Error triggering pending rollout for workload", "err", err, "vpaName", vpa.Name, "vpaNamespace", vpa.Namespace)
 		return fmt.Errorf("error triggering pending rollout for workload %s: %v", vpa.Name, err)
@@ -75,7 +93,8 @@ func TriggerPendingRollout(ctx context.Context, vpa v1.VerticalPodAutoscaler, wo
 }
 
 // Patches the workload resource to trigger a rollout using the annotation 'kubectl.kubernetes.io/restartedAt'
-func triggerRolloutRestart(ctx context.Context, workload map[string]interface{}, dynamicClient dynamic.Interface, patchOperationFieldManager string) error {
+// In dry-run, the patch is only logged and recorded as an Event.
+func triggerRolloutRestart(ctx context.Context, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, dynamicClient dynamic.Interface, restMapper meta.RESTMapper, recorder record.EventRecorder, patchOperationFieldManager string, dryRun bool) error {
 
 	log := slog.Default()
 
@@ -84,16 +103,22 @@ func triggerRolloutRestart(ctx context.Context, workload map[string]interface{},
 
 	currentTime := time.Now().Format(time.RFC3339)
 	patchData := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":"%s"}}}}}`, currentTime)
-	gvr := schema.GroupVersionResource{
-		Group:    strings.SplitN(workload["apiVersion"].(string), "/", 2)[0],
-		Version:  strings.SplitN(workload["apiVersion"].(string), "/", 2)[1],
-		Resource: strings.ToLower(workload["kind"].(string) + "s"),
+	gvr, err := workloadGVR(restMapper, workload["apiVersion"].(string), workload["kind"].(string))
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		log.Info("Dry run: would trigger rollout on workload", "workloadName", workloadName, "workloadNamespace", workloadNamespace, "patchData", patchData)
+		recordEvent(recorder, vpa, workload, corev1.EventTypeNormal, EventReasonDryRun, "Dry run: would trigger a rollout restart of %s %s with patch %s", workload["kind"], workloadName, patchData)
+		return nil
 	}
-	_, err := dynamicClient.Resource(gvr).Namespace(workloadNamespace.(string)).Patch(ctx, workloadName.(string), types.MergePatchType, []byte(patchData), metav1.PatchOptions{FieldManager: patchOperationFieldManager})
+	_, err = dynamicClient.Resource(gvr).Namespace(workloadNamespace.(string)).Patch(ctx, workloadName.(string), types.MergePatchType, []byte(patchData), metav1.PatchOptions{FieldManager: patchOperationFieldManager})
 	if err != nil {
 		log.Error("Error triggering rollout on workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace, "Group", gvr.Group, "Version", gvr.Version, "Resource", gvr.Resource, "patchData", patchData)
+		metrics.APIErrors.WithLabelValues(metrics.OperationPatchWorkload).Inc()
 		return err
 	}
+	metrics.RolloutsTriggered.WithLabelValues(workloadNamespace.(string), workload["kind"].(string)).Inc()
 
 	log.Info("Rollout triggered successfully", "workloadName", workloadName, "workloadNamespace", workloadNamespace, "timestamp", currentTime)
 	return nil
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	vpa_api_util "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/vpa"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Check that the pods restarted by a completed rollout received their effective recommendation from the VPA admission controller,
+// which does not happen when its webhook is down or misconfigured. The requests of the controlled resources of every evaluated
+// container must differ from the effective recommendation's target by at most the tolerance, in percent. A tolerance of 0 disables it.
+// Only the pods of the rollout are verified: terminating pods and pods created before the workload's restart are skipped.
+// It returns the containers whose requests differ by more than the tolerance.
+func RolloutIsApplied(ctx context.Context, podLister corelisters.PodLister, limitRanges limitrange.LimitRangeCalculator, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, workload map[string]interface{}, tolerancePercent int) (bool, []ContainerDiff, error) {
+	log := slog.Default()
+	workloadName := workload["metadata"].(map[string]interface{})["name"]
+	workloadNamespace := workload["metadata"].(map[string]interface{})["namespace"]
+
+	tolerancePercent, err := getVerificationTolerance(recorder, vpa, tolerancePercent)
+	if err != nil {
+		return false, nil, err
+	}
+	if tolerancePercent == 0 || vpa.Status.Recommendation == nil {
+		return true, nil, nil
+	}
+	driftPolicy, err := getContainerDriftPolicy(recorder, vpa, TriggerThresholds{})
+	if err != nil {
+		return false, nil, err
+	}
+
+	restartedAt, restarted, err := workloadRestartedAt(workload)
+	if err != nil {
+		log.Error("Error parsing last rollout time from workload template annotations", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+		return false, nil, err
+	}
+	podList, err := getTargetWorkloadPods(ctx, workload, podLister)
+	if err != nil {
+		log.Error("Error getting pods for workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+		return false, nil, err
+	}
+	var pods []corev1.Pod
+	var effectiveRecommendations []*v1.RecommendedPodResources
+	for i := range podList.Items {
+		// Old pods still terminating after the rollout kept the requests they were created with
+		if podList.Items[i].DeletionTimestamp != nil || (restarted && podList.Items[i].CreationTimestamp.Time.Before(restartedAt)) {
+			continue
+		}
+		pod := podWithInitContainers(&podList.Items[i], driftPolicy.initContainers)
+		effectiveRecommendation, err := EffectiveRecommendation(vpa, pod, limitRanges)
+		if err != nil {
+			return false, nil, err
+		}
+		pods = append(pods, *pod)
+		effectiveRecommendations = append(effectiveRecommendations, effectiveRecommendation)
+	}
+
+	// The tolerance is used as the thresholds of every rule, so that the reported pod is one whose requests were not applied
+	var tolerance TriggerThresholds
+	tolerance.setPercent(tolerancePercent)
+	var unappliedDiffs []ContainerDiff
+	for _, recommendation := range vpa.Status.Recommendation.ContainerRecommendations {
+		if !driftPolicy.evaluates(recommendation.ContainerName) {
+			continue
+		}
+		containerPolicy := vpa_api_util.GetContainerResourcePolicy(recommendation.ContainerName, vpa.Spec.ResourcePolicy)
+		if containerPolicy != nil && containerPolicy.Mode != nil && *containerPolicy.Mode == v1.ContainerScalingModeOff {
+			continue
+		}
+		containerDiff, found := computeContainerDiff(recommendation, pods, effectiveRecommendations, utils.TriggerModeTarget, tolerance)
+		if !found {
+			continue
+		}
+		// The admission controller only sets the requests of the resources the VPA controls
+		controlledResources := defaultControlledResources
+		if containerPolicy != nil && containerPolicy.ControlledResources != nil {
+			controlledResources = *containerPolicy.ControlledResources
+		}
+		cpuUnapplied := slices.Contains(controlledResources, corev1.ResourceCPU) && containerDiff.CPUDiffPercent > float64(tolerancePercent)
+		memoryUnapplied := slices.Contains(controlledResources, corev1.ResourceMemory) && containerDiff.MemoryDiffPercent > float64(tolerancePercent)
+		if cpuUnapplied || memoryUnapplied {
+			log.Info("Pods of the rollout did not receive the VPA recommendation", "VPAName", vpa.Name, "VPANamespace", vpa.Namespace, "WorkloadName", workloadName, "WorkloadNamespace", workloadNamespace, "ContainerName", containerDiff.ContainerName, "PodName", containerDiff.PodName, "CPUDiffPercent", containerDiff.CPUDiffPercent, "MemoryDiffPercent", containerDiff.MemoryDiffPercent, "TolerancePercent", tolerancePercent)
+			unappliedDiffs = append(unappliedDiffs, containerDiff)
+		}
+	}
+	return len(unappliedDiffs) == 0, unappliedDiffs, nil
+}
+
+// Read the verification tolerance of a VPA, in percent, from its annotation or else the default one.
+// An invalid annotation is reported with an Event and returned as an error.
+func getVerificationTolerance(recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, tolerancePercent int) (int, error) {
+	value := vpa.Annotations[utils.VPAAnnotationVerificationTolerance]
+	if value == "" {
+		return tolerancePercent, nil
+	}
+	tolerance, err := strconv.Atoi(value)
+	if err == nil && tolerance < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	if err != nil {
+		recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationVerificationTolerance, err)
+		return tolerancePercent, fmt.Errorf("error parsing annotation %s: %v", utils.VPAAnnotationVerificationTolerance, err)
+	}
+	return tolerance, nil
+}
+
+// Describe the containers whose requests were not applied by a rollout, for the RolloutUnapplied Event
+func formatUnappliedContainerDiffs(containerDiffs []ContainerDiff) string {
+	var descriptions []string
+	for _, containerDiff := range containerDiffs {
+		descriptions = append(descriptions, fmt.Sprintf("container %s of pod %s has %s CPU (target %s) and %s memory (target %s)",
+			containerDiff.ContainerName, containerDiff.PodName,
+			containerDiff.CPURequest.String(), containerDiff.CPUTarget.String(),
+			containerDiff.MemoryRequest.String(), containerDiff.MemoryTarget.String()))
+	}
+	return strings.Join(descriptions, "; ")
+}
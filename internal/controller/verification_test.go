@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
+	"k8s.io/client-go/tools/record"
+
+	testutil "github.com/influxdata/vpa-rollout-controller/test"
+)
+
+func TestRolloutIsApplied(t *testing.T) {
+	ctx := context.Background()
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	memoryOnly := []corev1.ResourceName{corev1.ResourceMemory}
+
+	tests := []struct {
+		name                    string
+		appCPURequest           string
+		annotations             map[string]string
+		resourcePolicy          *v1.PodResourcePolicy
+		expectApplied           bool
+		expectUnapplied         []string
+		expectInvalidAnnotation bool
+	}{
+		{
+			name:          "Pods that received the recommendation are applied",
+			appCPURequest: "100m",
+			expectApplied: true,
+		},
+		{
+			name:            "Pods that kept their requests are not applied",
+			appCPURequest:   "50m",
+			expectApplied:   false,
+			expectUnapplied: []string{"app"},
+		},
+		{
+			name:          "Differences within the tolerance are applied",
+			appCPURequest: "95m",
+			expectApplied: true,
+		},
+		{
+			name:           "Resources the VPA does not control are not verified",
+			appCPURequest:  "50m",
+			resourcePolicy: &v1.PodResourcePolicy{ContainerPolicies: []v1.ContainerResourcePolicy{{ContainerName: "app", ControlledResources: &memoryOnly}}},
+			expectApplied:  true,
+		},
+		{
+			name:          "Excluded containers are not verified",
+			appCPURequest: "50m",
+			annotations:   map[string]string{utils.VPAAnnotationExcludedContainers: "app"},
+			expectApplied: true,
+		},
+		{
+			name:          "A tolerance of 0 disables the verification",
+			appCPURequest: "50m",
+			annotations:   map[string]string{utils.VPAAnnotationVerificationTolerance: "0"},
+			expectApplied: true,
+		},
+		{
+			name:            "The tolerance can be overridden by the VPA",
+			appCPURequest:   "95m",
+			annotations:     map[string]string{utils.VPAAnnotationVerificationTolerance: "1"},
+			expectApplied:   false,
+			expectUnapplied: []string{"app"},
+		},
+		{
+			name:                    "Invalid tolerances are reported",
+			appCPURequest:           "100m",
+			annotations:             map[string]string{utils.VPAAnnotationVerificationTolerance: "-5"},
+			expectInvalidAnnotation: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options []testutil.VPAOption
+			for key, value := range tt.annotations {
+				options = append(options, testutil.WithAnnotation(key, value))
+			}
+			vpa, pod := createTestDriftVPAAndPod(options...)
+			vpa.Spec.ResourcePolicy = tt.resourcePolicy
+			pod.Spec.Containers[1].Resources.Requests[corev1.ResourceCPU] = resource.MustParse(tt.appCPURequest)
+			recorder := record.NewFakeRecorder(10)
+
+			applied, unappliedDiffs, err := RolloutIsApplied(ctx, testutil.CreateTestPodLister(pod), limitrange.NewNoopLimitsCalculator(), recorder, vpa, workload, 10)
+			if tt.expectInvalidAnnotation {
+				if err == nil {
+					t.Fatalf("expected an error for the invalid annotation")
+				}
+				if event := <-recorder.Events; !strings.Contains(event, EventReasonInvalidAnnotation) {
+					t.Errorf("expected an %s event, got: %s", EventReasonInvalidAnnotation, event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if applied != tt.expectApplied {
+				t.Errorf("expected applied to be %v, got: %v", tt.expectApplied, applied)
+			}
+			if len(unappliedDiffs) != len(tt.expectUnapplied) {
+				t.Fatalf("expected unapplied containers %v, got: %v", tt.expectUnapplied, unappliedDiffs)
+			}
+			for i, containerName := range tt.expectUnapplied {
+				if unappliedDiffs[i].ContainerName != containerName || unappliedDiffs[i].PodName != pod.Name {
+					t.Errorf("expected container %s of pod %s to be unapplied, got: %+v", containerName, pod.Name, unappliedDiffs[i])
+				}
+			}
+			if description := formatUnappliedContainerDiffs(unappliedDiffs); len(tt.expectUnapplied) > 0 && !strings.Contains(description, "container app of pod pod-0 has "+tt.appCPURequest+" CPU (target 100m)") {
+				t.Errorf("unexpected description of the unapplied containers: %s", description)
+			}
+		})
+	}
+}
+
+func TestRolloutIsAppliedSkipsOldPods(t *testing.T) {
+	ctx := context.Background()
+	restartedAt := time.Now().Add(-10 * time.Minute).UTC().Truncate(time.Second)
+	workload := testutil.CreateTestWorkload("my-workload", "default", "")
+	if err := unstructured.SetNestedField(workload, restartedAt.Format(time.RFC3339), "spec", "template", "metadata", "annotations", "kubectl.kubernetes.io/restartedAt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The pod of the rollout received the recommendation
+	vpa, pod := createTestDriftVPAAndPod()
+	pod.CreationTimestamp = metav1.NewTime(restartedAt.Add(time.Minute))
+	pod.Spec.Containers[1].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("100m")
+
+	// Old pods kept their stale requests: one is still terminating, the other was created before the restart
+	_, terminatingPod := createTestDriftVPAAndPod()
+	terminatingPod.Name = "pod-old-0"
+	terminatingPod.CreationTimestamp = metav1.NewTime(restartedAt.Add(-time.Hour))
+	terminatingPod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	_, oldPod := createTestDriftVPAAndPod()
+	oldPod.Name = "pod-old-1"
+	oldPod.CreationTimestamp = metav1.NewTime(restartedAt.Add(-time.Hour))
+
+	applied, unappliedDiffs, err := RolloutIsApplied(ctx, testutil.CreateTestPodLister(pod, terminatingPod, oldPod), limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), vpa, workload, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !applied {
+		t.Errorf("expected the pods of the rollout to be applied, got unapplied containers: %v", unappliedDiffs)
+	}
+
+	// A terminating pod created after the restart is skipped as well
+	pod.Spec.Containers[1].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("50m")
+	pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	_, newPod := createTestDriftVPAAndPod()
+	newPod.Name = "pod-new-0"
+	newPod.CreationTimestamp = metav1.NewTime(restartedAt.Add(time.Minute))
+	applied, unappliedDiffs, err = RolloutIsApplied(ctx, testutil.CreateTestPodLister(pod, newPod), limitrange.NewNoopLimitsCalculator(), record.NewFakeRecorder(10), vpa, workload, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if applied || len(unappliedDiffs) != 1 || unappliedDiffs[0].PodName != newPod.Name {
+		t.Errorf("expected only the new pod to be unapplied, got: %v", unappliedDiffs)
+	}
+}
@@ -4,18 +4,18 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"strings"
+	"time"
 
 	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
 
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	v1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
-	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 // Check if the VPA has the "enabled" annotation set to "true" and that the VPA's updateMode is set to 'Initial'
@@ -37,25 +37,93 @@ func VPAIsEligible(ctx context.Context, vpa v1.VerticalPodAutoscaler) bool {
 	return false
 }
 
-// Get the target workload from the VPA spec
-func GetTargetWorkload(ctx context.Context, vpa v1.VerticalPodAutoscaler, dynamicClient dynamic.Interface) (map[string]interface{}, error) {
+// Check if the controller must only report what it would do for the VPA, either because it runs in dry-run mode or because the VPA's mode annotation is set to 'observe'.
+// An unknown mode is treated as 'observe', so that a typo never lets the controller mutate resources.
+func VPAIsInDryRun(ctx context.Context, recorder record.EventRecorder, vpa v1.VerticalPodAutoscaler, dryRun bool) bool {
+	log := slog.Default()
 
-	vpaTargetGroupVersionResource := schema.GroupVersionResource{
-		Group:    strings.SplitN(vpa.Spec.TargetRef.APIVersion, "/", 2)[0],
-		Version:  strings.SplitN(vpa.Spec.TargetRef.APIVersion, "/", 2)[1],
-		Resource: strings.ToLower(vpa.Spec.TargetRef.Kind + "s"),
+	mode := utils.VPAModeActive
+	if vpa.Annotations != nil && vpa.Annotations[utils.VPAAnnotationMode] != "" {
+		mode = vpa.Annotations[utils.VPAAnnotationMode]
 	}
+	switch mode {
+	case utils.VPAModeActive:
+		return dryRun
+	case utils.VPAModeObserve:
+		return true
+	default:
+		log.Error("Invalid VPA mode, observing the VPA", "Name", vpa.Name, "Namespace", vpa.Namespace, "Mode", mode)
+		recordInvalidAnnotationEvent(recorder, vpa, utils.VPAAnnotationMode, fmt.Errorf("mode must be '%s' or '%s'", utils.VPAModeActive, utils.VPAModeObserve))
+		return true
+	}
+}
 
-	unstructuredObj, err := dynamicClient.Resource(vpaTargetGroupVersionResource).Namespace(vpa.Namespace).Get(ctx, vpa.Spec.TargetRef.Name, metav1.GetOptions{})
+// Get the target workload from the VPA spec
+func GetTargetWorkload(ctx context.Context, vpa v1.VerticalPodAutoscaler, workloadListers WorkloadListers, restMapper meta.RESTMapper) (map[string]interface{}, error) {
+
+	gvr, err := targetWorkloadGVR(restMapper, vpa)
+	if err != nil {
+		return nil, err
+	}
+	workloadLister, err := workloadListers.ForResource(ctx, gvr)
+	if err != nil {
+		return nil, fmt.Errorf("error getting target workload lister: %v", err)
+	}
+	obj, err := workloadLister.ByNamespace(vpa.Namespace).Get(vpa.Spec.TargetRef.Name)
 	if err != nil {
 		return nil, fmt.Errorf("error getting target workload: %v", err)
 	}
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("error getting target workload: unexpected object type %T", obj)
+	}
 
-	return unstructuredObj.UnstructuredContent(), nil
+	// Objects returned by listers are shared with the informer cache, so hand out a copy
+	return unstructuredObj.DeepCopy().UnstructuredContent(), nil
+}
+
+// Get the GroupVersionResource of the VPA's target workload
+func targetWorkloadGVR(restMapper meta.RESTMapper, vpa v1.VerticalPodAutoscaler) (schema.GroupVersionResource, error) {
+	if vpa.Spec.TargetRef == nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("VPA %s in namespace %s has no targetRef", vpa.Name, vpa.Namespace)
+	}
+	return resolveWorkloadGVR(restMapper, vpa.Spec.TargetRef.APIVersion, vpa.Spec.TargetRef.Kind, true)
+}
+
+// Get the GroupVersionResource of a workload kind from the API server's discovery information
+func workloadGVR(restMapper meta.RESTMapper, apiVersion, kind string) (schema.GroupVersionResource, error) {
+	return resolveWorkloadGVR(restMapper, apiVersion, kind, true)
+}
+
+// Resolves the GroupVersionResource of a workload kind with the RESTMapper.
+// If refresh is true, kinds that are unknown to the RESTMapper trigger a refresh of its discovery information, for kinds installed after it was cached.
+// Event handlers pass false, so that they never call the API server.
+func resolveWorkloadGVR(restMapper meta.RESTMapper, apiVersion, kind string, refresh bool) (schema.GroupVersionResource, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("error parsing apiVersion %q of kind %s: %v", apiVersion, kind, err)
+	}
+	mapping, err := restMapper.RESTMapping(gv.WithKind(kind).GroupKind(), gv.Version)
+	if refresh && meta.IsNoMatchError(err) {
+		if resettableRESTMapper, ok := restMapper.(meta.ResettableRESTMapper); ok {
+			resettableRESTMapper.Reset()
+			mapping, err = restMapper.RESTMapping(gv.WithKind(kind).GroupKind(), gv.Version)
+		}
+	}
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			return schema.GroupVersionResource{}, fmt.Errorf("unknown workload kind %s in apiVersion %q: %v", kind, apiVersion, err)
+		}
+		return schema.GroupVersionResource{}, fmt.Errorf("error resolving the resource of kind %s in apiVersion %q: %v", kind, apiVersion, err)
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return schema.GroupVersionResource{}, fmt.Errorf("workload kind %s in apiVersion %q is not namespaced", kind, apiVersion)
+	}
+	return mapping.Resource, nil
 }
 
 // Get the VPA's target workload resource's pods using selector labels
-func getTargetWorkloadPods(ctx context.Context, workload map[string]interface{}, clientset kubernetes.Interface) (*corev1.PodList, error) {
+func getTargetWorkloadPods(ctx context.Context, workload map[string]interface{}, podLister corelisters.PodLister) (*corev1.PodList, error) {
 
 	log := slog.Default()
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
@@ -69,22 +137,32 @@ func getTargetWorkloadPods(ctx context.Context, workload map[string]interface{},
 
 	labelSelector := labels.Set(selectorLabels).String()
 	// We use labelSelector to either get (1) the workload's pods or (2) the surge buffer workload's pods
-	if strings.HasSuffix(workloadName.(string), "surge-buffer") {
+	if isSurgeBufferWorkload(workload) {
 		labelSelector += "," + utils.LabelSurgeBuffer + "=true"
 	} else {
 		labelSelector += "," + utils.LabelSurgeBuffer + "!=true"
 	}
-	podList, err := clientset.CoreV1().Pods(workloadNamespace.(string)).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		log.Error("Error parsing label selector for workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace, "labelSelector", labelSelector)
+		return nil, err
+	}
+	pods, err := podLister.Pods(workloadNamespace.(string)).List(selector)
 	if err != nil {
 		log.Error("Error getting pods for workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 		return nil, err
 	}
 
+	podList := &corev1.PodList{Items: make([]corev1.Pod, 0, len(pods))}
+	for _, pod := range pods {
+		podList.Items = append(podList.Items, *pod.DeepCopy())
+	}
 	return podList, nil
 }
 
-// Perform multiple checks to ensure the workload's pods are healthy and ready for a rollout
-func workloadPodsAreHealthy(ctx context.Context, workload map[string]interface{}, clientset kubernetes.Interface) (bool, error) {
+// Perform multiple checks to ensure the workload's pods are healthy and ready for a rollout.
+// Containers OOM killed within the OOM window do not need to be Ready, so that a crash looping container can still get more memory. A window of 0 disables it.
+func workloadPodsAreHealthy(ctx context.Context, workload map[string]interface{}, podLister corelisters.PodLister, oomWindow time.Duration) (bool, error) {
 
 	log := slog.Default()
 	workloadName := workload["metadata"].(map[string]interface{})["name"]
@@ -92,7 +170,7 @@ func workloadPodsAreHealthy(ctx context.Context, workload map[string]interface{}
 	workloadReplicas := workload["spec"].(map[string]interface{})["replicas"]
 
 	// Get the list of pods for the target workload
-	podList, err := getTargetWorkloadPods(ctx, workload, clientset)
+	podList, err := getTargetWorkloadPods(ctx, workload, podLister)
 	if err != nil {
 		log.Error("Error getting pods for workload", "err", err, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 		return false, err
@@ -110,6 +188,7 @@ func workloadPodsAreHealthy(ctx context.Context, workload map[string]interface{}
 		return false, nil
 	}
 
+	oomKilledAfter := time.Now().Add(-oomWindow)
 	for _, pod := range podList.Items {
 		// Check if any of the pods are not in Running state
 		if pod.Status.Phase != corev1.PodRunning {
@@ -119,6 +198,10 @@ func workloadPodsAreHealthy(ctx context.Context, workload map[string]interface{}
 		// Check if any of the containers in the pod are not Ready
 		for _, containerStatus := range pod.Status.ContainerStatuses {
 			if !containerStatus.Ready {
+				if killedAt, killed := containerOOMKilledAt(containerStatus); oomWindow > 0 && killed && killedAt.After(oomKilledAfter) {
+					log.Debug("Container of the target workload's Pod is not Ready after an OOM kill", "podName", pod.Name, "podNamespace", pod.Namespace, "containerName", containerStatus.Name, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
+					continue
+				}
 				log.Info("At least one of the target workload's Pods's containers is not Ready", "podName", pod.Name, "podNamespace", pod.Namespace, "containerName", containerStatus.Name, "workloadName", workloadName, "workloadNamespace", workloadNamespace)
 				return false, nil
 			}
@@ -7,9 +7,11 @@ import (
 	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	vpa_types "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
-	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 
 	testutil "github.com/influxdata/vpa-rollout-controller/test"
 )
@@ -47,15 +49,44 @@ func TestVPAIsEligible(t *testing.T) {
 	}
 }
 
-func TestGetTargetWorkload(t *testing.T) {
+func TestVPAIsInDryRun(t *testing.T) {
 	ctx := context.Background()
-	fakeDynamic := &testutil.FakeDynamicClient{}
+	recorder := record.NewFakeRecorder(10)
+
+	vpa := testutil.CreateTestVPA()
+	if VPAIsInDryRun(ctx, recorder, vpa, false) {
+		t.Errorf("VPAIsInDryRun should return false without the mode annotation and the dry-run flag")
+	}
+	if !VPAIsInDryRun(ctx, recorder, vpa, true) {
+		t.Errorf("VPAIsInDryRun should return true when the dry-run flag is set")
+	}
+
+	vpaObserve := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationMode, utils.VPAModeObserve))
+	if !VPAIsInDryRun(ctx, recorder, vpaObserve, false) {
+		t.Errorf("VPAIsInDryRun should return true when the mode annotation is set to 'observe'")
+	}
+
+	// An unknown mode is treated as 'observe' and reported
+	vpaInvalid := testutil.CreateTestVPA(testutil.WithAnnotation(utils.VPAAnnotationMode, "obsrve"))
+	if !VPAIsInDryRun(ctx, recorder, vpaInvalid, false) {
+		t.Errorf("VPAIsInDryRun should return true when the mode annotation is invalid")
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected 1 event for the invalid mode annotation, got: %d", len(recorder.Events))
+	}
+}
 
+func TestGetTargetWorkload(t *testing.T) {
+	ctx := context.Background()
 	// Create test VPA using the utility function
 	vpa := testutil.CreateTestVPA()
+	workloadListers := &testutil.FakeWorkloadListers{
+		Workloads: []map[string]interface{}{testutil.CreateTestWorkload("test-deployment", "default", "")},
+	}
 
 	// Success case
-	workload, err := GetTargetWorkload(ctx, vpa, fakeDynamic)
+	restMapper := testutil.CreateTestRESTMapper()
+	workload, err := GetTargetWorkload(ctx, vpa, workloadListers, restMapper)
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
@@ -63,17 +94,64 @@ func TestGetTargetWorkload(t *testing.T) {
 		t.Errorf("expected kind Deployment, got: %v", workload["kind"])
 	}
 
-	// Error case
-	fakeDynamic.ShouldError = true
-	_, err = GetTargetWorkload(ctx, vpa, fakeDynamic)
+	// Error case: the target workload does not exist
+	vpaMissingTarget := testutil.CreateTestVPA(testutil.WithTargetRef("Deployment", "missing-deployment", "apps/v1"))
+	_, err = GetTargetWorkload(ctx, vpaMissingTarget, workloadListers, restMapper)
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	// Error case: the workload lister cannot be obtained
+	workloadListers.ShouldError = true
+	_, err = GetTargetWorkload(ctx, vpa, workloadListers, restMapper)
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
 }
 
+func TestWorkloadGVR(t *testing.T) {
+	restMapper := meta.NewDefaultRESTMapper(nil)
+	restMapper.AddSpecific(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployment"}, meta.RESTScopeNamespace)
+	// Irregular plural, which lowercasing the kind and appending "s" gets wrong
+	restMapper.AddSpecific(schema.GroupVersionKind{Group: "example.com", Version: "v1alpha1", Kind: "Proxy"}, schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "proxies"}, schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "proxy"}, meta.RESTScopeNamespace)
+	restMapper.AddSpecific(schema.GroupVersionKind{Version: "v1", Kind: "ReplicationController"}, schema.GroupVersionResource{Version: "v1", Resource: "replicationcontrollers"}, schema.GroupVersionResource{Version: "v1", Resource: "replicationcontroller"}, meta.RESTScopeNamespace)
+	restMapper.AddSpecific(schema.GroupVersionKind{Version: "v1", Kind: "Node"}, schema.GroupVersionResource{Version: "v1", Resource: "nodes"}, schema.GroupVersionResource{Version: "v1", Resource: "node"}, meta.RESTScopeRoot)
+
+	tests := []struct {
+		apiVersion  string
+		kind        string
+		expected    schema.GroupVersionResource
+		expectError bool
+	}{
+		{apiVersion: "apps/v1", kind: "Deployment", expected: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}},
+		{apiVersion: "example.com/v1alpha1", kind: "Proxy", expected: schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "proxies"}},
+		// Core group apiVersions have no "/"
+		{apiVersion: "v1", kind: "ReplicationController", expected: schema.GroupVersionResource{Version: "v1", Resource: "replicationcontrollers"}},
+		{apiVersion: "apps/v1", kind: "Unknown", expectError: true},
+		{apiVersion: "v1", kind: "Node", expectError: true},
+		{apiVersion: "apps/v1/extra", kind: "Deployment", expectError: true},
+	}
+	for _, tt := range tests {
+		gvr, err := workloadGVR(restMapper, tt.apiVersion, tt.kind)
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("%s %s: expected error, got: %v", tt.apiVersion, tt.kind, gvr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", tt.apiVersion, tt.kind, err)
+			continue
+		}
+		if gvr != tt.expected {
+			t.Errorf("%s %s: expected %v, got: %v", tt.apiVersion, tt.kind, tt.expected, gvr)
+		}
+	}
+}
+
 func TestGetTargetWorkloadPods(t *testing.T) {
 	ctx := context.Background()
-	client := fake.NewSimpleClientset(
+	podLister := testutil.CreateTestPodLister(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "pod1",
@@ -84,7 +162,7 @@ func TestGetTargetWorkloadPods(t *testing.T) {
 		},
 	)
 	workload := testutil.CreateTestWorkload("mydeployment", "default", "")
-	pods, err := getTargetWorkloadPods(ctx, workload, client)
+	pods, err := getTargetWorkloadPods(ctx, workload, podLister)
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
@@ -98,7 +176,7 @@ func TestGetTargetWorkloadPods(t *testing.T) {
 
 func TestWorkloadPodsAreHealthy(t *testing.T) {
 	ctx := context.Background()
-	client := fake.NewSimpleClientset(
+	podLister := testutil.CreateTestPodLister(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "pod1",
@@ -120,7 +198,7 @@ func TestWorkloadPodsAreHealthy(t *testing.T) {
 		},
 	)
 	workload := testutil.CreateTestWorkload("mydeployment", "default", "")
-	healthy, err := workloadPodsAreHealthy(ctx, workload, client)
+	healthy, err := workloadPodsAreHealthy(ctx, workload, podLister, 0)
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
@@ -129,7 +207,7 @@ func TestWorkloadPodsAreHealthy(t *testing.T) {
 	}
 
 	// unhealthy: pod not running
-	client = fake.NewSimpleClientset(
+	podLister = testutil.CreateTestPodLister(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "pod2",
@@ -139,7 +217,7 @@ func TestWorkloadPodsAreHealthy(t *testing.T) {
 			Status: corev1.PodStatus{Phase: corev1.PodPending},
 		},
 	)
-	healthy, err = workloadPodsAreHealthy(ctx, workload, client)
+	healthy, err = workloadPodsAreHealthy(ctx, workload, podLister, 0)
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
@@ -171,7 +249,7 @@ func TestGetTargetWorkloadPods_SurgeBufferLabelSelection(t *testing.T) {
 		Status: corev1.PodStatus{Phase: corev1.PodRunning},
 	}
 
-	client := fake.NewSimpleClientset(pod1, pod2)
+	podLister := testutil.CreateTestPodLister(pod1, pod2)
 
 	// Workload that is NOT a surge-buffer (should exclude surge buffer pods)
 	workload := map[string]interface{}{
@@ -185,7 +263,27 @@ func TestGetTargetWorkloadPods_SurgeBufferLabelSelection(t *testing.T) {
 			},
 		},
 	}
-	pods, err := getTargetWorkloadPods(ctx, workload, client)
+	pods, err := getTargetWorkloadPods(ctx, workload, podLister)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods.Items) != 1 || pods.Items[0].Name != "pod1" {
+		t.Errorf("expected only pod1 (non-surge-buffer), got: %v", podNames(pods.Items))
+	}
+
+	// Workload whose name ends with "surge-buffer" but is NOT a surge-buffer (should exclude surge buffer pods)
+	workloadNamedLikeSurge := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      "cache-surge-buffer",
+			"namespace": "default",
+		},
+		"spec": map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchLabels": selectorLabels,
+			},
+		},
+	}
+	pods, err = getTargetWorkloadPods(ctx, workloadNamedLikeSurge, podLister)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -193,11 +291,12 @@ func TestGetTargetWorkloadPods_SurgeBufferLabelSelection(t *testing.T) {
 		t.Errorf("expected only pod1 (non-surge-buffer), got: %v", podNames(pods.Items))
 	}
 
-	// Workload that IS a surge-buffer (should select only surge buffer pods)
+	// Workload that IS a surge-buffer, identified by its label (should select only surge buffer pods)
 	workloadSurge := map[string]interface{}{
 		"metadata": map[string]interface{}{
 			"name":      "mydeployment-surge-buffer",
 			"namespace": "default",
+			"labels":    map[string]interface{}{utils.LabelSurgeBuffer: "true"},
 		},
 		"spec": map[string]interface{}{
 			"selector": map[string]interface{}{
@@ -205,7 +304,7 @@ func TestGetTargetWorkloadPods_SurgeBufferLabelSelection(t *testing.T) {
 			},
 		},
 	}
-	podsSurge, err := getTargetWorkloadPods(ctx, workloadSurge, client)
+	podsSurge, err := getTargetWorkloadPods(ctx, workloadSurge, podLister)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "vpa_rollout"
+
+// Rollout phases whose duration is tracked by PhaseDuration
+const (
+	PhasePending          = "pending"
+	PhaseInProgress       = "in-progress"
+	PhaseSurgeBufferReady = "surge-buffer-ready"
+)
+
+var (
+	// Rollouts that were triggered on a workload, i.e. the workload's pods were restarted
+	RolloutsTriggered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollouts_triggered_total",
+		Help:      "Number of rollouts triggered, by namespace and workload kind.",
+	}, []string{"namespace", "workload_kind"})
+
+	// Rollouts that reached the 'complete' status
+	RolloutsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollouts_completed_total",
+		Help:      "Number of rollouts completed, by namespace and workload kind.",
+	}, []string{"namespace", "workload_kind"})
+
+	// Rollouts that could not be carried out, or that were failed after their phase deadline
+	RolloutsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollouts_failed_total",
+		Help:      "Number of rollouts that failed, by namespace and workload kind.",
+	}, []string{"namespace", "workload_kind"})
+
+	// Rollouts whose pods did not receive the VPA recommendation, e.g. because the VPA admission controller is down
+	RolloutsUnapplied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollouts_unapplied_total",
+		Help:      "Number of rollouts whose pods did not receive the VPA recommendation, by namespace and workload kind.",
+	}, []string{"namespace", "workload_kind"})
+
+	// Time spent in each phase of a rollout
+	PhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Time spent in each phase of a rollout: 'pending', 'in-progress' and 'surge-buffer-ready' (time for a surge buffer to become ready).",
+		Buckets:   prometheus.ExponentialBuckets(5, 2, 12),
+	}, []string{"phase"})
+
+	// Latest difference between the VPA recommendation and the workload pods' requests, as computed by RolloutIsNeeded
+	ResourceDiffPercent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "resource_diff_percent",
+		Help:      "Difference in percent between the VPA recommendation and the workload pods' requests, by VPA, container and resource.",
+	}, []string{"namespace", "vpa", "container", "resource"})
+
+	// Whether the workload pods' requests are outside of the VPA recommendation's bounds, as computed by RolloutIsNeeded
+	ResourceOutsideBounds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "resource_outside_bounds",
+		Help:      "1 if the requests of any of the workload's pods are outside of the VPA recommendation's lower and upper bounds, 0 otherwise, by VPA, container and resource.",
+	}, []string{"namespace", "vpa", "container", "resource"})
+
+	// Workload pods whose container was OOM killed within the VPA's OOM window, as computed by RolloutIsNeeded
+	RecentOOMKills = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "recent_oom_kills",
+		Help:      "Number of the workload's pods in which the container was OOM killed within the VPA's OOM window, by VPA and container.",
+	}, []string{"namespace", "vpa", "container"})
+
+	// Containers that needed a rollout, by the rule that triggered it
+	RolloutTriggerRules = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollout_trigger_rules_total",
+		Help:      "Number of times a container needed a rollout, by namespace, trigger mode and triggered rule.",
+	}, []string{"namespace", "mode", "rule"})
+
+	// VPAs whose recommendation was not acted on
+	RecommendationsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "recommendations_skipped_total",
+		Help:      "Number of times a VPA recommendation started being skipped, by namespace and reason.",
+	}, []string{"namespace", "reason"})
+
+	// Decisions taken because of containers OOM killed within the OOM window
+	OOMDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oom_decisions_total",
+		Help:      "Number of times recent OOM kills bypassed the cooldown for a memory increase or blocked a memory decrease, by namespace and decision.",
+	}, []string{"namespace", "decision"})
+
+	// Errors returned by the Kubernetes API server
+	APIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Number of errors returned by the Kubernetes API server, by operation.",
+	}, []string{"operation"})
+
+	// Orphaned surge buffer workloads deleted by the garbage collector
+	SurgeBuffersCollected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "surge_buffers_collected_total",
+		Help:      "Number of orphaned surge buffer workloads deleted, by namespace and reason.",
+	}, []string{"namespace", "reason"})
+
+	// Time spent reconciling a single VPA
+	ReconcileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Time spent reconciling a single VPA, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+// Operations reported by the APIErrors counter
+const (
+	OperationPatchWorkload        = "patch_workload"
+	OperationPatchVPA             = "patch_vpa"
+	OperationCreateSurgeBuffer    = "create_surge_buffer"
+	OperationUpdateSurgeBuffer    = "update_surge_buffer"
+	OperationDeleteSurgeBuffer    = "delete_surge_buffer"
+	OperationDeleteSurgeBufferPVC = "delete_surge_buffer_pvc"
+)
+
+// Reasons reported by the SurgeBuffersCollected counter
+const (
+	SurgeBufferGCReasonVPANotFound      = "vpa_not_found"
+	SurgeBufferGCReasonRolloutNotActive = "rollout_not_active"
+	SurgeBufferGCReasonMaxAgeExceeded   = "max_age_exceeded"
+)
+
+// Reasons reported by the RecommendationsSkipped counter
+const (
+	RecommendationSkipReasonConfigUnsupported = "config_unsupported"
+	RecommendationSkipReasonNoPodsMatched     = "no_pods_matched"
+	RecommendationSkipReasonNotProvided       = "not_provided"
+	RecommendationSkipReasonLowConfidence     = "low_confidence"
+	RecommendationSkipReasonStale             = "stale"
+)
+
+// Decisions reported by the OOMDecisions counter
+const (
+	OOMDecisionCooldownBypassed      = "cooldown_bypassed"
+	OOMDecisionMemoryDecreaseBlocked = "memory_decrease_blocked"
+)
+
+// Removes the per-VPA series of a VPA that no longer exists
+func DeleteVPA(vpaNamespace, vpaName string) {
+	ResourceDiffPercent.DeletePartialMatch(prometheus.Labels{"namespace": vpaNamespace, "vpa": vpaName})
+	ResourceOutsideBounds.DeletePartialMatch(prometheus.Labels{"namespace": vpaNamespace, "vpa": vpaName})
+	RecentOOMKills.DeletePartialMatch(prometheus.Labels{"namespace": vpaNamespace, "vpa": vpaName})
+}
@@ -7,24 +7,124 @@ const (
 	// The latest rollout status of the VPA
 	VPAAnnotationRolloutStatus = "vpa-rollout.influxdata.io/rollout-status"
 
+	// The time at which the VPA's rollout status was last set, in RFC3339 format
+	VPAAnnotationRolloutStatusUpdatedAt = "vpa-rollout.influxdata.io/rollout-status-updated-at"
+
+	// Mode the controller operates the VPA in. In 'observe' mode, the controller evaluates the VPA and reports what it would do without mutating any resource.
+	VPAAnnotationMode = "vpa-rollout.influxdata.io/mode"
+
+	// Values of the VPA mode annotation
+	VPAModeActive  = "active"
+	VPAModeObserve = "observe"
+
 	// Override the cooldown period between rollouts for a specific VPA
 	VPAAnnotationCooldownPeriod = "vpa-rollout.influxdata.io/cooldown-period"
 
+	// Override the maximum time a rollout can stay 'pending', waiting for its surge buffer to be ready, before it is failed
+	VPAAnnotationPendingDeadline = "vpa-rollout.influxdata.io/pending-deadline"
+
+	// Override the maximum time a rollout can stay 'in-progress' before it is failed
+	VPAAnnotationInProgressDeadline = "vpa-rollout.influxdata.io/in-progress-deadline"
+
+	// Override the time to wait after a failed rollout before attempting another one
+	VPAAnnotationFailedRolloutBackoff = "vpa-rollout.influxdata.io/failed-rollout-backoff"
+
+	// Override the time and the number of distinct recommendations the drift must stay the same for before triggering a rollout
+	VPAAnnotationStabilizationWindow       = "vpa-rollout.influxdata.io/stabilization-window"
+	VPAAnnotationStabilizationObservations = "vpa-rollout.influxdata.io/stabilization-observations"
+
+	// The drift observed while waiting for it to be stable, in JSON
+	VPAAnnotationDriftHistory = "vpa-rollout.influxdata.io/drift-history"
+
+	// Override the age after which the VPA recommendation is not acted on
+	VPAAnnotationRecommendationMaxAge = "vpa-rollout.influxdata.io/recommendation-max-age"
+
+	// Override the time during which an OOM kill bypasses the cooldown for memory increases and blocks memory decreases
+	VPAAnnotationOOMWindow = "vpa-rollout.influxdata.io/oom-window"
+
+	// Override the percentage the requests of the pods restarted by a rollout can differ from the recommendation by
+	VPAAnnotationVerificationTolerance = "vpa-rollout.influxdata.io/verification-tolerance"
+
 	// Override the percentage difference that will trigger a rollout for the VPA's target workload
 	VPAAnnotationDiffPercentTrigger = "vpa-rollout.influxdata.io/diff-percent-trigger"
 
+	// How the drift of a VPA's containers from the recommendation is evaluated, see the TriggerMode values
+	VPAAnnotationTriggerMode = "vpa-rollout.influxdata.io/trigger-mode"
+
+	// Rollouts are triggered when the requests differ from the recommendation's target by more than the thresholds
+	TriggerModeTarget = "target"
+	// Rollouts are triggered when the requests are outside of the recommendation's lower and upper bounds
+	TriggerModeBounds = "bounds"
+
+	// Which init containers of the workload's pods are compared with the recommendation and resized in the surge buffer, see the InitContainers values
+	VPAAnnotationInitContainers = "vpa-rollout.influxdata.io/init-containers"
+
+	// Init containers are ignored
+	InitContainersNone = "none"
+	// Native sidecars, i.e. init containers whose restartPolicy is 'Always', are handled like regular containers
+	InitContainersSidecars = "sidecars"
+	// Every init container is handled like a regular container
+	InitContainersAll = "all"
+
+	// Override the percentage difference that triggers a rollout, by resource and by direction in which the requests would change
+	VPAAnnotationCPUIncreaseDiffPercentTrigger    = "vpa-rollout.influxdata.io/cpu-increase-diff-percent-trigger"
+	VPAAnnotationCPUDecreaseDiffPercentTrigger    = "vpa-rollout.influxdata.io/cpu-decrease-diff-percent-trigger"
+	VPAAnnotationMemoryIncreaseDiffPercentTrigger = "vpa-rollout.influxdata.io/memory-increase-diff-percent-trigger"
+	VPAAnnotationMemoryDecreaseDiffPercentTrigger = "vpa-rollout.influxdata.io/memory-decrease-diff-percent-trigger"
+
+	// Override the minimum absolute difference that triggers a rollout, as a resource quantity (e.g. '100m' or '128Mi')
+	VPAAnnotationMinCPUDiffTrigger    = "vpa-rollout.influxdata.io/min-cpu-diff-trigger"
+	VPAAnnotationMinMemoryDiffTrigger = "vpa-rollout.influxdata.io/min-memory-diff-trigger"
+
+	// Comma-separated names of the only containers checked for drift from the VPA recommendation. All recommended containers are checked by default.
+	VPAAnnotationIncludedContainers = "vpa-rollout.influxdata.io/included-containers"
+
+	// Comma-separated names of containers that are not checked for drift from the VPA recommendation
+	VPAAnnotationExcludedContainers = "vpa-rollout.influxdata.io/excluded-containers"
+
+	// Override the diff percent trigger of specific containers, as comma-separated 'container=percent' pairs
+	VPAAnnotationContainerDiffPercentTriggers = "vpa-rollout.influxdata.io/container-diff-percent-triggers"
+
 	// Enables the surge buffer feature for the VPA's target workload
 	// This will create a "surge buffer" workload resource that is a copy of the target workload with the resource requests overridden to match the VPA recommendation.
 	VPAAnnotationSurgeBufferEnabled = "vpa-rollout.influxdata.io/surge-buffer-enabled"
 
 	// Override the number of surge buffer pods to create for the VPA's target workload during a rollout. Default is 1.
+	// With "auto", it is derived from the workload's rolling update strategy.
 	VPAAnnotationNumberOfSurgeBufferPods = "vpa-rollout.influxdata.io/number-of-surge-buffer-pods"
 
+	// Value of the number of surge buffer pods annotation that derives it from the workload's maxSurge and maxUnavailable
+	SurgeBufferReplicasAuto = "auto"
+
 	// Default number of surge buffer pods if not specified in the VPA annotation
 	DefaultSurgeBufferReplicas = "1"
 
+	// Override how the surge buffer of a StatefulSet is built, see the SurgeBufferStatefulSetMode values
+	VPAAnnotationSurgeBufferStatefulSetMode = "vpa-rollout.influxdata.io/surge-buffer-statefulset-mode"
+
+	// Surge buffers of StatefulSets are StatefulSets with the same volumeClaimTemplates, whose PVCs are deleted with the surge buffer
+	SurgeBufferStatefulSetModeStatefulSet = "statefulset"
+	// Surge buffers of StatefulSets are StatefulSets whose volumeClaimTemplates are replaced by ephemeral volumes
+	SurgeBufferStatefulSetModeEphemeral = "ephemeral"
+	// Surge buffers of StatefulSets are Deployments whose volumeClaimTemplates are replaced by ephemeral volumes
+	SurgeBufferStatefulSetModeDeployment = "deployment"
+
+	// Pod template overrides of the surge buffer, in JSON, applied on top of the cluster-wide ones: annotations, removeAnnotations, labels, removeLabels, priorityClassName, nodeSelector, tolerations and affinity
+	VPAAnnotationSurgeBufferPodTemplateOverrides = "vpa-rollout.influxdata.io/surge-buffer-pod-template-overrides"
+
+	// Override the governing service of the surge buffer of a StatefulSet, so that its pods don't join the workload's headless service
+	VPAAnnotationSurgeBufferServiceName = "vpa-rollout.influxdata.io/surge-buffer-service-name"
+
 	// Label to indicate that the Pod is a "surge-buffer" pod
 	LabelSurgeBuffer = "vpa-rollout.influxdata.io/surge-buffer"
+
+	// Labels linking a surge buffer workload to the VPA it was created for and to the workload it was copied from
+	LabelSurgeBufferVPAUID            = "vpa-rollout.influxdata.io/vpa-uid"
+	LabelSurgeBufferSourceWorkloadUID = "vpa-rollout.influxdata.io/source-workload-uid"
+
+	// Annotations holding the names of the VPA and of the source workload of a surge buffer workload, which may be too long for label values
+	AnnotationSurgeBufferVPAName            = "vpa-rollout.influxdata.io/vpa-name"
+	AnnotationSurgeBufferSourceWorkloadName = "vpa-rollout.influxdata.io/source-workload-name"
 )
 
 var (
@@ -3,18 +3,25 @@ package test
 import (
 	"context"
 	"fmt"
+	"time"
 
 	autoscaling "k8s.io/api/autoscaling/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	vpa_types "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/limitrange"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/influxdata/vpa-rollout-controller/pkg/utils"
 )
@@ -237,6 +244,17 @@ func WithStatus(options ...VPAOption) VPAOption {
 	}
 }
 
+// WithCondition sets a condition on the VPA status, as the VPA recommender does
+func WithCondition(conditionType vpa_types.VerticalPodAutoscalerConditionType, status corev1.ConditionStatus, lastTransitionTime time.Time) VPAOption {
+	return func(vpa *vpa_types.VerticalPodAutoscaler) {
+		vpa.Status.Conditions = append(vpa.Status.Conditions, vpa_types.VerticalPodAutoscalerCondition{
+			Type:               conditionType,
+			Status:             status,
+			LastTransitionTime: metav1.NewTime(lastTransitionTime),
+		})
+	}
+}
+
 func WithTargetCPU(q resource.Quantity) VPAContainerRecommendationOption {
 	return func(rec *vpa_types.RecommendedContainerResources) {
 		if rec.Target == nil {
@@ -283,7 +301,49 @@ func CreateTestWorkload(name, namespace string, restartedAt string) map[string]i
 	return workload
 }
 
-// CreateTestClientset creates a fake Kubernetes clientset for testing
-func CreateTestClientset() *fake.Clientset {
-	return fake.NewSimpleClientset()
+// CreateTestPodLister creates a pod lister backed by an in-memory indexer containing the given pods
+func CreateTestPodLister(pods ...*corev1.Pod) corelisters.PodLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, pod := range pods {
+		_ = indexer.Add(pod)
+	}
+	return corelisters.NewPodLister(indexer)
+}
+
+// CreateTestLimitRangeCalculator creates a LimitRange calculator backed by an informer over the given LimitRanges
+func CreateTestLimitRangeCalculator(limitRanges ...*corev1.LimitRange) limitrange.LimitRangeCalculator {
+	objects := make([]runtime.Object, 0, len(limitRanges))
+	for _, limitRange := range limitRanges {
+		objects = append(objects, limitRange)
+	}
+	calculator, err := limitrange.NewLimitsRangeCalculator(informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(objects...), 0))
+	if err != nil {
+		panic(err.Error())
+	}
+	return calculator
+}
+
+// CreateTestRESTMapper creates a RESTMapper that knows about the apps/v1 Deployment and StatefulSet kinds
+func CreateTestRESTMapper() meta.RESTMapper {
+	restMapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Group: "apps", Version: "v1"}})
+	restMapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	restMapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}, meta.RESTScopeNamespace)
+	return restMapper
+}
+
+// FakeWorkloadListers serves the given workload objects from an in-memory indexer, whatever the requested resource
+type FakeWorkloadListers struct {
+	Workloads   []map[string]interface{}
+	ShouldError bool
+}
+
+func (f *FakeWorkloadListers) ForResource(ctx context.Context, gvr schema.GroupVersionResource) (cache.GenericLister, error) {
+	if f.ShouldError {
+		return nil, fmt.Errorf("simulated error")
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, workload := range f.Workloads {
+		_ = indexer.Add(&unstructured.Unstructured{Object: workload})
+	}
+	return cache.NewGenericLister(indexer, gvr.GroupResource()), nil
 }